@@ -0,0 +1,252 @@
+package pinub
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// export sends everything pinub stores about the user as a zip archive: JSON
+// files for programs and the pins as Netscape bookmarks, which browsers
+// import.
+func (a *App) export() http.HandlerFunc {
+	tpl, _ := template.ParseFS(tpls, "templates/bookmarks.html")
+
+	type exportProfile struct {
+		Email      string `json:"email"`
+		Username   string `json:"username,omitempty"`
+		Visibility string `json:"visibility"`
+		// visibility by tag, for the tags shared on their own
+		SharedTags map[string]string `json:"shared_tags,omitempty"`
+		VerifiedAt *time.Time        `json:"verified_at"`
+		TwoFactor  bool              `json:"two_factor"`
+		DeleteAt   *time.Time        `json:"delete_at,omitempty"`
+		CreatedAt  *time.Time        `json:"created_at"`
+	}
+	type exportPin struct {
+		URL       string     `json:"url"`
+		Title     string     `json:"title"`
+		Notes     string     `json:"notes"`
+		Tags      []string   `json:"tags"`
+		Hidden    bool       `json:"hidden"`
+		CreatedAt *time.Time `json:"created_at"`
+	}
+	type exportSession struct {
+		UserAgent string     `json:"user_agent"`
+		IP        string     `json:"ip"`
+		Remember  bool       `json:"remember"`
+		ActiveAt  *time.Time `json:"active_at"`
+		CreatedAt *time.Time `json:"created_at"`
+	}
+	type exportPasskey struct {
+		Name      string     `json:"name"`
+		UsedAt    *time.Time `json:"used_at"`
+		CreatedAt *time.Time `json:"created_at"`
+	}
+	type exportInvite struct {
+		Code      string     `json:"code"`
+		MaxUses   int        `json:"max_uses"`
+		Uses      int        `json:"uses"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		CreatedAt *time.Time `json:"created_at"`
+	}
+	type exportEvent struct {
+		Action    string     `json:"action"`
+		Detail    string     `json:"detail"`
+		ByAdmin   bool       `json:"by_admin,omitempty"`
+		IP        string     `json:"ip"`
+		UserAgent string     `json:"user_agent"`
+		CreatedAt *time.Time `json:"created_at"`
+	}
+	type exportIdentity struct {
+		Issuer    string     `json:"issuer"`
+		Subject   string     `json:"subject"`
+		CreatedAt *time.Time `json:"created_at"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+		ctx := r.Context()
+
+		links, err := a.db.Links(ctx, user, "")
+		if err != nil {
+			http.Error(w, "cannot get links from database", http.StatusBadRequest)
+			return
+		}
+		shares, err := a.db.TagShares(ctx, user)
+		if err != nil {
+			http.Error(w, "cannot get shared tags from database", http.StatusBadRequest)
+			return
+		}
+		logins, err := a.db.Logins(ctx, user)
+		if err != nil {
+			http.Error(w, "cannot get sessions from database", http.StatusBadRequest)
+			return
+		}
+		passkeys, err := a.db.Passkeys(ctx, user)
+		if err != nil {
+			http.Error(w, "cannot get passkeys from database", http.StatusBadRequest)
+			return
+		}
+		identities, err := a.db.Identities(ctx, user)
+		if err != nil {
+			http.Error(w, "cannot get identities from database", http.StatusBadRequest)
+			return
+		}
+		invites, err := a.db.Invites(ctx, user.ID)
+		if err != nil {
+			http.Error(w, "cannot get invites from database", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "export", "")
+		// all of them, the export includes itself
+		events, err := a.db.AuditEvents(ctx, user.ID, -1, 0)
+		if err != nil {
+			http.Error(w, "cannot get audit events from database", http.StatusBadRequest)
+			return
+		}
+
+		pins := []exportPin{}
+		for _, l := range links {
+			pins = append(pins, exportPin{l.URL, l.Title, l.Notes, append([]string{}, l.Tags...), l.Hidden, l.CreatedAt})
+		}
+		var sharedTags map[string]string
+		for _, s := range shares {
+			if sharedTags == nil {
+				sharedTags = map[string]string{}
+			}
+			sharedTags[s.Tag] = s.Visibility
+		}
+		sessions := []exportSession{}
+		for _, l := range logins {
+			sessions = append(sessions, exportSession{l.UserAgent, l.IP, l.Remember, l.ActiveAt, l.CreatedAt})
+		}
+		keys := []exportPasskey{}
+		for _, pk := range passkeys {
+			keys = append(keys, exportPasskey{pk.Name, pk.UsedAt, pk.CreatedAt})
+		}
+		ids := []exportIdentity{}
+		for _, id := range identities {
+			ids = append(ids, exportIdentity{id.Issuer, id.Subject, id.CreatedAt})
+		}
+		codes := []exportInvite{}
+		for _, i := range invites {
+			codes = append(codes, exportInvite{i.Code, i.MaxUses, i.Uses, i.ExpiresAt, i.CreatedAt})
+		}
+		activity := []exportEvent{}
+		for _, e := range events {
+			byAdmin := e.ActorID != 0 && e.ActorID != user.ID
+			activity = append(activity, exportEvent{e.Action, e.Detail, byAdmin, e.IP, e.UserAgent, e.CreatedAt})
+		}
+
+		files := []struct {
+			name string
+			v    any
+		}{
+			{"profile.json", exportProfile{user.Email, user.Username, user.Visibility, sharedTags, user.VerifiedAt,
+				user.TwoFactor(), user.DeleteAt, user.CreatedAt}},
+			{"pins.json", pins},
+			{"sessions.json", sessions},
+			{"passkeys.json", keys},
+			{"identities.json", ids},
+			{"invites.json", codes},
+			{"activity.json", activity},
+		}
+
+		name := "pinub-" + time.Now().Format("2006-01-02") + ".zip"
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("Cache-Control", "no-store")
+
+		// the headers are sent with the first byte, errors can only be
+		// logged from here on
+		z := zip.NewWriter(w)
+		for _, file := range files {
+			f, err := z.Create(file.name)
+			if err != nil {
+				slog.Error("cannot write export", err)
+				return
+			}
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(file.v); err != nil {
+				slog.Error("cannot write export", err)
+				return
+			}
+		}
+		f, err := z.Create("bookmarks.html")
+		if err != nil {
+			slog.Error("cannot write export", err)
+			return
+		}
+		if err := tpl.Execute(f, links); err != nil {
+			slog.Error("cannot write export", err)
+			return
+		}
+		if err := z.Close(); err != nil {
+			slog.Error("cannot write export", err)
+		}
+	}
+}
+
+// deleteAccount deletes the account of the user once the grace period is
+// over, which the user confirms with their password. Until then they may
+// sign in again and keep their account.
+func (a *App) deleteAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		if r.FormValue("action") == "cancel" {
+			if err := a.db.CancelDeletion(r.Context(), user); err != nil {
+				http.Error(w, "cannot cancel deletion", http.StatusBadRequest)
+				return
+			}
+			a.audit(r, user, user, "account.keep", "")
+
+			a.flash(w, "your account is kept")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		if !a.confirmed(r, user, r.FormValue("pass")) {
+			a.flash(w, confirmFailure(user))
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		if err := a.db.ScheduleDeletion(r.Context(), user, a.DeletionGrace); err != nil {
+			http.Error(w, "cannot delete account", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "account.delete", "")
+
+		http.SetCookie(w, &http.Cookie{Name: cookieName, Path: "/", MaxAge: -1})
+		a.flash(w, "your account will be deleted on "+user.DeleteAt.Format("02.01.06 15:04")+
+			" UTC, sign in before then to keep it")
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+	}
+}
+
+// inWords returns d in days or hours for people to read, empty for zero.
+func inWords(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return ""
+	case d >= 48*time.Hour:
+		return strconv.Itoa(int(d/(24*time.Hour))) + " days"
+	case d >= 24*time.Hour:
+		return "a day"
+	case d >= 2*time.Hour:
+		return strconv.Itoa(int(d/time.Hour)) + " hours"
+	case d >= time.Hour:
+		return "an hour"
+	}
+
+	return d.Round(time.Minute).String()
+}
@@ -0,0 +1,148 @@
+package pinub
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userRows returns the number of rows referencing the user in every table
+// with a user_id or created_by column.
+func userRows(t *testing.T, a *App, user *User) map[string]int {
+	t.Helper()
+
+	rows, err := a.db.DB.Query("SELECT m.name, p.name FROM sqlite_master m, pragma_table_info(m.name) p " +
+		" WHERE m.type = 'table' AND p.name IN ('user_id', 'created_by');")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	var columns [][2]string
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			t.Fatal(err)
+		}
+		columns = append(columns, [2]string{table, column})
+	}
+	rows.Close()
+
+	for _, c := range columns {
+		var n int
+		if err := a.db.DB.QueryRow("SELECT COUNT(*) FROM "+c[0]+" WHERE "+c[1]+" = $1;", user.ID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		counts[c[0]] += n
+	}
+
+	return counts
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	a, srv, _ := newTestApp(t)
+	user := createUser(t, a, "leaving@example.com")
+	other := createUser(t, a, "staying@example.com")
+
+	c := newTestClient(t, srv)
+	c.signIn("leaving@example.com")
+	c.pin("https://go.dev/", "go")
+	c.pin("https://example.com/", "shared")
+	c.post("/sharing/tag", url.Values{"tag": {"go"}, "visibility": {VisibilityUnlisted}})
+	o := newTestClient(t, srv)
+	o.signIn("staying@example.com")
+	o.pin("https://example.com/", "")
+
+	for _, err := range []error{
+		a.db.AddPasskey(ctx, user, &Passkey{CredentialID: []byte{1}, PublicKey: []byte{2}, Algorithm: -7, Name: "key"}),
+		a.db.AddIdentity(ctx, user, "https://issuer.example", "subject"),
+		a.db.CreateInvite(ctx, &Invite{CreatedBy: user.ID, MaxUses: 1}, time.Hour),
+		a.db.EnableTOTP(ctx, user, "JBSWY3DPEHPK3PXP", 1, []string{"code"}),
+		a.db.CreatePasswordReset(ctx, user, "reset", time.Hour),
+		a.db.CreateMagicLink(ctx, user, "magic", time.Hour),
+		a.db.CreateConfirmation(ctx, user, "confirm", time.Hour),
+		a.db.CreateEmailVerification(ctx, user, "new@example.com", "verify", time.Hour),
+		a.db.CreateEmailRevert(ctx, user, "old@example.com", "revert", time.Hour),
+		a.db.AddAuditEvent(ctx, &AuditEvent{UserID: other.ID, ActorID: user.ID, Action: "admin.grant", Detail: "asked by leaving@example.com"}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := userRows(t, a, user)
+	for _, table := range []string{"user_links", "link_tags", "tag_shares", "logins", "passkeys", "identities", "invites",
+		"recovery_codes", "password_resets", "magic_links", "confirmations", "email_verifications", "email_reverts", "audit_events"} {
+		if before[table] == 0 {
+			t.Errorf("no %s of the user to delete", table)
+		}
+	}
+
+	if err := a.db.DeleteUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, n := range userRows(t, a, user) {
+		if n > 0 {
+			t.Errorf("%s: %d rows of the deleted user left", table, n)
+		}
+	}
+	var n int
+	if err := a.db.DB.QueryRow("SELECT COUNT(*) FROM audit_events WHERE instr(detail, 'leaving@example.com') > 0;").Scan(&n); err != nil || n > 0 {
+		t.Errorf("audit details naming the deleted user: %d, %v", n, err)
+	}
+	if err := a.db.DB.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_check;").Scan(&n); err != nil || n > 0 {
+		t.Errorf("foreign key violations: %d, %v", n, err)
+	}
+
+	// links go unless somebody else pinned them
+	var links []string
+	rows, err := a.db.DB.Query("SELECT url FROM links ORDER BY url;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var link string
+		rows.Scan(&link)
+		links = append(links, link)
+	}
+	rows.Close()
+	if len(links) != 1 || links[0] != "https://example.com/" {
+		t.Errorf("links left: %q", links)
+	}
+	if counts := userRows(t, a, other); counts["user_links"] != 1 || counts["logins"] == 0 {
+		t.Errorf("rows of the other user: %v", counts)
+	}
+}
+
+// Signing out takes a form of pinub, so other sites cannot sign users out
+// with a link or an image.
+func TestSignout(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	createUser(t, a, "signout@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("signout@example.com")
+
+	if _, body := c.get("/"); !strings.Contains(body, `action="/signout"`) {
+		t.Error("no form to sign out")
+	}
+	c.get("/signout")
+	if !c.signedIn() {
+		t.Error("signed out by GET")
+	}
+	resp, err := c.PostForm(srv.URL+"/signout", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !c.signedIn() {
+		t.Error("signed out without CSRF token")
+	}
+
+	c.post("/signout", url.Values{})
+	if c.signedIn() {
+		t.Error("not signed out")
+	}
+}
@@ -0,0 +1,114 @@
+package pinub
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/exp/slog"
+)
+
+// adminPageSize is the number of users listed per page.
+const adminPageSize = 50
+
+// admin serves next only to admins. Everyone else sees no admin area.
+func admin(next http.HandlerFunc) http.HandlerFunc {
+	return private(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.Context().Value(userContextKey).(*User); !user.IsAdmin {
+			http.NotFound(w, r)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// adminUsers lists and searches the users.
+func (a *App) adminUsers() http.HandlerFunc {
+	tpl, _ := template.New("admin.html").Funcs(funcs).ParseFS(tpls, "templates/admin.html", layoutTpl)
+
+	type adminData struct {
+		Query string
+		Users []UserSummary
+		// Prev and Next are the numbers of the pages around this one,
+		// zero if there is none.
+		Prev, Next int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := adminData{Query: r.FormValue("q")}
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		page = max(page, 1)
+
+		// one more than shown tells whether there is a next page
+		users, err := a.db.SearchUsers(r.Context(), data.Query, adminPageSize+1, (page-1)*adminPageSize)
+		if err != nil {
+			http.Error(w, "cannot get users from database", http.StatusBadRequest)
+			return
+		}
+		if len(users) > adminPageSize {
+			users, data.Next = users[:adminPageSize], page+1
+		}
+		data.Users, data.Prev = users, page-1
+
+		render(w, r, tpl, data)
+	}
+}
+
+// adminUser changes the account of another user.
+func (a *App) adminUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := r.Context().Value(userContextKey).(*User)
+
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		user, err := a.db.ByID(r.Context(), id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		// admins cannot lock themselves out
+		action := r.FormValue("action")
+		if user.ID == actor.ID && action != "logout" && action != "reset-2fa" {
+			a.flash(w, "you cannot do that to your own account")
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
+			return
+		}
+
+		var notice string
+		switch action {
+		case "disable":
+			err = a.db.SetDisabled(r.Context(), user, true)
+			notice = user.Email + " disabled"
+		case "enable":
+			err = a.db.SetDisabled(r.Context(), user, false)
+			notice = user.Email + " enabled"
+		case "logout":
+			err = a.db.DeleteLogins(r.Context(), user)
+			notice = user.Email + " signed out everywhere"
+		case "reset-2fa":
+			err = a.db.DisableTOTP(r.Context(), user)
+			notice = "two-factor authentication of " + user.Email + " turned off"
+		case "delete":
+			err = a.db.DeleteUser(r.Context(), user)
+			notice = user.Email + " deleted"
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("admin action failed", err, "action", action, "user", user.ID)
+			http.Error(w, "cannot change user", http.StatusBadRequest)
+			return
+		}
+
+		a.audit(r, actor, user, "admin."+action, "")
+		a.flash(w, notice)
+		http.Redirect(w, r, "/admin?q="+url.QueryEscape(r.FormValue("q")), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,117 @@
+package pinub
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/exp/slog"
+)
+
+// auditActions describes the actions of audit events to the users they are
+// about. Actions missing here are shown as they are.
+var auditActions = map[string]string{
+	"register":           "registered",
+	"signin":             "signed in",
+	"signin.failed":      "failed to sign in",
+	"signout":            "signed out",
+	"session.revoke":     "signed out a session",
+	"session.revoke-all": "signed out everywhere",
+	"password.change":    "changed the password",
+	"password.reset":     "reset the password",
+	"email.change":       "changed the email address",
+	"email.revert":       "restored the previous email address",
+	"2fa.enable":         "turned on two-factor authentication",
+	"2fa.disable":        "turned off two-factor authentication",
+	"2fa.recovery-codes": "created new recovery codes",
+	"passkey.add":        "added a passkey",
+	"passkey.delete":     "removed a passkey",
+	"identity.link":      "linked a single sign-on account",
+	"token.feed":         "created feed links",
+	"token.share":        "created a share link",
+	"export":             "downloaded their data",
+	"account.delete":     "deleted the account",
+	"account.keep":       "kept the account",
+	"admin.disable":      "an admin disabled the account",
+	"admin.enable":       "an admin enabled the account",
+	"admin.logout":       "an admin signed out all sessions",
+	"admin.reset-2fa":    "an admin turned off two-factor authentication",
+	"admin.grant":        "became an admin",
+	"admin.revoke":       "is no admin anymore",
+}
+
+const (
+	// auditPageSize is the number of events listed per page for admins.
+	auditPageSize = 50
+	// recentAuditEvents is the number of events users see on their
+	// profile.
+	recentAuditEvents = 20
+)
+
+// describeAction returns what happened in an audit event with action, in
+// words for the user it is about.
+func describeAction(action string) string {
+	if words, ok := auditActions[action]; ok {
+		return words
+	}
+
+	return action
+}
+
+// audit records that actor did action to user, from the device of the
+// request. Either may be nil. Failures are logged, they do not stop the
+// action.
+func (a *App) audit(r *http.Request, actor, user *User, action, detail string) {
+	e := &AuditEvent{
+		Action:    action,
+		Detail:    detail,
+		IP:        a.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if actor != nil {
+		e.ActorID = actor.ID
+	}
+	if user != nil {
+		e.UserID = user.ID
+	}
+
+	if err := a.db.AddAuditEvent(r.Context(), e); err != nil {
+		slog.Error("cannot add audit event", err, "action", action)
+	}
+}
+
+// adminAudit lists the audit events of all users, or of the user with the
+// id in the user parameter.
+func (a *App) adminAudit() http.HandlerFunc {
+	tpl, _ := template.New("admin_audit.html").Funcs(funcs).ParseFS(tpls, "templates/admin_audit.html", layoutTpl)
+
+	type auditData struct {
+		// User is the id of the user whose events are listed, zero for
+		// all users.
+		User   int
+		Events []AuditEvent
+		// Prev and Next are the numbers of the pages around this one,
+		// zero if there is none.
+		Prev, Next int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data auditData
+		data.User, _ = strconv.Atoi(r.FormValue("user"))
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		page = max(page, 1)
+
+		// one more than shown tells whether there is a next page
+		events, err := a.db.AuditEvents(r.Context(), data.User, auditPageSize+1, (page-1)*auditPageSize)
+		if err != nil {
+			http.Error(w, "cannot get audit events from database", http.StatusBadRequest)
+			return
+		}
+		if len(events) > auditPageSize {
+			events, data.Next = events[:auditPageSize], page+1
+		}
+		data.Events, data.Prev = events, page-1
+
+		render(w, r, tpl, data)
+	}
+}
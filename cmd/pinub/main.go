@@ -1,26 +1,524 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/netip"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"dab.io/pinub"
+	"dab.io/pinub/internal/cookies"
+	"dab.io/pinub/internal/mailer"
+	"dab.io/pinub/internal/oidc"
+	"dab.io/pinub/internal/password"
 	"golang.org/x/exp/slog"
 )
 
+// devKey is publicly known and only used with -insecure-dev.
+var devKey, _ = hex.DecodeString("7D8C9FA38B164A11843404B989E6491F")
+
 func main() {
-	secretKey, err := hex.DecodeString(env("SECRET_KEY", "7D8C9FA38B164A11843404B989E6491F"))
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"rotate-key":  rotateKey,
+			"disable-2fa": disableTwoFactor,
+			"make-admin":  makeAdmin,
+			"invite":      invite,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	insecureDev := flag.Bool("insecure-dev", false, "use a publicly known secret key and allow cookies over plain HTTP")
+	flag.Parse()
+
+	keys, err := keyring(*insecureDev)
 	if err != nil {
 		slog.Error("secret key error", err)
+		os.Exit(1)
+	}
+
+	registration := env("REGISTRATION", pinub.RegistrationOpen)
+	switch registration {
+	case pinub.RegistrationOpen, pinub.RegistrationInvite, pinub.RegistrationClosed:
+	default:
+		slog.Error("REGISTRATION must be open, invite or closed", "value", registration)
+		os.Exit(1)
+	}
+
+	unverified := env("UNVERIFIED", pinub.UnverifiedLimit)
+	switch unverified {
+	case pinub.UnverifiedAllow, pinub.UnverifiedLimit, pinub.UnverifiedBlock:
+	default:
+		slog.Error("UNVERIFIED must be allow, limit or block", "value", unverified)
+		os.Exit(1)
 	}
 
 	app := &pinub.App{
 		ListenAddress: env("LISTEN_ADDRESS", "127.0.0.1:8080"),
-		SecretKey:     secretKey,
+		Keys:          keys,
+		InsecureDev:   *insecureDev,
+		BaseURL:       env("BASE_URL", ""),
+
+		ReadHeaderTimeout: duration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       duration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      duration("WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       duration("IDLE_TIMEOUT", 120*time.Second),
+		ShutdownTimeout:   duration("SHUTDOWN_TIMEOUT", 10*time.Second),
+
+		SessionIdleTimeout: duration("SESSION_IDLE_TIMEOUT", 30*24*time.Hour),
+		SessionLifetime:    duration("SESSION_LIFETIME", 365*24*time.Hour),
+		DeletionGrace:      duration("ACCOUNT_DELETION_GRACE", 7*24*time.Hour),
+		AuditRetention:     duration("AUDIT_RETENTION", 180*24*time.Hour),
 
 		DSN: env("DSN", "pinub.sqlite3"),
+
+		Mailer:       newMailer(*insecureDev),
+		Unverified:   unverified,
+		Registration: registration,
+		UserInvites:  boolean("USER_INVITES", false),
+		MagicLinks:   boolean("MAGIC_LINKS", false),
+		OIDCName:     env("OIDC_NAME", "single sign-on"),
+	}
+	if issuer, ok := os.LookupEnv("OIDC_ISSUER"); ok {
+		app.OIDC = &oidc.Provider{
+			Issuer:       issuer,
+			ClientID:     env("OIDC_CLIENT_ID", ""),
+			ClientSecret: env("OIDC_CLIENT_SECRET", ""),
+		}
+	}
+	if header, ok := os.LookupEnv("PROXY_AUTH_HEADER"); ok {
+		proxies, err := prefixes(env("TRUSTED_PROXIES", ""))
+		if err != nil {
+			slog.Error("TRUSTED_PROXIES error", err)
+			os.Exit(1)
+		}
+		if len(proxies) == 0 {
+			slog.Error("TRUSTED_PROXIES must list the addresses of the proxies setting " + header)
+			os.Exit(1)
+		}
+		app.ProxyHeader = header
+		app.TrustedProxies = proxies
+	}
+	if list, ok := os.LookupEnv("REVERSE_PROXIES"); ok {
+		proxies, err := prefixes(list)
+		if err != nil {
+			slog.Error("REVERSE_PROXIES error", err)
+			os.Exit(1)
+		}
+		app.ReverseProxies = proxies
+	}
+	app.DisableLocalSignin = boolean("DISABLE_LOCAL_SIGNIN", false)
+	app.PersistLoginLimits = boolean("PERSIST_LOGIN_LIMITS", false)
+	app.Passwords = &password.Policy{
+		MinLength:   integer("PASSWORD_MIN_LENGTH", password.DefaultPolicy.MinLength, 1, 1024),
+		MinStrength: integer("PASSWORD_MIN_STRENGTH", password.DefaultPolicy.MinStrength, 0, 4),
+	}
+	app.Hasher = &password.Hasher{
+		Algorithm: env("PASSWORD_HASH", password.DefaultHasher.Algorithm),
+		Argon2: password.Argon2Params{
+			Memory:  uint32(integer("ARGON2_MEMORY", int(password.DefaultHasher.Argon2.Memory), 1, math.MaxUint32)),
+			Time:    uint32(integer("ARGON2_TIME", int(password.DefaultHasher.Argon2.Time), 1, math.MaxUint32)),
+			Threads: uint8(integer("ARGON2_THREADS", int(password.DefaultHasher.Argon2.Threads), 1, math.MaxUint8)),
+		},
+		BcryptCost: integer("BCRYPT_COST", password.DefaultHasher.BcryptCost, 0, math.MaxInt32),
+	}
+	// the parameters of the chosen algorithm are checked by hashing once
+	if _, err := app.Hasher.Hash(""); err != nil {
+		slog.Error("PASSWORD_HASH error", err)
+		os.Exit(1)
+	}
+	if path, ok := os.LookupEnv("BREACHED_PASSWORDS"); ok {
+		breached, err := password.OpenBreached(path)
+		if err != nil {
+			slog.Error("BREACHED_PASSWORDS error", err)
+			os.Exit(1)
+		}
+		app.Passwords.Breached = breached
+	}
+
+	// fly.io stops machines with SIGINT, others with SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = app.Start(ctx)
+	stop()
+	if app.Passwords.Breached != nil {
+		app.Passwords.Breached.Close()
+	}
+	if err != nil {
+		slog.Error("pinub failed", err)
+		os.Exit(1)
+	}
+}
+
+// newMailer sends emails through the SMTP server in SMTP_ADDR. Without a
+// server, emails are written to MAIL_DIR or to the log. The log holds the
+// whole emails only with insecureDev, as they contain sign in links.
+func newMailer(insecureDev bool) mailer.Mailer {
+	from := env("MAIL_FROM", "pinub@localhost")
+
+	if addr, ok := os.LookupEnv("SMTP_ADDR"); ok {
+		return &mailer.SMTP{
+			Addr:     addr,
+			Username: env("SMTP_USERNAME", ""),
+			Password: env("SMTP_PASSWORD", ""),
+			From:     from,
+		}
+	}
+
+	dir := env("MAIL_DIR", "")
+	if dir == "" && !insecureDev {
+		slog.Warn("SMTP_ADDR is not set, emails are not sent and only their recipient and subject are logged")
+	}
+
+	return &mailer.Log{Dir: dir, From: from, Body: insecureDev}
+}
+
+// keyringPath is the file holding the cookie keys. It defaults to the file
+// keyring in DATA_DIR, which defaults to the directory of the database.
+func keyringPath() string {
+	dataDir := env("DATA_DIR", filepath.Dir(env("DSN", "pinub.sqlite3")))
+
+	return env("KEYRING", filepath.Join(dataDir, "keyring"))
+}
+
+// keyring loads the cookie keys. They are read from the keyring file if it
+// exists, or else from the hex encoded key in SECRET_KEY. Setting both is an
+// error, as one of them would be ignored. Without either, a new random key
+// is generated and stored in the keyring file, unless insecureDev asks for
+// the publicly known development key, which is refused otherwise.
+func keyring(insecureDev bool) (*cookies.Keyring, error) {
+	path := keyringPath()
+
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		if _, ok := os.LookupEnv("SECRET_KEY"); ok {
+			return nil, fmt.Errorf("both SECRET_KEY and the keyring %s are set, remove one of them", path)
+		}
+		keys, err := cookies.ParseKeyring(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, k := range keys.Keys() {
+			if bytes.Equal(k.Secret, devKey) && !insecureDev {
+				return nil, fmt.Errorf("keyring %s holds the publicly known development key", path)
+			}
+		}
+
+		return keys, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
 	}
-	app.Start()
+
+	if val, ok := os.LookupEnv("SECRET_KEY"); ok {
+		secretKey, err := hex.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("SECRET_KEY: %w", err)
+		}
+		if bytes.Equal(secretKey, devKey) && !insecureDev {
+			return nil, errors.New("SECRET_KEY is the publicly known development key")
+		}
+		key, err := cookies.NewKey(secretKey)
+		if err != nil {
+			return nil, fmt.Errorf("SECRET_KEY: %w", err)
+		}
+
+		return cookies.NewKeyring(key), nil
+	}
+
+	if insecureDev {
+		slog.Warn("using the publicly known development key")
+		key, err := cookies.NewKey(devKey)
+
+		return cookies.NewKeyring(key), err
+	}
+
+	key, err := cookies.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	keys := cookies.NewKeyring(key)
+	if err := writeKeyring(path, keys); err != nil {
+		return nil, fmt.Errorf("cannot store generated key: %w", err)
+	}
+	slog.Info("generated new secret key", "keyring", path)
+
+	return keys, nil
+}
+
+// writeKeyring replaces the keyring file at once, so a starting pinub never
+// reads half of it. Only the owner may read the file.
+func writeKeyring(path string, keys *cookies.Keyring) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keyring-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := keys.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// rotateKey adds a new primary key to the keyring file. Cookies encrypted
+// with the previous keys stay valid and are re-encrypted with the new key
+// when they are used next.
+func rotateKey(args []string) error {
+	fset := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	keep := fset.Int("keep", 2, "number of previous keys that may still decrypt cookies")
+	fset.Parse(args)
+
+	// the first rotation starts from SECRET_KEY or a generated key
+	keys, err := keyring(false)
+	if err != nil {
+		return err
+	}
+	key, err := cookies.GenerateKey()
+	if err != nil {
+		return err
+	}
+	keys = keys.Rotate(key, *keep)
+
+	if err := writeKeyring(keyringPath(), keys); err != nil {
+		return err
+	}
+
+	fmt.Printf("new primary key %08x, %d previous keys kept; restart pinub to use it\n", key.ID, len(keys.Keys())-1)
+	if _, ok := os.LookupEnv("SECRET_KEY"); ok {
+		fmt.Println("the keyring holds SECRET_KEY now, unset it before the restart")
+	}
+
+	return nil
+}
+
+// openDB opens the database of DSN for the commands, with the schema
+// brought up to date like pinub does when it starts.
+func openDB(ctx context.Context) (*sql.DB, error) {
+	db, err := pinub.OpenDB(env("DSN", "pinub.sqlite3"))
+	if err != nil {
+		return nil, err
+	}
+	if err := pinub.Migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// disableTwoFactor turns off two-factor authentication for a user who lost
+// their authenticator app and recovery codes.
+func disableTwoFactor(args []string) error {
+	fset := flag.NewFlagSet("disable-2fa", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "usage: pinub disable-2fa email")
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	email := fset.Arg(0)
+
+	ctx := context.Background()
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	us := &pinub.UserService{DB: db}
+	user, err := us.ByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	if err != nil {
+		return err
+	}
+	if !user.TwoFactor() {
+		return fmt.Errorf("%s does not use two-factor authentication", email)
+	}
+	if err := us.DisableTOTP(ctx, user); err != nil {
+		return err
+	}
+	event := &pinub.AuditEvent{UserID: user.ID, Action: "admin.reset-2fa", Detail: "from the command line"}
+	if err := us.AddAuditEvent(ctx, event); err != nil {
+		return err
+	}
+
+	fmt.Printf("two-factor authentication disabled for %s\n", email)
+
+	return nil
+}
+
+// makeAdmin grants a user access to /admin, or revokes it with -revoke. The
+// first admin can only be made here.
+func makeAdmin(args []string) error {
+	fset := flag.NewFlagSet("make-admin", flag.ExitOnError)
+	revoke := fset.Bool("revoke", false, "revoke the admin role instead")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "usage: pinub make-admin [-revoke] email")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	email := fset.Arg(0)
+
+	ctx := context.Background()
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	us := &pinub.UserService{DB: db}
+	user, err := us.ByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	if err != nil {
+		return err
+	}
+	if err := us.SetAdmin(ctx, user, !*revoke); err != nil {
+		return err
+	}
+
+	action := "admin.grant"
+	if *revoke {
+		action = "admin.revoke"
+	}
+	event := &pinub.AuditEvent{UserID: user.ID, Action: action, Detail: "from the command line"}
+	if err := us.AddAuditEvent(ctx, event); err != nil {
+		return err
+	}
+
+	if *revoke {
+		fmt.Printf("%s is no admin anymore\n", email)
+	} else {
+		fmt.Printf("%s is an admin now\n", email)
+	}
+
+	return nil
+}
+
+// invite creates an invite code, or lists or deletes invites.
+func invite(args []string) error {
+	fset := flag.NewFlagSet("invite", flag.ExitOnError)
+	uses := fset.Int("uses", 1, "how many accounts may be registered with the code, 0 for any number")
+	expires := fset.Duration("expires", 7*24*time.Hour, "how long the code works, 0 for ever")
+	list := fset.Bool("list", false, "list the invites instead")
+	del := fset.Int("delete", 0, "delete the invite with this id instead")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "usage: pinub invite [-uses n] [-expires duration] | -list | -delete id")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 0 || *uses < 0 || *expires < 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	us := &pinub.UserService{DB: db}
+
+	switch {
+	case *list:
+		invites, err := us.Invites(ctx, 0)
+		if err != nil {
+			return err
+		}
+		for _, i := range invites {
+			expiresAt := "never"
+			if i.ExpiresAt != nil {
+				expiresAt = i.ExpiresAt.Format(time.RFC3339)
+			}
+			maxUses := "any"
+			if i.MaxUses > 0 {
+				maxUses = strconv.Itoa(i.MaxUses)
+			}
+			fmt.Printf("%d\t%s\tused %d of %s\texpires %s\n", i.ID, i.Code, i.Uses, maxUses, expiresAt)
+		}
+
+	case *del > 0:
+		if err := us.DeleteInvite(ctx, 0, *del); err != nil {
+			return err
+		}
+		fmt.Printf("invite %d deleted\n", *del)
+
+	default:
+		i := &pinub.Invite{MaxUses: *uses}
+		if err := us.CreateInvite(ctx, i, *expires); err != nil {
+			return err
+		}
+		fmt.Println(strings.TrimSuffix(env("BASE_URL", ""), "/") + "/register?invite=" + i.Code)
+	}
+
+	return nil
+}
+
+// prefixes parses a comma separated list of CIDR prefixes. Single addresses
+// stand for themselves.
+func prefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
 }
 
 func env(key, defaultValue string) string {
@@ -30,3 +528,60 @@ func env(key, defaultValue string) string {
 
 	return defaultValue
 }
+
+// boolean, integer and duration read settings from the environment. Values
+// that do not parse stop pinub, rather than running with a default the
+// operator did not ask for.
+func boolean(key string, defaultValue bool) bool {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		slog.Error("boolean error", err, "key", key)
+		os.Exit(1)
+	}
+
+	return b
+}
+
+// integer also stops pinub for values outside of min and max.
+func integer(key string, defaultValue, min, max int) int {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		slog.Error("integer error", err, "key", key)
+		os.Exit(1)
+	}
+	if i < min || i > max {
+		slog.Error(fmt.Sprintf("%s must be between %d and %d", key, min, max), "value", i)
+		os.Exit(1)
+	}
+
+	return i
+}
+
+func duration(key string, defaultValue time.Duration) time.Duration {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		slog.Error("duration error", err, "key", key)
+		os.Exit(1)
+	}
+	if d < 0 {
+		slog.Error(key+" must not be negative", "value", val)
+		os.Exit(1)
+	}
+
+	return d
+}
@@ -0,0 +1,157 @@
+package pinub
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"dab.io/pinub/internal/cookies"
+	"dab.io/pinub/internal/mailer"
+	"dab.io/pinub/internal/password"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// confirmedCookieName remembers that the user proved who they are a
+	// moment ago, by signing in or with a link sent by email. Users without
+	// a password confirm changes to their account with it.
+	confirmedCookieName = "confirmed"
+	confirmedMaxAge     = 10 * 60
+
+	// confirmationTTL is how long the link in a confirmation email works.
+	confirmationTTL = 15 * time.Minute
+)
+
+// confirmed reports whether the user, who is signed in, confirmed a change
+// to their account. Users with a password confirm with it. Users without
+// one, like those of an OpenID Connect provider, must have signed in or
+// followed a confirmation link within the last minutes, a session alone is
+// not enough.
+func (a *App) confirmed(r *http.Request, user *User, given string) bool {
+	if len(user.Password) == 0 {
+		return a.recentlyConfirmed(r, user)
+	}
+
+	valid, err := password.Verify(given, user.Password)
+	if err != nil {
+		slog.Error("cannot verify password", err)
+	}
+
+	return valid
+}
+
+// recentlyConfirmed reports whether the user proved who they are within
+// confirmedMaxAge.
+func (a *App) recentlyConfirmed(r *http.Request, user *User) bool {
+	value, err := cookies.ReadEncrypted(r, confirmedCookieName, a.Keys)
+
+	return err == nil && value == strconv.Itoa(user.ID)
+}
+
+// setConfirmed remembers for confirmedMaxAge that the user proved who they
+// are.
+func (a *App) setConfirmed(w http.ResponseWriter, user *User) error {
+	cookie := http.Cookie{
+		Name:     confirmedCookieName,
+		Value:    strconv.Itoa(user.ID),
+		Path:     "/",
+		MaxAge:   confirmedMaxAge,
+		HttpOnly: true,
+		Secure:   !a.InsecureDev,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return cookies.WriteEncrypted(w, cookie, a.Keys)
+}
+
+// confirm lets users without a password confirm changes to their account
+// with a link sent to their email address. Posting without a token sends
+// the link. Mail scanners open links to check them, so the link shows a
+// button and only its POST uses up the token.
+func (a *App) confirm() http.HandlerFunc {
+	tpl, _ := template.New("confirm.html").Funcs(funcs).ParseFS(tpls, "templates/confirm.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		// keep the token out of the Referer header of links on the page
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		f := newForm(r)
+
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		if len(f.Value("token")) == 0 {
+			key := strings.ToLower(user.Email)
+			if !a.magicLinkSends.Allow(key) {
+				a.flash(w, "too many links sent, try again in a few minutes")
+				http.Redirect(w, r, "/profile", http.StatusSeeOther)
+				return
+			}
+			a.magicLinkSends.Add(key)
+
+			linkURL := a.absURL(r, "/profile/confirm")
+			a.background(func(ctx context.Context) {
+				if err := a.sendConfirmation(ctx, user, linkURL); err != nil {
+					slog.Error("cannot send confirmation link", err)
+				}
+			})
+
+			a.flash(w, "a link to confirm it is you is on its way to "+user.Email)
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		if err := a.db.UseConfirmation(r.Context(), user, f.Value("token")); err != nil {
+			a.flash(w, "the link to confirm it is you is not valid anymore")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+		if err := a.setConfirmed(w, user); err != nil {
+			http.Error(w, "cannot save cookie", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "confirm", "email link")
+
+		a.flash(w, fmt.Sprintf("confirmed, change your account within the next %d minutes", confirmedMaxAge/60))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	}
+}
+
+// sendConfirmation mails a link to linkURL with a new confirmation token to
+// the user.
+func (a *App) sendConfirmation(ctx context.Context, user *User, linkURL string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := a.db.CreateConfirmation(ctx, user, token, confirmationTTL); err != nil {
+		return err
+	}
+
+	link := linkURL + "?token=" + url.QueryEscape(token)
+	return a.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm the change to your pinub account",
+		Body: fmt.Sprintf("Open this link within the next %.0f minutes to confirm it is you changing your pinub account:\n\n%s\n\n"+
+			"The link works once. If you did not ask for it, ignore this email.\n",
+			confirmationTTL.Minutes(), link),
+	})
+}
+
+// confirmFailure tells the user why confirming a change failed.
+func confirmFailure(user *User) string {
+	if len(user.Password) == 0 {
+		return "confirm it is you first, by signing in again or with a link sent by email"
+	}
+
+	return "password not valid"
+}
@@ -0,0 +1,100 @@
+package pinub
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var confirmLinkPattern = regexp.MustCompile(`/profile/confirm\?token=(\S+)`)
+
+// session returns a browser that has only the session cookie of c, like
+// somebody who stole it.
+func (c *testClient) session() *testClient {
+	c.t.Helper()
+
+	other := newTestClient(c.t, c.srv)
+	u, _ := url.Parse(c.srv.URL)
+	for _, cookie := range c.Jar.Cookies(u) {
+		if cookie.Name == cookieName {
+			other.Jar.SetCookies(u, []*http.Cookie{cookie})
+		}
+	}
+	if !other.signedIn() {
+		c.t.Fatal("session not copied")
+	}
+
+	return other
+}
+
+// Accounts without a password confirm changes by signing in again or with
+// a link sent by email, a session alone is not enough.
+func TestConfirmWithoutPassword(t *testing.T) {
+	a, srv, m := newTestApp(t)
+	provider := newTestProvider(t, a)
+	provider.Claims = map[string]any{"sub": "subject", "email": "oidc@example.com", "email_verified": true}
+	ctx := context.Background()
+
+	c := newTestClient(t, srv)
+	c.callback(c.oidcSignIn(provider))
+	thief := c.session()
+
+	deleting := func(c *testClient) bool {
+		t.Helper()
+
+		c.post("/profile/delete", url.Values{"action": {"delete"}})
+		user, err := a.db.ByEmail(ctx, "oidc@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.DeleteAt == nil {
+			return false
+		}
+		if err := a.db.CancelDeletion(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	}
+
+	if deleting(thief) {
+		t.Error("deleted with a session alone")
+	}
+	if resp, _ := thief.post("/profile", url.Values{"email": {"thief@example.com"}}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("changed email with a session alone: %s", resp.Status)
+	}
+
+	// the link goes to the owner of the account and works once
+	thief.post("/profile/confirm", url.Values{})
+	msg := waitForMail(t, a, m)
+	match := confirmLinkPattern.FindStringSubmatch(msg.Body)
+	if msg.To != "oidc@example.com" || match == nil {
+		t.Fatalf("confirmation email to %s: %q", msg.To, msg.Body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+	if _, body := thief.get("/profile/confirm?token=" + url.QueryEscape(token)); !strings.Contains(body, "Confirm") {
+		t.Error("link does not ask to confirm")
+	}
+	if deleting(thief) {
+		t.Error("opening the link confirmed")
+	}
+	thief.post("/profile/confirm", url.Values{"token": {token}})
+	if !deleting(thief) {
+		t.Error("not deleted after following the link")
+	}
+
+	// deleting signs out everywhere, signing in again confirms
+	c = newTestClient(t, srv)
+	c.callback(c.oidcSignIn(provider))
+	if !deleting(c) {
+		t.Error("not deleted right after signing in")
+	}
+	c.callback(c.oidcSignIn(provider))
+	again := c.session()
+	again.post("/profile/confirm", url.Values{"token": {token}})
+	if deleting(again) {
+		t.Error("link worked twice")
+	}
+}
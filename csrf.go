@@ -0,0 +1,106 @@
+package pinub
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+
+	"dab.io/pinub/internal/cookies"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// csrfCookieName holds the CSRF token of a browser. Forms send the same
+	// token in csrfField. Other sites can make the browser send the cookie,
+	// but they can neither read it nor decrypt it to fill in the field.
+	csrfCookieName = "csrf"
+	csrfField      = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// csrf rejects state-changing requests that did not originate from one of
+// pinub's own forms. Requests have to come from the same origin, according
+// to the Sec-Fetch-Site and Origin headers where the browser sends them,
+// and have to carry the CSRF token of the browser. The token is stored in
+// the request context for render.
+func (a *App) csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := a.csrfToken(w, r)
+		if err != nil {
+			slog.Error("cannot create csrf token", err)
+			http.Error(w, "cannot save cookie", http.StatusInternalServerError)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		default:
+			if !sameOrigin(r) {
+				http.Error(w, "cross-site request refused", http.StatusForbidden)
+				return
+			}
+
+			sent := r.Header.Get(csrfHeader)
+			if len(sent) == 0 {
+				sent = r.PostFormValue(csrfField)
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(sent)) != 1 {
+				http.Error(w, "form has expired, please reload", http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), csrfContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sameOrigin reports whether the browser claims the request was made by a
+// page of pinub itself. Browsers that send neither header are let through;
+// for them the CSRF token has to suffice.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return u.Host == r.Host
+}
+
+// csrfToken returns the CSRF token of the browser, and hands out a new one
+// if it has none yet.
+func (a *App) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookie := http.Cookie{
+		Name:     csrfCookieName,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !a.InsecureDev,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token, err := cookies.ReadEncryptedRotate(w, r, cookie, a.Keys); err == nil { // if NO error
+		return token, nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	cookie.Value = token
+	if err := cookies.WriteEncrypted(w, cookie, a.Keys); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
@@ -0,0 +1,269 @@
+package pinub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Feeds are served as /{atom,rss}.xml below the page they belong to. Feeds of
+// private pins live under /f/{feed token}, because feed readers cannot send
+// the session cookie.
+const (
+	atomFeed = "atom.xml"
+	rssFeed  = "rss.xml"
+)
+
+type atom struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Link       atomLink       `xml:"link"`
+	Summary    string         `xml:"summary,omitempty"`
+	Categories []atomCategory `xml:"category"`
+}
+
+// atomCategory is a tag of a pin.
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func atomCategories(tags []string) []atomCategory {
+	var categories []atomCategory
+	for _, tag := range tags {
+		categories = append(categories, atomCategory{Term: tag})
+	}
+
+	return categories
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description,omitempty"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// feed serves the pins find finds for the request as the feed format
+// requested in the path.
+func (a *App) feed(find func(r *http.Request) (*listing, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := find(r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		a.serveFeed(w, r, l)
+	}
+}
+
+// privateListing finds the pins in the feeds at /f/{token}: all pins of
+// the user owning the feed token, including hidden ones, or those with the
+// tag at /f/{token}/t/{tag}.
+func (a *App) privateListing(r *http.Request) (*listing, bool) {
+	user, err := a.db.ByFeedToken(r.Context(), r.PathValue("token"))
+	if err != nil {
+		return nil, false
+	}
+	l := &listing{User: user, Page: "/", private: true}
+
+	if tag := r.PathValue("tag"); len(tag) > 0 {
+		if !tagRe.MatchString(tag) {
+			return nil, false
+		}
+		l.Tag, l.Page = tag, "/tags/"+tag
+	}
+
+	return l, true
+}
+
+// feeds replaces the feed token of the signed in user.
+func (a *App) feeds() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		if r.Method != http.MethodPost {
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		token, err := randomToken()
+		if err != nil {
+			http.Error(w, "cannot create feed token", http.StatusInternalServerError)
+			return
+		}
+		if err := a.db.UpdateFeedToken(r.Context(), user, token); err != nil {
+			http.Error(w, "cannot create feed token", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "token.feed", "")
+
+		a.flash(w, "feed links updated")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	}
+}
+
+// serveFeed writes the pins of the listing as the feed format requested in
+// the path.
+func (a *App) serveFeed(w http.ResponseWriter, r *http.Request, l *listing) {
+	var (
+		user  = l.User
+		links []Link
+		err   error
+	)
+	if l.private {
+		links, err = a.db.Links(r.Context(), user, l.Tag)
+	} else {
+		links, err = a.db.SharedLinks(r.Context(), user, l.Tag)
+	}
+	if err != nil {
+		slog.Error("cannot get feed links", err)
+		http.Error(w, "cannot get links from database", http.StatusInternalServerError)
+		return
+	}
+
+	// the newest pin is the last change of the feed
+	updated := *user.CreatedAt
+	if len(links) > 0 {
+		updated = *links[0].CreatedAt
+	}
+
+	title := "pins of " + user.Username
+	if len(user.Username) == 0 {
+		title = "pins"
+	}
+	if len(l.Tag) > 0 {
+		title += " tagged " + l.Tag
+	}
+
+	var (
+		doc         any
+		contentType string
+	)
+	switch r.PathValue("feed") {
+	case atomFeed:
+		feed := atom{
+			Title:   title,
+			ID:      a.absURL(r, r.URL.Path),
+			Updated: updated.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: user.Username},
+			Links: []atomLink{
+				{Href: a.absURL(r, r.URL.Path), Rel: "self"},
+				{Href: a.absURL(r, l.Page), Rel: "alternate"},
+			},
+		}
+		if len(feed.Author.Name) == 0 {
+			feed.Author.Name = "pinub"
+		}
+		for _, link := range links {
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:      linkTitle(link),
+				ID:         link.URL,
+				Updated:    link.CreatedAt.UTC().Format(time.RFC3339),
+				Link:       atomLink{Href: link.URL},
+				Summary:    link.Notes,
+				Categories: atomCategories(link.Tags),
+			})
+		}
+		doc, contentType = feed, "application/atom+xml; charset=utf-8"
+	case rssFeed:
+		feed := rss{
+			Version: "2.0",
+			Channel: rssChannel{
+				Title:         title,
+				Link:          a.absURL(r, l.Page),
+				Description:   title,
+				LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+			},
+		}
+		for _, link := range links {
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       linkTitle(link),
+				Link:        link.URL,
+				Description: link.Notes,
+				GUID:        rssGUID{Value: link.URL},
+				PubDate:     link.CreatedAt.UTC().Format(time.RFC1123Z),
+				Categories:  link.Tags,
+			})
+		}
+		doc, contentType = feed, "application/rss+xml; charset=utf-8"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(doc); err != nil {
+		slog.Error("cannot encode feed", err)
+		http.Error(w, "cannot encode feed", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	if l.private {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	http.ServeContent(w, r, "", updated, bytes.NewReader(buf.Bytes()))
+}
+
+// linkTitle is the text shown for a link, its title or its URL without the
+// scheme.
+func linkTitle(link Link) string {
+	if len(link.Title) > 0 {
+		return link.Title
+	}
+
+	return strings.TrimPrefix(strings.TrimPrefix(link.URL, "https://"), "http://")
+}
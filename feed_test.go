@@ -0,0 +1,158 @@
+package pinub
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// feed returns the pins in the Atom or RSS feed at path and their tags, or
+// nil if there is no feed.
+func (c *testClient) feed(path string) map[string][]string {
+	c.t.Helper()
+
+	status, body := c.get(path)
+	if status != http.StatusOK {
+		return nil
+	}
+
+	pins := map[string][]string{}
+	var doc struct {
+		Entries []struct {
+			Link struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+			Categories []struct {
+				Term string `xml:"term,attr"`
+			} `xml:"category"`
+		} `xml:"entry"`
+		Items []struct {
+			Link       string   `xml:"link"`
+			Categories []string `xml:"category"`
+		} `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal([]byte(body), &doc); err != nil {
+		c.t.Fatalf("%s: %v", path, err)
+	}
+	for _, e := range doc.Entries {
+		pins[e.Link.Href] = []string{}
+		for _, category := range e.Categories {
+			pins[e.Link.Href] = append(pins[e.Link.Href], category.Term)
+		}
+	}
+	for _, item := range doc.Items {
+		pins[item.Link] = append([]string{}, item.Categories...)
+	}
+
+	return pins
+}
+
+func TestFeeds(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	user := createUser(t, a, "feeds@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("feeds@example.com")
+
+	c.pin("https://go.dev/", "go web")
+	c.pin("https://example.com/", "go")
+	c.pin("https://example.org/", "")
+	link, _ := a.db.Link(context.Background(), user, "https://example.com/")
+	if err := a.db.HideLink(context.Background(), user, link.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	c.post("/feeds", url.Values{})
+	c.post("/sharing", url.Values{"username": {"feeder"}, "visibility": {VisibilityPrivate}})
+	c.post("/sharing/tag", url.Values{"tag": {"go"}, "visibility": {VisibilityPublic}})
+	c.post("/sharing/tag", url.Values{"tag": {"web"}, "visibility": {VisibilityUnlisted}})
+	user, _ = a.db.ByUsername(context.Background(), "feeder")
+	web, _ := a.db.TagShare(context.Background(), user, "web")
+
+	visitor := newTestClient(t, srv)
+	private := "/f/" + user.FeedToken
+	tests := []struct {
+		path string
+		// pins in the feed and their tags, nil if there is no feed
+		pins map[string][]string
+	}{
+		{private, map[string][]string{
+			"https://go.dev/":      {"go", "web"},
+			"https://example.com/": {"go"},
+			"https://example.org/": {},
+		}},
+		{private + "/t/go", map[string][]string{
+			"https://go.dev/":      {"go", "web"},
+			"https://example.com/": {"go"},
+		}},
+		{private + "/t/other", map[string][]string{}},
+		{"/u/feeder/t/go", map[string][]string{"https://go.dev/": {"go", "web"}}},
+		{"/u/feeder/t/web", nil},
+		{"/u/feeder", nil},
+		{"/s/" + web.ShareToken, map[string][]string{"https://go.dev/": {"go", "web"}}},
+		{"/s/" + web.ShareToken + "/t/go", nil},
+		{"/f/unknown", nil},
+	}
+	for _, tt := range tests {
+		for _, feed := range []string{atomFeed, rssFeed} {
+			pins := visitor.feed(tt.path + "/" + feed)
+			if (pins == nil) != (tt.pins == nil) || len(pins) != len(tt.pins) {
+				t.Errorf("%s/%s: %q, want %q", tt.path, feed, pins, tt.pins)
+				continue
+			}
+			for link, tags := range tt.pins {
+				if !slices.Equal(pins[link], tags) {
+					t.Errorf("%s/%s: %s tagged %q, want %q", tt.path, feed, link, pins[link], tags)
+				}
+			}
+		}
+	}
+}
+
+func TestFeedConditional(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	createUser(t, a, "feeds@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("feeds@example.com")
+	c.pin("https://go.dev/", "go")
+	c.post("/sharing", url.Values{"username": {"feeder"}, "visibility": {VisibilityPublic}})
+
+	path := srv.URL + "/u/feeder/t/go/atom.xml"
+	resp, err := http.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || len(etag) == 0 || len(modified) == 0 {
+		t.Fatalf("feed: %s, ETag %q, Last-Modified %q", resp.Status, etag, modified)
+	}
+
+	conditional := func(header, value string) int {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	if status := conditional("If-None-Match", etag); status != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d", status)
+	}
+	if status := conditional("If-Modified-Since", modified); status != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: %d", status)
+	}
+
+	// changing the tags of a pin changes the feed
+	c.pin("https://go.dev/", "go web")
+	if status := conditional("If-None-Match", etag); status != http.StatusOK {
+		t.Errorf("If-None-Match after change: %d", status)
+	}
+}
@@ -0,0 +1,101 @@
+package pinub
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"dab.io/pinub/internal/cookies"
+	"golang.org/x/exp/slog"
+)
+
+// form keeps the submitted values of a form together with the problems
+// found in them, so a failed form can be shown again with its input and a
+// message next to each field.
+type form struct {
+	r      *http.Request
+	errors map[string]string
+}
+
+func newForm(r *http.Request) *form {
+	return &form{r: r, errors: map[string]string{}}
+}
+
+// Value returns the trimmed value the user entered into field.
+func (f *form) Value(field string) string {
+	if f == nil || f.r == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(f.r.FormValue(field))
+}
+
+// Fail records msg as the problem with field. An empty field is a problem
+// with the form as a whole. Only the first problem of a field is kept.
+func (f *form) Fail(field, msg string) {
+	if _, ok := f.errors[field]; !ok {
+		f.errors[field] = msg
+	}
+}
+
+// Error returns the problem with field, if there is one.
+func (f *form) Error(field string) string {
+	if f == nil {
+		return ""
+	}
+
+	return f.errors[field]
+}
+
+// Valid reports whether no problems were found.
+func (f *form) Valid() bool {
+	return len(f.errors) == 0
+}
+
+// flashCookieName holds a notice for the next page the user sees, like
+// "profile updated" after a redirect.
+const flashCookieName = "flash"
+
+// flash shows msg once on the next rendered page.
+func (a *App) flash(w http.ResponseWriter, msg string) {
+	cookie := http.Cookie{
+		Name:     flashCookieName,
+		Value:    msg,
+		Path:     "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		Secure:   !a.InsecureDev,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if err := cookies.WriteSigned(w, cookie, a.Keys); err != nil {
+		slog.Error("cannot save flash", err)
+	}
+}
+
+// flashes makes the flash message available to render. The message is only
+// removed when a page is rendered, not when the request redirects.
+func (a *App) flashes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pop := func() string {
+			return a.popFlash(w, r)
+		}
+
+		ctx := context.WithValue(r.Context(), flashContextKey, pop)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// popFlash returns the notice left by flash and removes it.
+func (a *App) popFlash(w http.ResponseWriter, r *http.Request) string {
+	if _, err := r.Cookie(flashCookieName); err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookieName, Path: "/", MaxAge: -1})
+
+	msg, err := cookies.ReadSigned(r, flashCookieName, a.Keys)
+	if err != nil {
+		return ""
+	}
+
+	return msg
+}
@@ -6,21 +6,49 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	ErrValueTooLong = errors.New("cookie value too long")
 	ErrInvalidValue = errors.New("invalid cookie value")
+	ErrExpired      = errors.New("cookie expired")
 )
 
+// Values written by WriteEncrypted and WriteSigned start with a prefix
+// naming their format and its version. Values written before these formats
+// existed are plain base64, which never contains a ".", so they can still
+// be told apart and read.
+const (
+	prefixEncrypted = "e2."
+	prefixSigned    = "s2."
+	// the cookie only tells how many chunks there are, see writeChunked
+	prefixChunked = "c2."
+)
+
+const (
+	// maxCookieSize is the maximum size of a cookie that all browsers
+	// accept, including its name and attributes.
+	maxCookieSize = 4096
+	// maxChunks limits how many cookies a single value may be split into.
+	// Browsers only keep a limited number of cookies per domain.
+	maxChunks = 8
+)
+
+// now is replaced in tests.
+var now = time.Now
+
 func Read(r *http.Request, name string) (string, error) {
-	// Read the cookie as normal.
-	cookie, err := r.Cookie(name)
+	// Read the cookie as normal, joining it from its chunks if it was too
+	// long for a single cookie.
+	raw, err := readChunked(r, name)
 	if err != nil {
 		return "", err
 	}
@@ -28,7 +56,7 @@ func Read(r *http.Request, name string) (string, error) {
 	// Decode the base64-encoded cookie value. If the cookie didn't contain a
 	// valid base64-encoded value, this operation will fail and we return an
 	// ErrInvalidValue error.
-	value, err := base64.URLEncoding.DecodeString(cookie.Value)
+	value, err := base64.URLEncoding.DecodeString(raw)
 	if err != nil {
 		return "", ErrInvalidValue
 	}
@@ -37,13 +65,125 @@ func Read(r *http.Request, name string) (string, error) {
 	return string(value), nil
 }
 
-func ReadEncrypted(r *http.Request, name string, secretKey []byte) (string, error) {
-	// Read the encrypted value from the cookie as normal.
-	encryptedValue, err := Read(r, name)
+// readChunked returns the value of the cookie with the given name as it was
+// passed to writeChunked.
+func readChunked(r *http.Request, name string) (string, error) {
+	cookie, err := r.Cookie(name)
 	if err != nil {
 		return "", err
 	}
 
+	count, ok := strings.CutPrefix(cookie.Value, prefixChunked)
+	if !ok {
+		return cookie.Value, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 || n > maxChunks {
+		return "", ErrInvalidValue
+	}
+
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		chunk, err := r.Cookie(fmt.Sprintf("%s.%d", name, i))
+		if err != nil {
+			return "", ErrInvalidValue
+		}
+		b.WriteString(chunk.Value)
+	}
+
+	return b.String(), nil
+}
+
+func ReadEncrypted(r *http.Request, name string, keys *Keyring) (string, error) {
+	value, _, err := readEncrypted(r, name, keys)
+
+	return value, err
+}
+
+// ReadEncryptedRotate works like ReadEncrypted, but re-issues cookies that
+// were not encrypted with the primary key of the keyring, or in an older
+// format. The re-issued cookie gets the value read and all other
+// attributes from cookie.
+func ReadEncryptedRotate(w http.ResponseWriter, r *http.Request, cookie http.Cookie, keys *Keyring) (string, error) {
+	value, current, err := readEncrypted(r, cookie.Name, keys)
+	if err != nil || current {
+		return value, err
+	}
+
+	cookie.Value = value
+	if err := WriteEncrypted(w, cookie, keys); err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// readEncrypted decrypts the cookie and reports whether it is in the
+// current format and encrypted with the primary key of the keyring.
+func readEncrypted(r *http.Request, name string, keys *Keyring) (string, bool, error) {
+	raw, err := readChunked(r, name)
+	if err != nil {
+		return "", false, err
+	}
+
+	// The current format is "e2.{base64 of key id, nonce and ciphertext}".
+	// The plaintext is an envelope with issue and expiry time.
+	if encoded, ok := strings.CutPrefix(raw, prefixEncrypted); ok {
+		encryptedValue, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil || len(encryptedValue) < 4 {
+			return "", false, ErrInvalidValue
+		}
+
+		id := binary.BigEndian.Uint32(encryptedValue[:4])
+		key, ok := keys.key(id)
+		if !ok {
+			return "", false, ErrInvalidValue
+		}
+
+		plaintext, err := decrypt(string(encryptedValue[4:]), key.Secret)
+		if err != nil {
+			return "", false, err
+		}
+		value, err := openEnvelope(plaintext, name)
+		if err != nil {
+			return "", false, err
+		}
+
+		return value, key.ID == keys.Primary().ID, nil
+	}
+
+	// Older cookies are plain base64 of "{key id}{nonce}{ciphertext}", or of
+	// "{nonce}{ciphertext}" from before keyrings existed, with a plaintext
+	// of "{cookie name}:{cookie value}". If the id is unknown, or the known
+	// key fails to decrypt, we fall back to trying every key without id.
+	encryptedValue, err := Read(r, name)
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(encryptedValue) > 4 {
+		id := binary.BigEndian.Uint32([]byte(encryptedValue[:4]))
+		if key, ok := keys.key(id); ok {
+			if plaintext, err := decrypt(encryptedValue[4:], key.Secret); err == nil {
+				value, err := checkName(plaintext, name)
+				return value, false, err
+			}
+		}
+	}
+
+	for _, key := range keys.Keys() {
+		if plaintext, err := decrypt(encryptedValue, key.Secret); err == nil {
+			value, err := checkName(plaintext, name)
+			return value, false, err
+		}
+	}
+
+	return "", false, ErrInvalidValue
+}
+
+// decrypt opens the "{nonce}{ciphertext}" value using secretKey.
+func decrypt(encryptedValue string, secretKey []byte) (string, error) {
 	// Create a new AES cipher block from the secret key.
 	block, err := aes.NewCipher(secretKey)
 	if err != nil {
@@ -77,9 +217,14 @@ func ReadEncrypted(r *http.Request, name string, secretKey []byte) (string, erro
 		return "", ErrInvalidValue
 	}
 
-	// The plaintext value is in the format "{cookie name}:{cookie value}". We
-	// use strings.Cut() to split it on the first ":" character.
-	expectedName, value, ok := strings.Cut(string(plaintext), ":")
+	return string(plaintext), nil
+}
+
+// checkName returns the value of a "{cookie name}:{cookie value}" plaintext
+// after checking that it belongs to the cookie with the given name.
+func checkName(plaintext, name string) (string, error) {
+	// We use strings.Cut() to split it on the first ":" character.
+	expectedName, value, ok := strings.Cut(plaintext, ":")
 	if !ok {
 		return "", ErrInvalidValue
 	}
@@ -93,25 +238,94 @@ func ReadEncrypted(r *http.Request, name string, secretKey []byte) (string, erro
 	return value, nil
 }
 
+// sealEnvelope returns the authenticated content of encrypted and signed
+// cookies: "{issued at}{expires at}{cookie name}:{cookie value}", with both
+// times as 8 byte Unix timestamps. The expiry is taken from MaxAge or
+// Expires, so the server can enforce it even if the client ignores it. Zero
+// means the cookie does not expire.
+func sealEnvelope(cookie http.Cookie) string {
+	issuedAt := now()
+
+	var expiresAt int64
+	switch {
+	case cookie.MaxAge > 0:
+		expiresAt = issuedAt.Unix() + int64(cookie.MaxAge)
+	case !cookie.Expires.IsZero():
+		expiresAt = cookie.Expires.Unix()
+	}
+
+	b := binary.BigEndian.AppendUint64(nil, uint64(issuedAt.Unix()))
+	b = binary.BigEndian.AppendUint64(b, uint64(expiresAt))
+
+	return string(b) + cookie.Name + ":" + cookie.Value
+}
+
+// openEnvelope returns the value of an envelope made by sealEnvelope, if it
+// belongs to the cookie with the given name and has not expired.
+func openEnvelope(envelope, name string) (string, error) {
+	if len(envelope) < 16 {
+		return "", ErrInvalidValue
+	}
+
+	expiresAt := int64(binary.BigEndian.Uint64([]byte(envelope[8:16])))
+	if expiresAt != 0 && now().Unix() >= expiresAt {
+		return "", ErrExpired
+	}
+
+	return checkName(envelope[16:], name)
+}
+
 func Write(w http.ResponseWriter, cookie http.Cookie) error {
 	// Encode the cookie value using base64.
 	cookie.Value = base64.URLEncoding.EncodeToString([]byte(cookie.Value))
 
-	// Check the total length of the cookie contents. Return the ErrValueTooLong
-	// error if it's more than 4096 bytes.
-	if len(cookie.String()) > 4096 {
+	return writeChunked(w, cookie)
+}
+
+// writeChunked writes the cookie as is if it fits into maxCookieSize.
+// Longer values are split into the cookies "{name}.1" to "{name}.{n}", and
+// the cookie itself only holds "c2.{n}". More than maxChunks chunks are
+// refused with an ErrValueTooLong error.
+func writeChunked(w http.ResponseWriter, cookie http.Cookie) error {
+	// Check the total length of the cookie contents. Write the cookie as
+	// normal if it's at most 4096 bytes.
+	if len(cookie.String()) <= maxCookieSize {
+		http.SetCookie(w, &cookie)
+		return nil
+	}
+
+	// Every chunk carries the same attributes and a name that is up to
+	// three characters longer.
+	value := cookie.Value
+	cookie.Value = ""
+	size := maxCookieSize - len(cookie.String()) - len(".99")
+	if size <= 0 {
 		return ErrValueTooLong
 	}
 
-	// Write the cookie as normal.
+	n := (len(value) + size - 1) / size
+	if n > maxChunks {
+		return ErrValueTooLong
+	}
+
+	for i := 1; i <= n; i++ {
+		chunk := cookie
+		chunk.Name = fmt.Sprintf("%s.%d", cookie.Name, i)
+		chunk.Value = value[(i-1)*size : min(i*size, len(value))]
+		http.SetCookie(w, &chunk)
+	}
+
+	cookie.Value = prefixChunked + strconv.Itoa(n)
 	http.SetCookie(w, &cookie)
 
 	return nil
 }
 
-func WriteEncrypted(w http.ResponseWriter, cookie http.Cookie, secretKey []byte) error {
-	// Create a new AES cipher block from the secret key.
-	block, err := aes.NewCipher(secretKey)
+func WriteEncrypted(w http.ResponseWriter, cookie http.Cookie, keys *Keyring) error {
+	key := keys.Primary()
+
+	// Create a new AES cipher block from the primary key of the keyring.
+	block, err := aes.NewCipher(key.Secret)
 	if err != nil {
 		return err
 	}
@@ -122,7 +336,9 @@ func WriteEncrypted(w http.ResponseWriter, cookie http.Cookie, secretKey []byte)
 		return err
 	}
 
-	// Create unique nonce containing 12 random bytes.
+	// Start the value with the key id, so readers know which key to use,
+	// followed by a unique nonce containing 12 random bytes.
+	prefix := binary.BigEndian.AppendUint32(nil, key.ID)
 	nonce := make([]byte, aesGCM.NonceSize())
 	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
@@ -130,20 +346,20 @@ func WriteEncrypted(w http.ResponseWriter, cookie http.Cookie, secretKey []byte)
 	}
 
 	// Prepare the plaintext input for encryption. Because we want to
-	// authenticate the cookie name as well as the value, we make this plaintext
-	// in the format "{cookie name}:{cookie value}". We use the : character as a
-	// separator because it is an invalid character for cookie names and
-	// therefore shouldn't appear in them.
-	plaintext := fmt.Sprintf("%s:%s", cookie.Name, cookie.Value)
-
-	// Encrypt the data using aesGCM.Seal(). By passing the nonce as the first
-	// parameter, the encrypted data will be appended to the nonce - meaning
-	// that the returned encryptedValue variable will be in the format
-	// "{nonce}{encrypted plaintext data}".
-	encryptedValue := aesGCM.Seal(nonce, nonce, []byte(plaintext), nil)
-
-	// Set the cookie value to the encryptedValue.
-	cookie.Value = string(encryptedValue)
-
-	return Write(w, cookie)
+	// authenticate the cookie name and its expiry as well as the value, we
+	// seal all of them in an envelope. We use the : character as a separator
+	// between name and value because it is an invalid character for cookie
+	// names and therefore shouldn't appear in them.
+	plaintext := sealEnvelope(cookie)
+
+	// Encrypt the data using aesGCM.Seal(). By passing the prefix and nonce
+	// as the first parameter, the encrypted data will be appended to them -
+	// meaning that the returned encryptedValue variable will be in the format
+	// "{key id}{nonce}{encrypted plaintext data}".
+	encryptedValue := aesGCM.Seal(append(prefix, nonce...), nonce, []byte(plaintext), nil)
+
+	// Set the cookie value to the versioned, base64-encoded encryptedValue.
+	cookie.Value = prefixEncrypted + base64.RawURLEncoding.EncodeToString(encryptedValue)
+
+	return writeChunked(w, cookie)
 }
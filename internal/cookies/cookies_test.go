@@ -0,0 +1,412 @@
+package cookies
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T, b byte) Key {
+	t.Helper()
+
+	key, err := NewKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// setNow fixes the time cookies are written and read at.
+func setNow(t *testing.T, at time.Time) {
+	t.Helper()
+
+	prev := now
+	now = func() time.Time { return at }
+	t.Cleanup(func() { now = prev })
+}
+
+// request returns a request carrying the cookies written to w.
+func request(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	return r
+}
+
+// withValue returns a request with the single cookie name=value.
+func withValue(name, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: name, Value: value})
+
+	return r
+}
+
+// longValue does not fit into a single cookie, even before encryption.
+var longValue = strings.Repeat("0123456789abcdef", 500)
+
+func TestEncrypted(t *testing.T) {
+	keys := NewKeyring(testKey(t, 1))
+
+	for _, value := range []string{"", "session token", "name:with:colons", longValue} {
+		w := httptest.NewRecorder()
+		if err := WriteEncrypted(w, http.Cookie{Name: "session", Value: value}, keys); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadEncrypted(request(w), "session", keys)
+		if err != nil || got != value {
+			t.Errorf("ReadEncrypted = %.20q, %v, want %.20q", got, err, value)
+		}
+	}
+}
+
+func TestSigned(t *testing.T) {
+	keys := NewKeyring(testKey(t, 1))
+
+	for _, value := range []string{"", "profile updated", longValue} {
+		w := httptest.NewRecorder()
+		if err := WriteSigned(w, http.Cookie{Name: "flash", Value: value}, keys); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadSigned(request(w), "flash", keys)
+		if err != nil || got != value {
+			t.Errorf("ReadSigned = %.20q, %v, want %.20q", got, err, value)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	issued := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	setNow(t, issued)
+
+	envelope := sealEnvelope(http.Cookie{Name: "session", Value: "token", MaxAge: 60})
+	if at := int64(binary.BigEndian.Uint64([]byte(envelope[:8]))); at != issued.Unix() {
+		t.Errorf("issued at %d, want %d", at, issued.Unix())
+	}
+	if exp := int64(binary.BigEndian.Uint64([]byte(envelope[8:16]))); exp != issued.Unix()+60 {
+		t.Errorf("expires at %d, want %d", exp, issued.Unix()+60)
+	}
+
+	tests := []struct {
+		name   string
+		cookie http.Cookie
+		// expires is zero for cookies that do not expire
+		expires time.Time
+	}{
+		{"MaxAge", http.Cookie{MaxAge: 60}, issued.Add(60 * time.Second)},
+		{"Expires", http.Cookie{Expires: issued.Add(time.Hour)}, issued.Add(time.Hour)},
+		{"MaxAge over Expires", http.Cookie{MaxAge: 60, Expires: issued.Add(time.Hour)}, issued.Add(60 * time.Second)},
+		{"session cookie", http.Cookie{}, time.Time{}},
+		{"deleted cookie", http.Cookie{MaxAge: -1}, time.Time{}},
+	}
+	for _, tt := range tests {
+		tt.cookie.Name, tt.cookie.Value = "session", "token"
+		now = func() time.Time { return issued }
+		envelope := sealEnvelope(tt.cookie)
+
+		at := func(when time.Time) error {
+			now = func() time.Time { return when }
+			_, err := openEnvelope(envelope, "session")
+			return err
+		}
+		if tt.expires.IsZero() {
+			if err := at(issued.Add(10 * 365 * 24 * time.Hour)); err != nil {
+				t.Errorf("%s: %v years later", tt.name, err)
+			}
+			continue
+		}
+		if err := at(tt.expires.Add(-time.Second)); err != nil {
+			t.Errorf("%s: %v before expiry", tt.name, err)
+		}
+		if err := at(tt.expires); !errors.Is(err, ErrExpired) {
+			t.Errorf("%s: %v at expiry, want ErrExpired", tt.name, err)
+		}
+	}
+
+	for _, envelope := range []string{"", "short", envelope[:15]} {
+		if _, err := openEnvelope(envelope, "session"); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("openEnvelope(%q) = %v, want ErrInvalidValue", envelope, err)
+		}
+	}
+}
+
+// The client cannot make a cookie last longer than the server wrote it
+// for, the expiry is part of the sealed value.
+func TestExpired(t *testing.T) {
+	issued := time.Now()
+	setNow(t, issued)
+	keys := NewKeyring(testKey(t, 1))
+
+	encrypted := httptest.NewRecorder()
+	WriteEncrypted(encrypted, http.Cookie{Name: "c", Value: "v", MaxAge: 60}, keys)
+	signed := httptest.NewRecorder()
+	WriteSigned(signed, http.Cookie{Name: "c", Value: "v", MaxAge: 60}, keys)
+
+	setNow(t, issued.Add(time.Minute))
+	if _, err := ReadEncrypted(request(encrypted), "c", keys); !errors.Is(err, ErrExpired) {
+		t.Errorf("ReadEncrypted = %v, want ErrExpired", err)
+	}
+	if _, err := ReadSigned(request(signed), "c", keys); !errors.Is(err, ErrExpired) {
+		t.Errorf("ReadSigned = %v, want ErrExpired", err)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	keys := NewKeyring(testKey(t, 1))
+
+	tests := []struct {
+		name   string
+		write  func(w http.ResponseWriter, c http.Cookie) error
+		read   func(r *http.Request) (string, error)
+		prefix string
+	}{
+		{"plain", Write, func(r *http.Request) (string, error) {
+			return Read(r, "big")
+		}, ""},
+		{"encrypted", func(w http.ResponseWriter, c http.Cookie) error {
+			return WriteEncrypted(w, c, keys)
+		}, func(r *http.Request) (string, error) {
+			return ReadEncrypted(r, "big", keys)
+		}, prefixEncrypted},
+		{"signed", func(w http.ResponseWriter, c http.Cookie) error {
+			return WriteSigned(w, c, keys)
+		}, func(r *http.Request) (string, error) {
+			return ReadSigned(r, "big", keys)
+		}, prefixSigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := tt.write(w, http.Cookie{Name: "big", Value: longValue, Path: "/"}); err != nil {
+				t.Fatal(err)
+			}
+
+			cookies := w.Result().Cookies()
+			var joined strings.Builder
+			for i, c := range cookies {
+				if len(c.String()) > maxCookieSize {
+					t.Errorf("cookie %s is %d bytes long", c.Name, len(c.String()))
+				}
+				if c.Path != "/" {
+					t.Errorf("cookie %s without attributes", c.Name)
+				}
+				if i < len(cookies)-1 {
+					joined.WriteString(c.Value)
+				}
+			}
+			last := cookies[len(cookies)-1]
+			if last.Name != "big" || last.Value != prefixChunked+strconv.Itoa(len(cookies)-1) {
+				t.Fatalf("last cookie %s=%s", last.Name, last.Value)
+			}
+			if !strings.HasPrefix(joined.String(), tt.prefix) {
+				t.Errorf("joined chunks start with %.5q, want %q", joined.String(), tt.prefix)
+			}
+			if got, err := tt.read(request(w)); err != nil || got != longValue {
+				t.Errorf("read %.20q, %v", got, err)
+			}
+
+			// a missing chunk is not a shorter value
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, c := range cookies[1:] {
+				r.AddCookie(c)
+			}
+			if _, err := tt.read(r); !errors.Is(err, ErrInvalidValue) {
+				t.Errorf("read without first chunk: %v, want ErrInvalidValue", err)
+			}
+		})
+	}
+
+	for _, count := range []string{"c2.0", "c2.9", "c2.-1", "c2.x", "c2."} {
+		if _, err := Read(withValue("big", count), "big"); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("Read(%s) = %v, want ErrInvalidValue", count, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	tooLong := strings.Repeat("x", maxChunks*maxCookieSize)
+	if err := Write(w, http.Cookie{Name: "big", Value: tooLong}); !errors.Is(err, ErrValueTooLong) {
+		t.Errorf("Write too long = %v, want ErrValueTooLong", err)
+	}
+	if len(w.Result().Cookies()) > 0 {
+		t.Error("cookies written for a value too long")
+	}
+}
+
+// legacyEncrypted returns a cookie value in the format of before the
+// envelope, with the key ID in front of the nonce or without.
+func legacyEncrypted(t *testing.T, key Key, name, value string, withID bool) string {
+	t.Helper()
+
+	block, _ := aes.NewCipher(key.Secret)
+	aesGCM, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aesGCM.NonceSize())
+
+	var prefix []byte
+	if withID {
+		prefix = binary.BigEndian.AppendUint32(nil, key.ID)
+	}
+	sealed := aesGCM.Seal(append(prefix, nonce...), nonce, []byte(name+":"+value), nil)
+
+	return base64.URLEncoding.EncodeToString(sealed)
+}
+
+func TestLegacy(t *testing.T) {
+	primary, previous := testKey(t, 1), testKey(t, 2)
+	keys := NewKeyring(primary, previous)
+
+	current := httptest.NewRecorder()
+	WriteEncrypted(current, http.Cookie{Name: "session", Value: "token"}, NewKeyring(previous))
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"key ID", legacyEncrypted(t, primary, "session", "token", true)},
+		{"key ID of previous key", legacyEncrypted(t, previous, "session", "token", true)},
+		{"without key ID", legacyEncrypted(t, primary, "session", "token", false)},
+		{"without key ID of previous key", legacyEncrypted(t, previous, "session", "token", false)},
+		{"envelope of previous key", current.Result().Cookies()[0].Value},
+	}
+	for _, tt := range tests {
+		// read as is
+		if got, err := ReadEncrypted(withValue("session", tt.value), "session", keys); err != nil || got != "token" {
+			t.Errorf("%s: ReadEncrypted = %q, %v", tt.name, got, err)
+		}
+
+		// and re-issued in the current format with the primary key
+		w := httptest.NewRecorder()
+		got, err := ReadEncryptedRotate(w, withValue("session", tt.value), http.Cookie{Name: "session", Path: "/"}, keys)
+		if err != nil || got != "token" {
+			t.Errorf("%s: ReadEncryptedRotate = %q, %v", tt.name, got, err)
+		}
+		reissued := w.Result().Cookies()
+		if len(reissued) != 1 || !strings.HasPrefix(reissued[0].Value, prefixEncrypted) || reissued[0].Path != "/" {
+			t.Fatalf("%s: re-issued %v", tt.name, reissued)
+		}
+		if got, err := ReadEncrypted(request(w), "session", NewKeyring(primary)); err != nil || got != "token" {
+			t.Errorf("%s: re-issued cookie reads %q, %v", tt.name, got, err)
+		}
+
+		// and only as the cookie it was written for
+		if _, err := ReadEncrypted(withValue("other", tt.value), "other", keys); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("%s: read as other cookie: %v, want ErrInvalidValue", tt.name, err)
+		}
+	}
+
+	// cookies of the current format with the primary key are left alone
+	w := httptest.NewRecorder()
+	WriteEncrypted(w, http.Cookie{Name: "session", Value: "token"}, keys)
+	rotated := httptest.NewRecorder()
+	if _, err := ReadEncryptedRotate(rotated, request(w), http.Cookie{Name: "session"}, keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated.Result().Cookies()) > 0 {
+		t.Error("current cookie re-issued")
+	}
+}
+
+func TestEncryptedTampered(t *testing.T) {
+	keys := NewKeyring(testKey(t, 1))
+	w := httptest.NewRecorder()
+	WriteEncrypted(w, http.Cookie{Name: "session", Value: "token"}, keys)
+	value := w.Result().Cookies()[0].Value
+
+	raw, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, prefixEncrypted))
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)-1] ^= 1
+	unknownID := append([]byte(nil), raw...)
+	unknownID[0] ^= 1
+
+	tests := []struct {
+		name  string
+		value string
+		keys  *Keyring
+	}{
+		{"other key", value, NewKeyring(testKey(t, 2))},
+		{"changed ciphertext", prefixEncrypted + base64.RawURLEncoding.EncodeToString(flipped), keys},
+		{"unknown key ID", prefixEncrypted + base64.RawURLEncoding.EncodeToString(unknownID), keys},
+		{"truncated", value[:len(value)-10], keys},
+		{"only key ID", prefixEncrypted + base64.RawURLEncoding.EncodeToString(raw[:4]), keys},
+		{"too short", prefixEncrypted + "AA", keys},
+		{"not base64", prefixEncrypted + "!!!!", keys},
+		{"legacy garbage", base64.URLEncoding.EncodeToString([]byte("garbage")), keys},
+		{"signed", signedValue(t, keys, "session", "token"), keys},
+	}
+	for _, tt := range tests {
+		if got, err := ReadEncrypted(withValue("session", tt.value), "session", tt.keys); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("%s: ReadEncrypted = %q, %v, want ErrInvalidValue", tt.name, got, err)
+		}
+	}
+
+	// a cookie copied to another name does not decrypt as that cookie
+	if _, err := ReadEncrypted(withValue("other", value), "other", keys); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("read as other cookie: %v, want ErrInvalidValue", err)
+	}
+}
+
+func signedValue(t *testing.T, keys *Keyring, name, value string) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if err := WriteSigned(w, http.Cookie{Name: name, Value: value}, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Result().Cookies()[0].Value
+}
+
+func TestSignedTampered(t *testing.T) {
+	primary, previous := testKey(t, 1), testKey(t, 2)
+	keys := NewKeyring(primary, previous)
+	value := signedValue(t, keys, "flash", "profile updated")
+
+	encodedPayload, encodedMAC, _ := strings.Cut(strings.TrimPrefix(value, prefixSigned), ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encodedPayload)
+	changed := bytes.Replace(payload, []byte("profile updated"), []byte("password changed"), 1)
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	// signing with the key ID of another key in the keyring
+	otherID := append(binary.BigEndian.AppendUint32(nil, previous.ID), payload[4:]...)
+
+	tests := []struct {
+		name  string
+		value string
+		keys  *Keyring
+	}{
+		{"other key", value, NewKeyring(testKey(t, 3))},
+		{"changed value", prefixSigned + b64(changed) + "." + encodedMAC, keys},
+		{"changed MAC", prefixSigned + encodedPayload + "." + b64(make([]byte, 32)), keys},
+		{"key ID of another key", prefixSigned + b64(otherID) + "." + encodedMAC, keys},
+		{"no MAC", prefixSigned + encodedPayload, keys},
+		{"empty MAC", prefixSigned + encodedPayload + ".", keys},
+		{"no prefix", strings.TrimPrefix(value, prefixSigned), keys},
+		{"encrypted prefix", prefixEncrypted + strings.TrimPrefix(value, prefixSigned), keys},
+		{"too short", prefixSigned + "AA." + encodedMAC, keys},
+		{"not base64", prefixSigned + "!!!!." + encodedMAC, keys},
+	}
+	for _, tt := range tests {
+		if got, err := ReadSigned(withValue("flash", tt.value), "flash", tt.keys); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("%s: ReadSigned = %q, %v, want ErrInvalidValue", tt.name, got, err)
+		}
+	}
+
+	// the value is signed together with the name of the cookie
+	if _, err := ReadSigned(withValue("other", value), "other", keys); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("read as other cookie: %v, want ErrInvalidValue", err)
+	}
+	// cookies signed with a previous key stay valid
+	old := signedValue(t, NewKeyring(previous), "flash", "profile updated")
+	if got, err := ReadSigned(withValue("flash", old), "flash", keys); err != nil || got != "profile updated" {
+		t.Errorf("signed with previous key: %q, %v", got, err)
+	}
+}
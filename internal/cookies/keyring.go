@@ -0,0 +1,139 @@
+package cookies
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrNoKeys = errors.New("keyring has no keys")
+
+// Key is an AES key for encrypted cookies. Its ID is stored in every cookie
+// encrypted with it, so readers know which key to use.
+type Key struct {
+	ID     uint32
+	Secret []byte
+}
+
+// NewKey returns the key for secret. Its ID is derived from the secret, so
+// the same secret always gets the same ID.
+func NewKey(secret []byte) (Key, error) {
+	// Check the key length by creating a cipher from it. Only 16, 24 and 32
+	// bytes are valid for AES-128, AES-192 and AES-256.
+	if _, err := aes.NewCipher(secret); err != nil {
+		return Key{}, err
+	}
+
+	sum := sha256.Sum256(secret)
+
+	return Key{ID: binary.BigEndian.Uint32(sum[:4]), Secret: secret}, nil
+}
+
+// GenerateKey returns a new random AES-256 key.
+func GenerateKey() (Key, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return Key{}, err
+	}
+
+	return NewKey(secret)
+}
+
+// Keyring is a list of keys for encrypted cookies. The first key, the
+// primary key, encrypts new cookies. All keys may decrypt, so cookies
+// encrypted with a previous primary key stay valid until they are
+// re-issued.
+type Keyring struct {
+	keys []Key
+}
+
+// NewKeyring returns a keyring with primary as its primary key.
+func NewKeyring(primary Key, previous ...Key) *Keyring {
+	return &Keyring{keys: append([]Key{primary}, previous...)}
+}
+
+// Primary returns the key that encrypts new cookies.
+func (kr *Keyring) Primary() Key {
+	return kr.keys[0]
+}
+
+// Keys returns all keys, the primary key first.
+func (kr *Keyring) Keys() []Key {
+	return kr.keys
+}
+
+// key returns the key with the given ID.
+func (kr *Keyring) key(id uint32) (Key, bool) {
+	for _, k := range kr.keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+
+	return Key{}, false
+}
+
+// Rotate returns a keyring with primary as its new primary key. The current
+// keys stay available for decryption, but only the newest keep of them.
+func (kr *Keyring) Rotate(primary Key, keep int) *Keyring {
+	previous := kr.keys
+	if len(previous) > keep {
+		previous = previous[:keep]
+	}
+
+	return NewKeyring(primary, previous...)
+}
+
+// ParseKeyring reads a keyring with one hex encoded key per line, the
+// primary key first. Empty lines and lines starting with # are ignored.
+func ParseKeyring(r io.Reader) (*Keyring, error) {
+	var keys []Key
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		secret, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		key, err := NewKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return NewKeyring(keys[0], keys[1:]...), nil
+}
+
+// WriteTo writes the keyring in the format read by ParseKeyring.
+func (kr *Keyring) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	b.WriteString("# pinub cookie keys, the first one encrypts new cookies\n")
+	for _, k := range kr.keys {
+		b.WriteString(hex.EncodeToString(k.Secret))
+		b.WriteString("\n")
+	}
+
+	n, err := io.WriteString(w, b.String())
+
+	return int64(n), err
+}
@@ -0,0 +1,73 @@
+package cookies
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strings"
+)
+
+// WriteSigned writes a cookie whose value can be read by the client, but
+// not changed. Use it for values that are not secret, like flash messages
+// or preferences. The value is in the format
+// "s2.{base64 of key id and envelope}.{base64 of HMAC-SHA256}".
+func WriteSigned(w http.ResponseWriter, cookie http.Cookie, keys *Keyring) error {
+	key := keys.Primary()
+
+	payload := binary.BigEndian.AppendUint32(nil, key.ID)
+	payload = append(payload, sealEnvelope(cookie)...)
+
+	cookie.Value = prefixSigned +
+		base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(key, payload))
+
+	return writeChunked(w, cookie)
+}
+
+// ReadSigned returns the value of a cookie written by WriteSigned, if its
+// signature is valid and it has not expired.
+func ReadSigned(r *http.Request, name string, keys *Keyring) (string, error) {
+	raw, err := readChunked(r, name)
+	if err != nil {
+		return "", err
+	}
+
+	signed, ok := strings.CutPrefix(raw, prefixSigned)
+	if !ok {
+		return "", ErrInvalidValue
+	}
+	encodedPayload, encodedMAC, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", ErrInvalidValue
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) < 4 {
+		return "", ErrInvalidValue
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return "", ErrInvalidValue
+	}
+
+	key, ok := keys.key(binary.BigEndian.Uint32(payload[:4]))
+	if !ok || !hmac.Equal(mac, sign(key, payload)) {
+		return "", ErrInvalidValue
+	}
+
+	return openEnvelope(string(payload[4:]), name)
+}
+
+// sign returns the HMAC-SHA256 of payload. The HMAC key is derived from the
+// key, so the same secret is never used for both AES and HMAC.
+func sign(key Key, payload []byte) []byte {
+	derived := hmac.New(sha256.New, key.Secret)
+	derived.Write([]byte("pinub signed cookie"))
+
+	mac := hmac.New(sha256.New, derived.Sum(nil))
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
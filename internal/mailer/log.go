@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Log is a mailer for development. It writes every message as .eml file to
+// Dir, or to the log if Dir is empty.
+type Log struct {
+	Dir  string
+	From string
+	// Body logs the body of messages, too. Bodies hold reset and sign in
+	// links, so without Body only the recipient and subject are logged.
+	Body bool
+}
+
+func (m *Log) Send(ctx context.Context, msg Message) error {
+	if len(m.Dir) == 0 {
+		attrs := []any{"to", msg.To, "subject", msg.Subject}
+		if m.Body {
+			attrs = append(attrs, "body", msg.Body)
+		}
+		slog.Info("mail", attrs...)
+		return nil
+	}
+
+	// addresses may contain characters that are not valid in file names
+	name := time.Now().UTC().Format("20060102T150405.000000000") + ".eml"
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, format(m.From, msg), 0o600); err != nil {
+		return err
+	}
+	slog.Info("mail", "to", msg.To, "subject", msg.Subject, "file", path)
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP delivers messages to an SMTP server. It upgrades the connection
+// with STARTTLS if the server offers it and authenticates if Username is
+// set.
+type SMTP struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Username string
+	Password string
+	// From is the sender of all messages.
+	From string
+
+	// rootCAs verify the certificate of the server instead of the system
+	// roots, for tests.
+	rootCAs *x509.CertPool
+}
+
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// net/smtp knows nothing about contexts, so the deadline has to be on
+	// the connection.
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+	// and cancelling ctx cuts the conversation short
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, RootCAs: m.rootCAs}); err != nil {
+			return err
+		}
+	}
+	if len(m.Username) > 0 {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(format(m.From, msg)); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,248 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// session is what an SMTP client told smtpServer.
+type session struct {
+	tls  bool
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// smtpServer accepts one SMTP session on a local port. It offers
+// STARTTLS if cert is set.
+type smtpServer struct {
+	net.Listener
+	cert     *tls.Certificate
+	sessions chan session
+}
+
+func newSMTPServer(t *testing.T, cert *tls.Certificate) *smtpServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{Listener: l, cert: cert, sessions: make(chan session, 1)}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.sessions <- s.serve(conn)
+	}()
+
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) session {
+	var sess session
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return sess
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			ext := []string{"250-localhost", "250-AUTH PLAIN"}
+			if s.cert != nil && !sess.tls {
+				ext = append(ext, "250-STARTTLS")
+			}
+			for _, l := range ext {
+				tp.PrintfLine("%s", l)
+			}
+			tp.PrintfLine("250 8BITMIME")
+		case "STARTTLS":
+			tp.PrintfLine("220 go ahead")
+			tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*s.cert}})
+			if err := tc.Handshake(); err != nil {
+				return sess
+			}
+			conn, sess.tls = tc, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			sess.auth = strings.TrimPrefix(arg, "PLAIN ")
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			sess.from = arg
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			sess.to = append(sess.to, arg)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return sess
+			}
+			sess.data = string(b)
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return sess
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// newCert returns a certificate for 127.0.0.1 and the pool trusting it.
+func newCert(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+var testMessage = Message{
+	To:      "user@example.com",
+	Subject: "Reset your password",
+	// a line with a single dot ends DATA unless it is escaped
+	Body: "Hello,\n.\nbye\n",
+}
+
+func TestSMTP(t *testing.T) {
+	cert, roots := newCert(t)
+
+	tests := []struct {
+		name     string
+		cert     *tls.Certificate
+		username string
+	}{
+		{"plain", nil, ""},
+		{"plain with auth", nil, "pinub"},
+		{"STARTTLS", cert, ""},
+		{"STARTTLS with auth", cert, "pinub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSMTPServer(t, tt.cert)
+			m := &SMTP{Addr: srv.Addr().String(), Username: tt.username, Password: "secret", From: "pinub@example.com", rootCAs: roots}
+			if err := m.Send(context.Background(), testMessage); err != nil {
+				t.Fatal(err)
+			}
+
+			sess := <-srv.sessions
+			if sess.tls != (tt.cert != nil) {
+				t.Errorf("TLS = %v", sess.tls)
+			}
+			if sess.from != "FROM:<pinub@example.com> BODY=8BITMIME" || len(sess.to) != 1 || sess.to[0] != "TO:<user@example.com>" {
+				t.Errorf("envelope from %s to %v", sess.from, sess.to)
+			}
+			wantAuth := ""
+			if tt.username != "" {
+				wantAuth = base64.StdEncoding.EncodeToString([]byte("\x00pinub\x00secret"))
+			}
+			if sess.auth != wantAuth {
+				t.Errorf("auth = %q, want %q", sess.auth, wantAuth)
+			}
+
+			header, body, _ := strings.Cut(sess.data, "\n\n")
+			for _, h := range []string{"From: pinub@example.com", "To: user@example.com", "Subject: Reset your password"} {
+				if !strings.Contains(header, h+"\n") {
+					t.Errorf("header %q missing in:\n%s", h, header)
+				}
+			}
+			if body != "Hello,\n.\nbye\n" {
+				t.Errorf("body = %q", body)
+			}
+		})
+	}
+}
+
+// A server with a certificate the client does not trust gets no message.
+func TestSMTPUntrusted(t *testing.T) {
+	cert, _ := newCert(t)
+	_, roots := newCert(t)
+	srv := newSMTPServer(t, cert)
+
+	m := &SMTP{Addr: srv.Addr().String(), From: "pinub@example.com", rootCAs: roots}
+	if err := m.Send(context.Background(), testMessage); err == nil {
+		t.Fatal("message sent to untrusted server")
+	}
+	if sess := <-srv.sessions; sess.data != "" {
+		t.Errorf("server got %q", sess.data)
+	}
+}
+
+// Cancelling the context stops waiting for a server that does not answer.
+func TestSMTPCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		done <- (&SMTP{Addr: l.Addr().String(), From: "pinub@example.com"}).Send(ctx, testMessage)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("message sent to a silent server")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send did not return after cancel")
+	}
+}
@@ -0,0 +1,288 @@
+// Package oidc signs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE (RFC 7636). The provider is found by
+// discovery and ID tokens are checked against its published keys.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider is an OpenID Connect provider pinub is registered at as client.
+type Provider struct {
+	// Issuer is the URL the discovery document is found under.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested besides openid. Without them, email and profile
+	// are requested.
+	Scopes []string
+	// HTTPClient talks to the provider. It defaults to a client with a
+	// timeout.
+	HTTPClient *http.Client
+
+	mu         sync.Mutex
+	discovery  *discovery
+	keys       map[string]any
+	keysLoaded time.Time
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the claims of an ID token pinub uses.
+type Claims struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+
+	return defaultClient
+}
+
+// discover loads the discovery document of the provider once.
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := &discovery{}
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, d); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: discovery: issuer %q, want %q", d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery: endpoints missing")
+	}
+	p.discovery = d
+
+	return d, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// Auth is what the client remembers between sending the user to the
+// provider and the user coming back.
+type Auth struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewAuth returns random values for a new sign in.
+func NewAuth() (*Auth, error) {
+	var values [3]string
+	for i := range values {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	return &Auth{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// AuthURL returns the address that asks the user to sign in at the provider,
+// which then redirects them to redirectURI.
+func (p *Provider) AuthURL(ctx context.Context, auth *Auth, redirectURI string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	challenge := sha256.Sum256([]byte(auth.Verifier))
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", strings.Join(append([]string{"openid"}, scopes...), " "))
+	v.Set("state", auth.State)
+	v.Set("nonce", auth.Nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the code the provider sent the user back with for an ID
+// token, checks it and returns its claims.
+func (p *Provider) Exchange(ctx context.Context, auth *Auth, code, redirectURI string) (*Claims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("client_id", p.ClientID)
+	v.Set("code_verifier", auth.Verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("oidc: token: %s: %w", resp.Status, err)
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("oidc: token: %s: %s", token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token: %s without ID token", resp.Status)
+	}
+
+	return p.verify(ctx, d, token.IDToken, auth.Nonce, time.Now())
+}
+
+// leeway allows for clocks that are a little off.
+const leeway = time.Minute
+
+// verify checks the signature and claims of the ID token.
+func (p *Provider) verify(ctx context.Context, d *discovery, idToken, nonce string, now time.Time) (*Claims, error) {
+	payload, err := p.verifySignature(ctx, d, idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Subject       string          `json:"sub"`
+		Audience      audience        `json:"aud"`
+		AuthorizedBy  string          `json:"azp"`
+		Expires       int64           `json:"exp"`
+		IssuedAt      int64           `json:"iat"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified json.RawMessage `json:"email_verified"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("oidc: ID token claims: %w", err)
+	}
+
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("oidc: ID token from %q, want %q", claims.Issuer, d.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return nil, errors.New("oidc: ID token for another client")
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID:
+		return nil, errors.New("oidc: ID token authorized for another client")
+	case now.After(time.Unix(claims.Expires, 0).Add(leeway)):
+		return nil, errors.New("oidc: ID token expired")
+	case now.Add(leeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, errors.New("oidc: ID token issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("oidc: ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, errors.New("oidc: ID token without subject")
+	}
+
+	// some providers send the boolean as string
+	verified := strings.Trim(string(claims.EmailVerified), `"`) == "true"
+
+	return &Claims{
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified,
+	}, nil
+}
+
+// audience is a single audience or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,268 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"dab.io/pinub/internal/oidc/oidctest"
+)
+
+const redirectURI = "http://localhost:8080/signin/oidc/callback"
+
+func newProvider(t *testing.T) (*Provider, *oidctest.Server) {
+	t.Helper()
+
+	srv, err := oidctest.NewServer("pinub", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	return &Provider{Issuer: srv.URL, ClientID: "pinub", ClientSecret: "secret"}, srv
+}
+
+// signIn runs the authorization code flow and returns the claims of the
+// ID token.
+func signIn(t *testing.T, p *Provider, srv *oidctest.Server) (*Claims, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	auth, err := NewAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthURL(ctx, auth, redirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := srv.Authorize(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(back)
+	if u.Query().Get("state") != auth.State {
+		t.Fatal("provider did not send the state back")
+	}
+
+	return p.Exchange(ctx, auth, u.Query().Get("code"), redirectURI)
+}
+
+func TestExchange(t *testing.T) {
+	p, srv := newProvider(t)
+
+	for _, alg := range []struct{ alg, kid string }{{"RS256", oidctest.RSAKeyID}, {"ES256", oidctest.ECKeyID}} {
+		srv.Claims = map[string]any{"email": "oidc@example.com", "email_verified": true}
+		srv.IDToken = func(claims map[string]any) string {
+			return srv.Sign(alg.alg, alg.kid, claims)
+		}
+
+		claims, err := signIn(t, p, srv)
+		if err != nil {
+			t.Fatalf("%s: %v", alg.alg, err)
+		}
+		want := Claims{Issuer: srv.URL, Subject: "subject", Email: "oidc@example.com", EmailVerified: true}
+		if *claims != want {
+			t.Errorf("%s: claims = %+v, want %+v", alg.alg, *claims, want)
+		}
+	}
+
+	// some providers send email_verified as string
+	srv.Claims = map[string]any{"email": "oidc@example.com", "email_verified": "true"}
+	srv.IDToken = nil
+	if claims, err := signIn(t, p, srv); err != nil || !claims.EmailVerified {
+		t.Errorf("email_verified as string: %+v, %v", claims, err)
+	}
+	srv.Claims = map[string]any{"email": "oidc@example.com"}
+	if claims, err := signIn(t, p, srv); err != nil || claims.EmailVerified {
+		t.Errorf("email_verified missing: %+v, %v", claims, err)
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	p, srv := newProvider(t)
+	ctx := context.Background()
+
+	auth, _ := NewAuth()
+	authURL, err := p.AuthURL(ctx, auth, redirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := url.ParseQuery(authURL[strings.Index(authURL, "?")+1:])
+	sum := sha256.Sum256([]byte(auth.Verifier))
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("authorization URL without S256 challenge of the verifier: %s", authURL)
+	}
+	if q.Get("state") != auth.State || q.Get("nonce") != auth.Nonce || strings.Contains(authURL, auth.Verifier) {
+		t.Errorf("authorization URL with wrong state or nonce, or the verifier: %s", authURL)
+	}
+
+	// a code intercepted on its way back is useless without the verifier
+	back, err := srv.Authorize(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(back)
+	stolen := &Auth{State: auth.State, Nonce: auth.Nonce, Verifier: "guessed"}
+	if _, err := p.Exchange(ctx, stolen, u.Query().Get("code"), redirectURI); err == nil {
+		t.Error("code exchanged without the verifier")
+	}
+	if srv.Tokens() != 0 {
+		t.Error("provider issued a token without the verifier")
+	}
+}
+
+func TestNonce(t *testing.T) {
+	p, srv := newProvider(t)
+	ctx := context.Background()
+
+	// an ID token for another sign in does not count
+	auth, _ := NewAuth()
+	authURL, _ := p.AuthURL(ctx, auth, redirectURI)
+	back, err := srv.Authorize(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(back)
+	other := &Auth{State: auth.State, Nonce: "another nonce", Verifier: auth.Verifier}
+	if _, err := p.Exchange(ctx, other, u.Query().Get("code"), redirectURI); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("Exchange with other nonce = %v, want nonce error", err)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	p, srv := newProvider(t)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		ok     bool
+	}{
+		{"other issuer", map[string]any{"iss": "https://evil.example"}, false},
+		{"no issuer", map[string]any{"iss": nil}, false},
+		{"other audience", map[string]any{"aud": "other"}, false},
+		{"no audience", map[string]any{"aud": nil}, false},
+		{"audience list", map[string]any{"aud": []string{"pinub"}}, true},
+		{"audiences with azp", map[string]any{"aud": []string{"pinub", "other"}, "azp": "pinub"}, true},
+		{"audiences without azp", map[string]any{"aud": []string{"pinub", "other"}}, false},
+		{"audiences with other azp", map[string]any{"aud": []string{"pinub", "other"}, "azp": "other"}, false},
+		{"expired", map[string]any{"exp": now.Add(-2 * time.Minute).Unix()}, false},
+		{"expired within leeway", map[string]any{"exp": now.Add(-30 * time.Second).Unix()}, true},
+		{"no expiry", map[string]any{"exp": nil}, false},
+		{"issued in the future", map[string]any{"iat": now.Add(5 * time.Minute).Unix()}, false},
+		{"no nonce", map[string]any{"nonce": nil}, false},
+		{"no subject", map[string]any{"sub": nil}, false},
+	}
+	for _, tt := range tests {
+		srv.Claims = tt.claims
+		_, err := signIn(t, p, srv)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: ID token accepted", tt.name)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	p, srv := newProvider(t)
+
+	tests := []struct {
+		name    string
+		idToken func(claims map[string]any) string
+	}{
+		{"alg none", func(claims map[string]any) string {
+			return srv.Sign("none", oidctest.RSAKeyID, claims)
+		}},
+		{"alg none without kid", func(claims map[string]any) string {
+			return srv.Sign("none", "", claims)
+		}},
+		{"HS256 with the client secret", func(claims map[string]any) string {
+			return srv.Sign("HS256", oidctest.RSAKeyID, claims)
+		}},
+		{"RS256 under the EC key", func(claims map[string]any) string {
+			return srv.Sign("RS256", oidctest.ECKeyID, claims)
+		}},
+		{"ES256 under the RSA key", func(claims map[string]any) string {
+			return srv.Sign("ES256", oidctest.RSAKeyID, claims)
+		}},
+		{"unknown kid", func(claims map[string]any) string {
+			return srv.Sign("RS256", "rsa-2", claims)
+		}},
+		{"altered claims", func(claims map[string]any) string {
+			parts := strings.Split(srv.Sign("RS256", oidctest.RSAKeyID, claims), ".")
+			claims["sub"] = "admin"
+			forged := strings.Split(srv.Sign("RS256", oidctest.RSAKeyID, claims), ".")
+			return parts[0] + "." + forged[1] + "." + parts[2]
+		}},
+		{"no signature", func(claims map[string]any) string {
+			jwt := srv.Sign("RS256", oidctest.RSAKeyID, claims)
+			return jwt[:strings.LastIndex(jwt, ".")+1]
+		}},
+		{"not a JWT", func(map[string]any) string { return "not.a-jwt" }},
+		{"malformed parts", func(map[string]any) string { return "!!.!!.!!" }},
+	}
+	for _, tt := range tests {
+		srv.IDToken = tt.idToken
+		if claims, err := signIn(t, p, srv); err == nil {
+			t.Errorf("%s: ID token accepted with %+v", tt.name, claims)
+		}
+	}
+}
+
+// Keys are loaded again for an unknown key ID after the provider rotated
+// them, but not more often than keysRefresh.
+func TestKeyRotation(t *testing.T) {
+	p, srv := newProvider(t)
+
+	if _, err := signIn(t, p, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.IDToken = func(claims map[string]any) string {
+		return srv.Sign("RS256", "rotated", claims)
+	}
+	if _, err := signIn(t, p, srv); err == nil {
+		t.Fatal("unknown key ID accepted")
+	}
+
+	p.mu.Lock()
+	p.keys["rotated"] = p.keys[oidctest.RSAKeyID]
+	p.mu.Unlock()
+	if _, err := signIn(t, p, srv); err != nil {
+		t.Errorf("known key ID refused: %v", err)
+	}
+
+	// the keys loaded from the provider replace the ones known before
+	p.mu.Lock()
+	p.keysLoaded = time.Time{}
+	p.mu.Unlock()
+	srv.IDToken = func(claims map[string]any) string {
+		return srv.Sign("RS256", "gone", claims)
+	}
+	if _, err := signIn(t, p, srv); err == nil {
+		t.Fatal("unknown key ID accepted after refresh")
+	}
+	p.mu.Lock()
+	_, ok := p.keys["rotated"]
+	p.mu.Unlock()
+	if ok {
+		t.Error("key removed by the provider still known")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	_, srv := newProvider(t)
+
+	// the discovery document has to be of the configured issuer
+	p := &Provider{Issuer: srv.URL + "/", ClientID: "pinub"}
+	if _, err := p.AuthURL(context.Background(), &Auth{}, redirectURI); err == nil {
+		t.Error("discovery of another issuer accepted")
+	}
+}
@@ -0,0 +1,248 @@
+// Package oidctest runs an OpenID Connect provider for tests. It serves
+// discovery, its keys and the token endpoint, and signs users in without
+// asking them.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Key IDs of the keys the provider publishes.
+const (
+	RSAKeyID = "rsa-1"
+	ECKeyID  = "ec-1"
+)
+
+// Server is the provider. Set its fields before users sign in.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	// Claims go into the next ID tokens, over the claims the provider
+	// sets itself: iss, sub, aud, exp, iat and nonce. A nil value removes
+	// a claim.
+	Claims map[string]any
+	// IDToken turns the claims into the ID token. It defaults to signing
+	// them with RS256.
+	IDToken func(claims map[string]any) string
+
+	RSAKey *rsa.PrivateKey
+	ECKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authRequest
+	// tokens counts the ID tokens issued.
+	tokens int
+}
+
+type authRequest struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// NewServer starts a provider for the client. Close it when done.
+func NewServer(clientID, clientSecret string) (*Server, error) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RSAKey:       rsaKey,
+		ECKey:        ecKey,
+		codes:        map[string]authRequest{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /keys", s.keys)
+	mux.HandleFunc("POST /token", s.token)
+	s.Server = httptest.NewServer(mux)
+
+	return s, nil
+}
+
+// Authorize signs the user in at the authorization URL the client sent
+// them to, and returns the URL the provider redirects them back to.
+func (s *Server) Authorize(authURL string) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != s.ClientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		return "", errors.New("oidctest: authorization request not valid")
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = authRequest{
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+	}
+	s.mu.Unlock()
+
+	back, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		return "", err
+	}
+	v := back.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	back.RawQuery = v.Encode()
+
+	return back.String(), nil
+}
+
+// Tokens returns the number of ID tokens issued.
+func (s *Server) Tokens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokens
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/keys",
+	})
+}
+
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	point, _ := s.ECKey.PublicKey.Bytes()
+
+	writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": RSAKeyID, "use": "sig", "alg": "RS256",
+			"n": b64(s.RSAKey.N.Bytes()), "e": b64(big.NewInt(int64(s.RSAKey.E)).Bytes())},
+		{"kty": "EC", "kid": ECKeyID, "use": "sig", "alg": "ES256", "crv": "P-256",
+			"x": b64(point[1:33]), "y": b64(point[33:])},
+	}})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if s.ClientSecret != "" && (!ok || id != url.QueryEscape(s.ClientID) || secret != url.QueryEscape(s.ClientSecret)) {
+		fail("invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("client_id") != s.ClientID {
+		fail("invalid_request")
+		return
+	}
+
+	s.mu.Lock()
+	code := r.PostFormValue("code")
+	req, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+	if !ok || req.redirectURI != r.PostFormValue("redirect_uri") {
+		fail("invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(req.challenge)) != 1 {
+		fail("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   s.URL,
+		"sub":   "subject",
+		"aud":   s.ClientID,
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"iat":   now.Unix(),
+		"nonce": req.nonce,
+	}
+	s.mu.Lock()
+	maps.Copy(claims, s.Claims)
+	s.tokens++
+	idToken := s.IDToken
+	s.mu.Unlock()
+	maps.DeleteFunc(claims, func(_ string, v any) bool { return v == nil })
+
+	if idToken == nil {
+		idToken = func(claims map[string]any) string {
+			return s.Sign("RS256", RSAKeyID, claims)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken(claims),
+	})
+}
+
+// Sign returns a JWT with the claims, signed with alg: RS256 and ES256 use
+// the keys of the provider, HS256 the client secret, and none nothing. The
+// header names kid as key.
+func (s *Server) Sign(alg, kid string, claims map[string]any) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, s.RSAKey, crypto.SHA256, hash[:])
+	case "ES256":
+		// JWS uses the fixed size r || s encoding, not ASN.1
+		r, sig, _ := ecdsa.Sign(rand.Reader, s.ECKey, hash[:])
+		signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte(s.ClientSecret))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+
+	return signed + "." + b64(signature)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
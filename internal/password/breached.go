@@ -0,0 +1,102 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// Breached is a file of SHA-1 hashes of breached passwords, like the Have I
+// Been Pwned downloader writes it: one uppercase hash per line, optionally
+// followed by a colon and a count, sorted by hash. Lookups seek in the file
+// and never send the password or its hash anywhere.
+type Breached struct {
+	f    *os.File
+	size int64
+}
+
+// hashLen is the length of a hex encoded SHA-1 hash.
+const hashLen = 2 * sha1.Size
+
+// OpenBreached opens the file of breached password hashes at path.
+func OpenBreached(path string) (*Breached, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Breached{f: f, size: fi.Size()}, nil
+}
+
+// Close closes the file.
+func (b *Breached) Close() error {
+	return b.f.Close()
+}
+
+// Contains reports whether password is in the file.
+func (b *Breached) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	want := bytes.ToUpper([]byte(hex.EncodeToString(sum[:])))
+
+	// binary search for the first line with a hash not less than want,
+	// by the offsets lines start at or after
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		hash, err := b.hashAfter(mid)
+		if err != nil {
+			return false, err
+		}
+		if hash != nil && bytes.Compare(hash, want) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	hash, err := b.hashAfter(lo)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(hash, want), nil
+}
+
+// hashAfter returns the hash of the first line starting at off or after it,
+// or nil if there is none.
+func (b *Breached) hashAfter(off int64) ([]byte, error) {
+	// a line starts at off if the byte before it ends the previous one
+	if off > 0 {
+		buf := make([]byte, 64)
+		for pos := off - 1; ; pos += int64(len(buf)) {
+			n, err := b.f.ReadAt(buf, pos)
+			if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+				off = pos + int64(i) + 1
+				break
+			}
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	hash := make([]byte, hashLen)
+	if _, err := b.f.ReadAt(hash, off); errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return bytes.ToUpper(hash), nil
+}
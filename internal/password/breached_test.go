@@ -0,0 +1,119 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// breachedFile writes hashes, one per line, formatted by line, and opens
+// the file.
+func breachedFile(t *testing.T, hashes []string, line func(hash string) string) *Breached {
+	t.Helper()
+
+	var b strings.Builder
+	for _, hash := range hashes {
+		b.WriteString(line(hash))
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	breached, err := OpenBreached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { breached.Close() })
+
+	return breached
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestBreached(t *testing.T) {
+	// passwords sorted by their hash, every third one is not in the file,
+	// nor are the first and the last one, so the file starts and ends with
+	// hashes of passwords between them
+	var passwords []string
+	for i := range 200 {
+		passwords = append(passwords, fmt.Sprintf("password-%d", i))
+	}
+	sort.Slice(passwords, func(i, j int) bool {
+		return sha1Hex(passwords[i]) < sha1Hex(passwords[j])
+	})
+	listed := map[string]bool{}
+	var hashes []string
+	for i, p := range passwords {
+		if i == 0 || i == len(passwords)-1 || i%3 == 2 {
+			continue
+		}
+		listed[p] = true
+		hashes = append(hashes, sha1Hex(p))
+	}
+	last := passwords[len(passwords)-2]
+	if !listed[passwords[1]] || !listed[last] {
+		t.Fatal("fixture does not start and end with listed passwords")
+	}
+
+	formats := []struct {
+		name string
+		line func(hash string) string
+	}{
+		{"hashes", func(hash string) string { return hash + "\n" }},
+		{"counts", func(hash string) string { return hash + ":" + fmt.Sprint(len(hash)*7) + "\n" }},
+		{"CRLF", func(hash string) string { return hash + ":3\r\n" }},
+		{"lowercase", func(hash string) string { return strings.ToLower(hash) + "\n" }},
+	}
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			breached := breachedFile(t, hashes, f.line)
+			for _, p := range passwords {
+				found, err := breached.Contains(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found != listed[p] {
+					t.Errorf("Contains(%q) = %v, want %v", p, found, listed[p])
+				}
+			}
+		})
+	}
+
+	// the last line may end without a newline
+	breached := breachedFile(t, hashes, func(hash string) string {
+		if hash == sha1Hex(last) {
+			return hash
+		}
+		return hash + "\r\n"
+	})
+	if found, err := breached.Contains(last); err != nil || !found {
+		t.Errorf("Contains(last line without newline) = %v, %v", found, err)
+	}
+}
+
+func TestBreachedEmpty(t *testing.T) {
+	breached := breachedFile(t, nil, nil)
+	if found, err := breached.Contains("password"); err != nil || found {
+		t.Errorf("Contains on empty file = %v, %v", found, err)
+	}
+}
+
+func TestPolicyBreached(t *testing.T) {
+	p := &Policy{MinLength: 8, Breached: breachedFile(t, []string{sha1Hex("correct horse battery staple")}, func(hash string) string {
+		return hash + ":42\n"
+	})}
+	if err := p.Check("correct horse battery staple"); err == nil || !strings.Contains(err.Error(), "data breach") {
+		t.Errorf("Check of breached password = %v", err)
+	}
+	if err := p.Check("purple elephants juggle tangerines"); err != nil {
+		t.Errorf("Check of password not breached = %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms a Hasher can hash with.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// Hasher hashes passwords with the preferred algorithm and parameters. The
+// hashes are strings in PHC format, like
+// $argon2id$v=19$m=19456,t=2,p=1$salt$hash, or the modular crypt format of
+// bcrypt, like $2a$10$..., so each hash names how it was made and older
+// hashes keep working after the preference changes.
+type Hasher struct {
+	// Algorithm is Argon2id or Bcrypt.
+	Algorithm string
+	// Argon2 are the parameters of Argon2id.
+	Argon2 Argon2Params
+	// BcryptCost is the cost of bcrypt.
+	BcryptCost int
+}
+
+// Argon2Params are the parameters of Argon2id.
+type Argon2Params struct {
+	// Memory in KiB.
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// DefaultHasher uses Argon2id with the parameters OWASP recommends.
+var DefaultHasher = &Hasher{
+	Algorithm:  Argon2id,
+	Argon2:     Argon2Params{Memory: 19 * 1024, Time: 2, Threads: 1},
+	BcryptCost: bcrypt.DefaultCost,
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+
+	// Argon2 needs at least 8 KiB of memory per thread. More than 1 GiB
+	// or 64 passes would let a single sign in stall the server.
+	argon2MaxMemory = 1024 * 1024
+	argon2MaxTime   = 64
+)
+
+// Check returns an error if Argon2id cannot hash with p, or would take
+// unreasonably long.
+func (p Argon2Params) Check() error {
+	if p.Threads == 0 || p.Time == 0 || p.Time > argon2MaxTime ||
+		p.Memory < 8*uint32(p.Threads) || p.Memory > argon2MaxMemory {
+		return fmt.Errorf("password: argon2 parameters out of range: m=%d (%d to %d), t=%d (1 to %d), p=%d (at least 1)",
+			p.Memory, 8*max(uint32(p.Threads), 1), argon2MaxMemory, p.Time, argon2MaxTime, p.Threads)
+	}
+
+	return nil
+}
+
+var (
+	errUnknownHash = errors.New("password: unknown hash format")
+	b64            = base64.RawStdEncoding
+)
+
+// Hash returns the hash of password.
+func (h *Hasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case Argon2id:
+		if err := h.Argon2.Check(); err != nil {
+			return "", err
+		}
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		p := h.Argon2
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.Memory, p.Time, p.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+
+	case Bcrypt:
+		// bcrypt would quietly use its default cost for costs too low
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return "", fmt.Errorf("password: bcrypt cost %d out of range, use %d to %d", h.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	}
+
+	return "", fmt.Errorf("password: unknown algorithm %q", h.Algorithm)
+}
+
+// Verify reports whether password matches hash, whatever algorithm made it.
+func Verify(password, hash string) (bool, error) {
+	if strings.HasPrefix(hash, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	p, salt, key, err := parseArgon2(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether hash was made with another algorithm or other
+// parameters than h prefers.
+func (h *Hasher) NeedsRehash(hash string) bool {
+	switch h.Algorithm {
+	case Argon2id:
+		p, _, _, err := parseArgon2(hash)
+		return err != nil || p != h.Argon2
+
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BcryptCost
+	}
+
+	return false
+}
+
+// parseArgon2 splits an Argon2id hash in PHC format.
+func parseArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != Argon2id {
+		return p, nil, nil, errUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("password: unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("password: argon2 parameters: %w", err)
+	}
+	if err := p.Check(); err != nil {
+		return p, nil, nil, err
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("password: argon2 salt: %w", err)
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("password: argon2 hash: %w", err)
+	}
+	if len(key) == 0 {
+		return p, nil, nil, errUnknownHash
+	}
+
+	return p, salt, key, nil
+}
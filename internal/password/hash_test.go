@@ -0,0 +1,99 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fast keeps the tests quick, the parameters do not matter for them.
+var fast = &Hasher{
+	Algorithm:  Argon2id,
+	Argon2:     Argon2Params{Memory: 64, Time: 1, Threads: 1},
+	BcryptCost: bcrypt.MinCost,
+}
+
+func TestHashVerify(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Bcrypt} {
+		h := *fast
+		h.Algorithm = algorithm
+
+		hash, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%s: Hash: %v", algorithm, err)
+		}
+		if ok, err := Verify("correct horse", hash); !ok || err != nil {
+			t.Errorf("%s: Verify(right password) = %v, %v, want true", algorithm, ok, err)
+		}
+		if ok, err := Verify("wrong horse", hash); ok || err != nil {
+			t.Errorf("%s: Verify(wrong password) = %v, %v, want false", algorithm, ok, err)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%s: NeedsRehash of a fresh hash", algorithm)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := fast.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := *fast
+	stronger.Argon2.Time = 2
+	if !stronger.NeedsRehash(hash) {
+		t.Error("other argon2 parameters do not need a rehash")
+	}
+	other := *fast
+	other.Algorithm = Bcrypt
+	if !other.NeedsRehash(hash) {
+		t.Error("other algorithm does not need a rehash")
+	}
+}
+
+// Hashes made with parameters out of range could never be verified, so
+// Hash refuses them.
+func TestHashOutOfRange(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Hasher
+	}{
+		{"no memory", Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 0, Time: 1, Threads: 1}}},
+		{"less than 8 KiB per thread", Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 15, Time: 1, Threads: 2}}},
+		{"too much memory", Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: argon2MaxMemory + 1, Time: 1, Threads: 1}}},
+		{"no time", Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 64, Time: 0, Threads: 1}}},
+		{"too much time", Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 64, Time: argon2MaxTime + 1, Threads: 1}}},
+		{"no threads", Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 64, Time: 1, Threads: 0}}},
+		{"bcrypt cost too low", Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost - 1}},
+		{"bcrypt cost too high", Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MaxCost + 1}},
+		{"unknown algorithm", Hasher{Algorithm: "md5"}},
+	}
+	for _, tt := range tests {
+		if hash, err := tt.h.Hash("correct horse"); err == nil {
+			t.Errorf("%s: Hash = %q, want error", tt.name, hash)
+		}
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"plain",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=256$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$2a$04$" + strings.Repeat("x", 10),
+	}
+	for _, hash := range tests {
+		if ok, err := Verify("correct horse", hash); ok || err == nil {
+			t.Errorf("Verify(%q) = %v, %v, want error", hash, ok, err)
+		}
+	}
+}
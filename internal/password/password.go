@@ -0,0 +1,49 @@
+// Package password decides which passwords users may choose and how they are
+// hashed. A Policy asks for a minimum length and a minimum strength,
+// estimated like zxcvbn does, and refuses passwords found in a local list of
+// breached passwords. A Hasher hashes them with Argon2id or bcrypt.
+package password
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Policy is what a new password must satisfy.
+type Policy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// MinStrength is the minimum score of Strength, from 0 to 4.
+	MinStrength int
+	// Breached lists passwords known from data breaches. Nil turns the
+	// check off.
+	Breached *Breached
+}
+
+// DefaultPolicy asks for eight characters that are not too guessable.
+var DefaultPolicy = &Policy{MinLength: 8, MinStrength: 2}
+
+// Check returns why password does not satisfy the policy, or nil. Inputs are
+// what the user told pinub about themselves, like their email address, which
+// make a password easier to guess. The error is meant for the user.
+func (p *Policy) Check(password string, inputs ...string) error {
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		return fmt.Errorf("password is too short, use at least %d characters", p.MinLength)
+	}
+
+	if score, feedback := Strength(password, inputs...); score < p.MinStrength {
+		return fmt.Errorf("password is too easy to guess: %s", feedback)
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return fmt.Errorf("cannot check password: %w", err)
+		}
+		if breached {
+			return fmt.Errorf("password appeared in a data breach, choose another one")
+		}
+	}
+
+	return nil
+}
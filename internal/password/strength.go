@@ -0,0 +1,354 @@
+package password
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// common lists frequently used passwords and words, most frequent first.
+//
+//go:embed common.txt
+var common string
+
+var commonRanks = func() map[string]int {
+	ranks := map[string]int{}
+	for i, word := range strings.Fields(common) {
+		if _, ok := ranks[word]; !ok {
+			ranks[word] = i + 1
+		}
+	}
+	return ranks
+}()
+
+// keyboardRows are neighbouring keys typed in a row, like qwerty.
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "qwertzuiop", "yxcvbnm"}
+
+// leet maps characters substituted for letters back to them.
+var leet = map[rune]rune{'4': 'a', '@': 'a', '3': 'e', '1': 'i', '!': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't'}
+
+// maxStrengthLen limits the work on long passwords. Characters after it
+// are not counted.
+const maxStrengthLen = 64
+
+// match is a guessable part of a password, from i to j inclusive.
+type match struct {
+	i, j     int
+	guesses  float64
+	feedback string
+}
+
+// Strength estimates how hard password is to guess, the way zxcvbn does: it
+// finds common words, keyboard patterns, sequences, repeats and years and
+// counts the guesses an attacker who knows them needs for the cheapest
+// combination. The score goes from 0, too guessable, to 4, very unguessable.
+// The feedback names the pattern that weakens the password the most.
+func Strength(password string, inputs ...string) (int, string) {
+	runes := []rune(password)
+	if len(runes) > maxStrengthLen {
+		runes = runes[:maxStrengthLen]
+	}
+
+	log10, weakest := cheapest(runes, findMatches(runes, userWords(inputs)))
+
+	var score int
+	switch {
+	case log10 < 3:
+		score = 0
+	case log10 < 6:
+		score = 1
+	case log10 < 8:
+		score = 2
+	case log10 < 10:
+		score = 3
+	default:
+		score = 4
+	}
+
+	feedback := "add another word or two, uncommon words are better"
+	if weakest != nil {
+		feedback = weakest.feedback
+	}
+
+	return score, feedback
+}
+
+// userWords splits the inputs into the words they consist of, like the parts
+// of an email address.
+func userWords(inputs []string) []string {
+	var words []string
+	for _, input := range inputs {
+		input = strings.ToLower(input)
+		words = append(words, input)
+		words = append(words, strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+
+	return words
+}
+
+func findMatches(runes []rune, user []string) []match {
+	lower := []rune(strings.ToLower(string(runes)))
+	unleet := make([]rune, len(lower))
+	leeted := false
+	for k, r := range lower {
+		if l, ok := leet[r]; ok {
+			unleet[k] = l
+			leeted = true
+		} else {
+			unleet[k] = r
+		}
+	}
+
+	var matches []match
+	n := len(runes)
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			matches = append(matches, dictionaryMatches(runes, lower, unleet, leeted, user, i, j)...)
+		}
+	}
+	matches = append(matches, spatialMatches(lower)...)
+	matches = append(matches, sequenceMatches(lower)...)
+	matches = append(matches, repeatMatches(runes, user)...)
+	matches = append(matches, yearMatches(lower)...)
+
+	return matches
+}
+
+// dictionaryMatches checks whether the runes from i to j are a common or
+// user word, maybe reversed, capitalized or with leet substitutions.
+func dictionaryMatches(runes, lower, unleet []rune, leeted bool, user []string, i, j int) []match {
+	var matches []match
+
+	variations := capitalization(runes[i : j+1])
+	word := string(lower[i : j+1])
+	lookup := func(word string, extra float64, reversed bool) {
+		rank, feedback := 0, "it is a common password or word"
+		for _, u := range user {
+			if u == word {
+				rank, feedback = 1, "it is based on what you told pinub about yourself"
+				break
+			}
+		}
+		if rank == 0 {
+			rank = commonRanks[word]
+		}
+		if rank == 0 {
+			return
+		}
+		if reversed {
+			extra *= 2
+			feedback = "reversed words are no harder to guess"
+		}
+		matches = append(matches, match{i, j, float64(rank) * variations * extra, feedback})
+	}
+
+	lookup(word, 1, false)
+	lookup(reverse(word), 1, true)
+	if leeted {
+		if sub := string(unleet[i : j+1]); sub != word {
+			before := len(matches)
+			lookup(sub, 2, false)
+			for k := before; k < len(matches); k++ {
+				matches[k].feedback = "predictable substitutions like @ for a do not help much"
+			}
+		}
+	}
+
+	return matches
+}
+
+// capitalization is the number of ways the word could have been capitalized
+// for the uppercase letters it has.
+func capitalization(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case upper == len(word), upper == 1 && unicode.IsUpper(word[0]), upper == 1 && unicode.IsUpper(word[len(word)-1]):
+		return 2
+	}
+
+	return math.Pow(2, float64(min(upper, len(word)-upper)))
+}
+
+// spatialMatches finds at least four neighbouring keys typed in a row.
+func spatialMatches(lower []rune) []match {
+	var matches []match
+	for i := 0; i < len(lower); i++ {
+		for _, row := range keyboardRows {
+			k := strings.IndexRune(row, lower[i])
+			if k < 0 {
+				continue
+			}
+			j := i
+			for j+1 < len(lower) && k+j+1-i < len(row) && rune(row[k+j+1-i]) == lower[j+1] {
+				j++
+			}
+			if j-i >= 3 {
+				matches = append(matches, match{i, j, float64(len(row)) * float64(j-i+1) * 4, "keyboard patterns like qwerty are easy to guess"})
+			}
+		}
+	}
+
+	return matches
+}
+
+// sequenceMatches finds at least three characters counting up or down, like
+// abc or 9876.
+func sequenceMatches(lower []rune) []match {
+	var matches []match
+	for i := 0; i+2 < len(lower); {
+		delta := lower[i+1] - lower[i]
+		j := i + 1
+		for j+1 < len(lower) && lower[j+1]-lower[j] == delta {
+			j++
+		}
+		if j-i >= 2 && (delta == 1 || delta == -1) {
+			base := 26.0
+			switch {
+			case strings.ContainsRune("a1z9", lower[i]):
+				base = 4
+			case unicode.IsDigit(lower[i]):
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, match{i, j, base * float64(j-i+1), "sequences like abc or 6543 are easy to guess"})
+			i = j
+			continue
+		}
+		i++
+	}
+
+	return matches
+}
+
+// repeatMatches finds characters or parts repeated right after each other,
+// like aaa or abcabc. Guessing them takes as long as guessing the part.
+func repeatMatches(runes []rune, user []string) []match {
+	var matches []match
+	n := len(runes)
+	for i := 0; i < n; i++ {
+		// the shortest part repeated from i on
+		for size := 1; i+2*size <= n; size++ {
+			count := 1
+			for i+(count+1)*size <= n && string(runes[i+count*size:i+(count+1)*size]) == string(runes[i:i+size]) {
+				count++
+			}
+			if count < 2 || (size == 1 && count < 3) {
+				continue
+			}
+			part := runes[i : i+size]
+			log10, _ := cheapest(part, findMatches(part, user))
+			matches = append(matches, match{i, i + count*size - 1, math.Pow(10, log10) * float64(count), "repeats like aaa or abcabc are easy to guess"})
+			break
+		}
+	}
+
+	return matches
+}
+
+// yearMatches finds years from 1900 to 2099.
+func yearMatches(lower []rune) []match {
+	var matches []match
+	for i := 0; i+3 < len(lower); i++ {
+		year := string(lower[i : i+4])
+		if (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && strings.Trim(year, "0123456789") == "" {
+			matches = append(matches, match{i, i + 3, 50, "years are easy to guess"})
+		}
+	}
+
+	return matches
+}
+
+// cheapest finds the combination of matches and random characters that
+// takes the fewest guesses, as zxcvbn does, and returns the base 10
+// logarithm of its guesses and the match covering the most characters.
+func cheapest(runes []rune, matches []match) (float64, *match) {
+	n := len(runes)
+	if n == 0 {
+		return 0, nil
+	}
+
+	// best[j][l] is the cheapest way to guess the first j runes in l parts,
+	// as the logarithm of the product of the guesses of the parts
+	inf := math.Inf(1)
+	best := make([][]float64, n+1)
+	last := make([][]*match, n+1)
+	for j := range best {
+		best[j] = make([]float64, n+1)
+		last[j] = make([]*match, n+1)
+		for l := range best[j] {
+			best[j][l] = inf
+		}
+	}
+	best[0][0] = 0
+
+	byEnd := make([][]*match, n)
+	for k := range matches {
+		m := &matches[k]
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+	random := func(i, j int) *match {
+		// zxcvbn counts 10 guesses per random character
+		return &match{i, j, math.Pow(10, float64(j-i+1)), ""}
+	}
+
+	for j := 0; j < n; j++ {
+		candidates := byEnd[j]
+		for i := 0; i <= j; i++ {
+			candidates = append(candidates, random(i, j))
+		}
+		for _, m := range candidates {
+			guesses := math.Log10(max(m.guesses, 1))
+			for l := 0; l < n; l++ {
+				if prev := best[m.i][l]; prev+guesses < best[j+1][l+1] {
+					best[j+1][l+1] = prev + guesses
+					last[j+1][l+1] = m
+				}
+			}
+		}
+	}
+
+	// more parts are more combinations to try: l! orders of them
+	cost, parts := inf, 0
+	for l := 1; l <= n; l++ {
+		if c := best[n][l] + logFactorial(l); c < cost {
+			cost, parts = c, l
+		}
+	}
+
+	var weakest *match
+	for j, l := n, parts; j > 0; l-- {
+		m := last[j][l]
+		if m.feedback != "" && (weakest == nil || m.j-m.i > weakest.j-weakest.i) {
+			weakest = m
+		}
+		j = m.i
+	}
+
+	return cost, weakest
+}
+
+func logFactorial(n int) float64 {
+	lgamma, _ := math.Lgamma(float64(n + 1))
+	return lgamma / math.Ln10
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+
+	return string(r)
+}
@@ -0,0 +1,75 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		inputs   []string
+		// min and max score
+		min, max int
+		feedback string
+	}{
+		{"password", nil, 0, 0, "common password"},
+		{"Password1", nil, 0, 0, "common password"},
+		{"PASSWORD", nil, 0, 0, "common password"},
+		{"P@ssw0rd", nil, 0, 0, "substitutions"},
+		{"drowssap", nil, 0, 0, "reversed"},
+		{"qwertyuiop", nil, 0, 0, ""},
+		{"sdfghjkl", nil, 0, 1, "keyboard"},
+		{"abcdefghij", nil, 0, 0, "sequences"},
+		{"9876543210", nil, 0, 0, ""},
+		{"aaaaaaaaaaaa", nil, 0, 0, "repeats"},
+		{"abcabcabcabc", nil, 0, 0, "repeats"},
+		{"passwordpassword", nil, 0, 0, ""},
+		{"19871987", nil, 0, 0, ""},
+		{"dragon2000", nil, 0, 1, ""},
+		{"janedoeexample", []string{"jane.doe@example.com"}, 0, 0, "what you told pinub"},
+		{"jane.doe1984", []string{"jane.doe@example.com"}, 0, 1, ""},
+		{"jane.doe1984", nil, 2, 4, ""},
+		{"correct horse battery staple", nil, 4, 4, ""},
+		{"purple elephants juggle tangerines", nil, 4, 4, ""},
+		{"Tr0ub4dour&3", nil, 3, 4, ""},
+		{"x7#Kq9!mZ2", nil, 3, 4, ""},
+		{"", nil, 0, 0, ""},
+	}
+	for _, tt := range tests {
+		score, feedback := Strength(tt.password, tt.inputs...)
+		if score < tt.min || score > tt.max {
+			t.Errorf("Strength(%q, %q) = %d, want %d to %d", tt.password, tt.inputs, score, tt.min, tt.max)
+		}
+		if !strings.Contains(feedback, tt.feedback) {
+			t.Errorf("Strength(%q) feedback %q, want %q", tt.password, feedback, tt.feedback)
+		}
+	}
+}
+
+// Strength stays quick for long passwords, only the start of them counts.
+func TestStrengthLong(t *testing.T) {
+	long := strings.Repeat("x7#Kq9!mZ2", 1000)
+	if score, _ := Strength(long); score != 4 {
+		t.Errorf("Strength of long password = %d, want 4", score)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	tests := []struct {
+		password string
+		inputs   []string
+		err      string
+	}{
+		{"short", nil, "too short"},
+		{"Password1", nil, "too easy to guess"},
+		{"janedoeexample", []string{"jane.doe@example.com"}, "too easy to guess"},
+		{"correct horse battery staple", nil, ""},
+	}
+	for _, tt := range tests {
+		err := DefaultPolicy.Check(tt.password, tt.inputs...)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("Check(%q) = %v, want %q", tt.password, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// secret is the SHA-1 key of RFC 6238 Appendix B, "12345678901234567890",
+// base32 encoded.
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The test vectors of RFC 6238 Appendix B have eight digits, the codes of
+// six digits are their last six.
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	for _, tt := range tests {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil || code != tt.code {
+			t.Errorf("Code at %d = %q, %v, want %q", tt.unix, code, err, tt.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	for skew := int64(-3); skew <= 3; skew++ {
+		code, err := Code(secret, step+skew)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := Validate(secret, code, now)
+		if want := -1 <= skew && skew <= 1; ok != want {
+			t.Errorf("Validate(code of step %+d) = %v, want %v", skew, ok, want)
+		}
+		if ok && got != step+skew {
+			t.Errorf("Validate(code of step %+d) returned step %d, want %d", skew, got, step+skew)
+		}
+	}
+
+	tests := []struct {
+		code string
+		ok   bool
+	}{
+		{"050471", true},
+		{"050 471", true},
+		{"050472", false},
+		{"50471", false},
+		{"14050471", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if _, ok := Validate(secret, tt.code, now); ok != tt.ok {
+			t.Errorf("Validate(%q) = %v, want %v", tt.code, ok, tt.ok)
+		}
+	}
+}
+
+func TestSecret(t *testing.T) {
+	tests := []struct {
+		secret string
+		ok     bool
+	}{
+		{secret, true},
+		{"gezdgnbvgy3tqojqgezdgnbvgy3tqojq", true},
+		{"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJ1", false},
+		{"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====", false},
+	}
+	for _, tt := range tests {
+		code, err := Code(tt.secret, 37037037)
+		if (err == nil) != tt.ok || tt.ok && code != "050471" {
+			t.Errorf("Code(%q) = %q, %v", tt.secret, code, err)
+		}
+		if _, ok := Validate(tt.secret, "050471", time.Unix(1111111111, 0)); ok != tt.ok {
+			t.Errorf("Validate with secret %q = %v, want %v", tt.secret, ok, tt.ok)
+		}
+	}
+
+	generated, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(generated, 0); err != nil || len(generated) != 32 {
+		t.Errorf("GenerateSecret() = %q, does not decode: %v", generated, err)
+	}
+}
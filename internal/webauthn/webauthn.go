@@ -0,0 +1,285 @@
+// Package webauthn verifies the ceremonies that register passkeys and sign
+// in with them, as described in W3C Web Authentication Level 2, for a single
+// relying party. Attestation statements are not checked: pinub asks browsers
+// for no attestation and trusts any authenticator.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms of the public keys pinub accepts.
+const (
+	AlgES256 = -7
+	AlgRS256 = -257
+)
+
+// Algorithms lists the accepted algorithms in order of preference.
+var Algorithms = []int{AlgES256, AlgRS256}
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+var (
+	// ErrClonedAuthenticator is returned for a signature counter that did
+	// not increase, a sign that the private key was copied.
+	ErrClonedAuthenticator = errors.New("webauthn: signature counter did not increase")
+
+	errChallenge = errors.New("webauthn: challenge does not match")
+)
+
+// RelyingParty is the site passkeys are registered for.
+type RelyingParty struct {
+	// ID is the host name, like "pinub.example" or "localhost". Browsers
+	// refuse IP addresses.
+	ID string
+	// Origin is the scheme and host the pages are served from, like
+	// "https://pinub.example" or "http://localhost:8080".
+	Origin string
+}
+
+// Credential is a registered passkey.
+type Credential struct {
+	ID []byte
+	// PublicKey is PKIX, ASN.1 DER encoded.
+	PublicKey []byte
+	Algorithm int
+	SignCount uint32
+}
+
+// NewChallenge returns a random challenge, base64 URL encoded as browsers
+// return it in the client data.
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create
+// to the challenge and returns the new credential.
+func (rp RelyingParty) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	obj, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := obj.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object is not a map", errCBOR)
+	}
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("webauthn: attestation object without authenticator data")
+	}
+
+	data, err := rp.parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if data.credential == nil {
+		return nil, errors.New("webauthn: no attested credential data")
+	}
+	data.credential.SignCount = data.signCount
+
+	return data.credential, nil
+}
+
+// VerifyAssertion checks the response of navigator.credentials.get to the
+// challenge, made with the credential. requireUV demands that the
+// authenticator verified the user, with a PIN or biometrics. It returns the
+// new signature counter of the credential.
+func (rp RelyingParty) VerifyAssertion(challenge string, cred *Credential, clientDataJSON, authenticatorData, signature []byte, requireUV bool) (uint32, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	data, err := rp.parseAuthData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if requireUV && data.flags&flagUserVerified == 0 {
+		return 0, errors.New("webauthn: user not verified")
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authenticatorData...), clientDataHash[:]...)
+	if err := verifySignature(cred, signed, signature); err != nil {
+		return 0, err
+	}
+
+	// authenticators without a counter always send zero
+	if (data.signCount != 0 || cred.SignCount != 0) && data.signCount <= cred.SignCount {
+		return 0, ErrClonedAuthenticator
+	}
+
+	return data.signCount, nil
+}
+
+func (rp RelyingParty) verifyClientData(raw []byte, typ, challenge string) error {
+	var cd struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("webauthn: client data: %w", err)
+	}
+
+	if cd.Type != typ {
+		return fmt.Errorf("webauthn: client data of type %q, want %q", cd.Type, typ)
+	}
+	if len(challenge) == 0 || subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return errChallenge
+	}
+	if cd.Origin != rp.Origin || cd.CrossOrigin {
+		return fmt.Errorf("webauthn: origin %q, want %q", cd.Origin, rp.Origin)
+	}
+
+	return nil
+}
+
+type authData struct {
+	flags     byte
+	signCount uint32
+	// credential is set if the authenticator attested a new credential.
+	credential *Credential
+}
+
+// parseAuthData reads the authenticator data and checks that it was made
+// for the relying party with the user present.
+func (rp RelyingParty) parseAuthData(raw []byte) (*authData, error) {
+	// rpIdHash (32) | flags (1) | signCount (4)
+	if len(raw) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, errors.New("webauthn: credential belongs to another relying party")
+	}
+
+	data := &authData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if data.flags&flagUserPresent == 0 {
+		return nil, errors.New("webauthn: user not present")
+	}
+	if data.flags&flagAttested == 0 {
+		return data, nil
+	}
+
+	// aaguid (16) | credentialIdLength (2) | credentialId | credentialPublicKey
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("webauthn: attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n > 1023 || n > len(rest) {
+		return nil, errors.New("webauthn: credential ID too long")
+	}
+	id := append([]byte(nil), rest[:n]...)
+
+	key, _, err := decodeCBOR(rest[n:])
+	if err != nil {
+		return nil, err
+	}
+	cose, ok := key.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: public key is not a map", errCBOR)
+	}
+	alg, publicKey, err := parseCOSEKey(cose)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	data.credential = &Credential{ID: id, PublicKey: der, Algorithm: alg}
+
+	return data, nil
+}
+
+// parseCOSEKey returns the algorithm and public key of a COSE_Key (RFC 9052).
+func parseCOSEKey(m map[any]any) (int, crypto.PublicKey, error) {
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("webauthn: ES256 key not on P-256")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return 0, nil, fmt.Errorf("webauthn: %w", err)
+		}
+		return AlgES256, key, nil
+
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("webauthn: RSA key too short")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return AlgRS256, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	}
+
+	return 0, nil, fmt.Errorf("webauthn: unsupported key type %d with algorithm %d", kty, alg)
+}
+
+func verifySignature(cred *Credential, signed, signature []byte) error {
+	key, err := x509.ParsePKIXPublicKey(cred.PublicKey)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(signed)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if cred.Algorithm == AlgES256 && ecdsa.VerifyASN1(key, hash[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if cred.Algorithm == AlgRS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil {
+			return nil
+		}
+	}
+
+	return errors.New("webauthn: signature not valid")
+}
@@ -0,0 +1,475 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+// The ceremonies in the tests are made by an authenticator with the fixed
+// keys in testdata, for pinub on localhost.
+var (
+	rp = RelyingParty{ID: "localhost", Origin: "http://localhost:8080"}
+
+	challenge = "dGVzdCBjaGFsbGVuZ2UgZm9yIHBpbnViIHBhc3NrZXlz"
+)
+
+type authenticator struct {
+	alg    int
+	key    crypto.Signer
+	credID []byte
+}
+
+func loadAuthenticator(t *testing.T, alg int, file string) *authenticator {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%s: no PEM data", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &authenticator{alg: alg, key: key.(crypto.Signer), credID: []byte(file)}
+}
+
+func authenticators(t *testing.T) []*authenticator {
+	return []*authenticator{
+		loadAuthenticator(t, AlgES256, "testdata/es256.pem"),
+		loadAuthenticator(t, AlgRS256, "testdata/rs256.pem"),
+	}
+}
+
+// ceremony describes what the authenticator and browser put into their
+// answer. The zero value is a valid ceremony.
+type ceremony struct {
+	typ         string
+	challenge   string
+	origin      string
+	crossOrigin bool
+	rpID        string
+	flags       byte
+	signCount   uint32
+}
+
+func (c ceremony) withDefaults(typ string) ceremony {
+	if c.typ == "" {
+		c.typ = typ
+	}
+	if c.challenge == "" {
+		c.challenge = challenge
+	}
+	if c.origin == "" {
+		c.origin = rp.Origin
+	}
+	if c.rpID == "" {
+		c.rpID = rp.ID
+	}
+	if c.flags == 0 {
+		c.flags = flagUserPresent | flagUserVerified
+	}
+
+	return c
+}
+
+func (c ceremony) clientData() []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":        c.typ,
+		"challenge":   c.challenge,
+		"origin":      c.origin,
+		"crossOrigin": c.crossOrigin,
+	})
+
+	return data
+}
+
+func (c ceremony) authData(attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	data := append(rpIDHash[:], c.flags)
+	data = binary.BigEndian.AppendUint32(data, c.signCount)
+
+	return append(data, attested...)
+}
+
+// register answers navigator.credentials.create.
+func (a *authenticator) register(c ceremony) (clientData, attestationObject []byte) {
+	c = c.withDefaults("webauthn.create")
+	c.flags |= flagAttested
+
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credID)))
+	attested = append(attested, a.credID...)
+	attested = append(attested, a.coseKey()...)
+
+	attestationObject = encodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": c.authData(attested),
+	})
+
+	return c.clientData(), attestationObject
+}
+
+// assert answers navigator.credentials.get.
+func (a *authenticator) assert(c ceremony) (clientData, authData, signature []byte) {
+	c = c.withDefaults("webauthn.get")
+	clientData = c.clientData()
+	authData = c.authData(nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := a.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		panic(err)
+	}
+
+	return clientData, authData, signature
+}
+
+func (a *authenticator) coseKey() []byte {
+	switch key := a.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		point, _ := key.Bytes()
+		return encodeCBOR(map[any]any{
+			int64(1): int64(2), int64(3): int64(AlgES256),
+			int64(-1): int64(1), int64(-2): point[1:33], int64(-3): point[33:],
+		})
+	case *rsa.PublicKey:
+		return encodeCBOR(map[any]any{
+			int64(1): int64(3), int64(3): int64(AlgRS256),
+			int64(-1): key.N.Bytes(), int64(-2): []byte{1, 0, 1},
+		})
+	}
+	panic("unsupported key")
+}
+
+func (a *authenticator) credential(t *testing.T, signCount uint32) *Credential {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(a.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Credential{ID: a.credID, PublicKey: der, Algorithm: a.alg, SignCount: signCount}
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	tests := []struct {
+		name string
+		c    ceremony
+		ok   bool
+	}{
+		{"valid", ceremony{}, true},
+		{"valid without user verification", ceremony{flags: flagUserPresent}, true},
+		{"wrong challenge", ceremony{challenge: "b3RoZXIgY2hhbGxlbmdl"}, false},
+		{"wrong type", ceremony{typ: "webauthn.get"}, false},
+		{"wrong origin", ceremony{origin: "http://localhost:8081"}, false},
+		{"cross origin", ceremony{crossOrigin: true}, false},
+		{"wrong rpIdHash", ceremony{rpID: "pinub.example"}, false},
+		{"user not present", ceremony{flags: flagUserVerified}, false},
+	}
+
+	for _, a := range authenticators(t) {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%d/%s", a.alg, tt.name), func(t *testing.T) {
+				clientData, attestationObject := a.register(tt.c)
+				cred, err := rp.VerifyRegistration(challenge, clientData, attestationObject)
+				if !tt.ok {
+					if err == nil {
+						t.Fatal("VerifyRegistration succeeded, want error")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("VerifyRegistration: %v", err)
+				}
+
+				want := a.credential(t, 0)
+				if !bytes.Equal(cred.ID, want.ID) || !bytes.Equal(cred.PublicKey, want.PublicKey) ||
+					cred.Algorithm != want.Algorithm || cred.SignCount != 0 {
+					t.Errorf("VerifyRegistration = %+v, want %+v", cred, want)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyRegistrationEmptyChallenge(t *testing.T) {
+	a := authenticators(t)[0]
+	clientData, attestationObject := a.register(ceremony{challenge: "-"})
+	clientData = bytes.Replace(clientData, []byte(`"challenge":"-"`), []byte(`"challenge":""`), 1)
+
+	if _, err := rp.VerifyRegistration("", clientData, attestationObject); !errors.Is(err, errChallenge) {
+		t.Errorf("VerifyRegistration without challenge = %v, want %v", err, errChallenge)
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	tests := []struct {
+		name      string
+		c         ceremony
+		stored    uint32
+		requireUV bool
+		want      uint32
+		err       error // nil for any error if ok is false
+		ok        bool
+	}{
+		{name: "valid", c: ceremony{signCount: 8}, stored: 7, requireUV: true, want: 8, ok: true},
+		{name: "without counter", c: ceremony{signCount: 0}, stored: 0, requireUV: true, want: 0, ok: true},
+		{name: "user verification not required", c: ceremony{flags: flagUserPresent, signCount: 1}, want: 1, ok: true},
+		{name: "user not verified", c: ceremony{flags: flagUserPresent, signCount: 1}, requireUV: true},
+		{name: "user not present", c: ceremony{flags: flagUserVerified, signCount: 1}},
+		{name: "wrong challenge", c: ceremony{challenge: "b3RoZXIgY2hhbGxlbmdl", signCount: 1}, err: errChallenge},
+		{name: "wrong type", c: ceremony{typ: "webauthn.create", signCount: 1}},
+		{name: "wrong origin", c: ceremony{origin: "https://localhost:8080", signCount: 1}},
+		{name: "wrong rpIdHash", c: ceremony{rpID: "example.com", signCount: 1}},
+		{name: "counter going backwards", c: ceremony{signCount: 6}, stored: 7, err: ErrClonedAuthenticator},
+		{name: "counter not increasing", c: ceremony{signCount: 7}, stored: 7, err: ErrClonedAuthenticator},
+		{name: "counter reset to zero", c: ceremony{signCount: 0}, stored: 7, err: ErrClonedAuthenticator},
+	}
+
+	for _, a := range authenticators(t) {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%d/%s", a.alg, tt.name), func(t *testing.T) {
+				clientData, authData, signature := a.assert(tt.c)
+				got, err := rp.VerifyAssertion(challenge, a.credential(t, tt.stored), clientData, authData, signature, tt.requireUV)
+				if !tt.ok {
+					if err == nil {
+						t.Fatal("VerifyAssertion succeeded, want error")
+					}
+					if tt.err != nil && !errors.Is(err, tt.err) {
+						t.Fatalf("VerifyAssertion = %v, want %v", err, tt.err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("VerifyAssertion: %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("VerifyAssertion = %d, want sign count %d", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyAssertionBadSignature(t *testing.T) {
+	as := authenticators(t)
+	for i, a := range as {
+		other := as[(i+1)%len(as)]
+		c := ceremony{signCount: 1}
+
+		clientData, authData, signature := a.assert(c)
+		bad := append([]byte(nil), signature...)
+		bad[len(bad)-1] ^= 1
+		if _, err := rp.VerifyAssertion(challenge, a.credential(t, 0), clientData, authData, bad, true); err == nil {
+			t.Errorf("%d: altered signature accepted", a.alg)
+		}
+
+		// signed authenticator data and client data cannot be swapped
+		_, otherAuthData, _ := a.assert(ceremony{signCount: 2})
+		if _, err := rp.VerifyAssertion(challenge, a.credential(t, 0), clientData, otherAuthData, signature, true); err == nil {
+			t.Errorf("%d: signature over other authenticator data accepted", a.alg)
+		}
+
+		// the signature of another key, or of the same key under the other
+		// algorithm, does not do
+		_, _, otherSignature := other.assert(c)
+		if _, err := rp.VerifyAssertion(challenge, a.credential(t, 0), clientData, authData, otherSignature, true); err == nil {
+			t.Errorf("%d: signature of another key accepted", a.alg)
+		}
+		cred := a.credential(t, 0)
+		cred.Algorithm = other.alg
+		if _, err := rp.VerifyAssertion(challenge, cred, clientData, authData, signature, true); err == nil {
+			t.Errorf("%d: signature accepted for the wrong algorithm", a.alg)
+		}
+	}
+}
+
+// Every prefix of a valid ceremony is rejected without a panic.
+func TestTruncated(t *testing.T) {
+	for _, a := range authenticators(t) {
+		clientData, attestationObject := a.register(ceremony{})
+		for n := range len(attestationObject) {
+			if _, err := rp.VerifyRegistration(challenge, clientData, attestationObject[:n]); err == nil {
+				t.Errorf("%d: attestation object truncated to %d bytes accepted", a.alg, n)
+			}
+		}
+
+		clientData, authData, signature := a.assert(ceremony{signCount: 1})
+		for n := range len(authData) {
+			if _, err := rp.VerifyAssertion(challenge, a.credential(t, 0), clientData, authData[:n], signature, true); err == nil {
+				t.Errorf("%d: authenticator data truncated to %d bytes accepted", a.alg, n)
+			}
+		}
+		for n := range len(clientData) {
+			if _, err := rp.VerifyAssertion(challenge, a.credential(t, 0), clientData[:n], authData, signature, true); err == nil {
+				t.Errorf("%d: client data truncated to %d bytes accepted", a.alg, n)
+			}
+		}
+	}
+}
+
+func TestVerifyRegistrationMalformed(t *testing.T) {
+	a := authenticators(t)[0]
+	clientData, _ := a.register(ceremony{})
+	authData := func(attested []byte) []byte {
+		return ceremony{}.withDefaults("").authData(attested)
+	}
+	attested := func(idLen uint16, id, key []byte) []byte {
+		data := binary.BigEndian.AppendUint16(make([]byte, 16), idLen)
+		return append(append(data, id...), key...)
+	}
+	withFlags := func(data []byte) []byte {
+		data[32] |= flagAttested
+		return data
+	}
+	p256 := a.coseKey()
+
+	tests := []struct {
+		name string
+		obj  []byte
+	}{
+		{"empty", nil},
+		{"not a map", encodeCBOR([]any{"authData"})},
+		{"no authData", encodeCBOR(map[any]any{"fmt": "none"})},
+		{"authData not bytes", encodeCBOR(map[any]any{"authData": "text"})},
+		{"not attested", encodeCBOR(map[any]any{"authData": authData(nil)})},
+		{"no credential data", encodeCBOR(map[any]any{"authData": withFlags(authData(nil))})},
+		{"credential ID longer than data", encodeCBOR(map[any]any{"authData": withFlags(authData(attested(500, []byte("id"), nil)))})},
+		{"credential ID too long", encodeCBOR(map[any]any{"authData": withFlags(authData(attested(1024, make([]byte, 1024), p256)))})},
+		{"no public key", encodeCBOR(map[any]any{"authData": withFlags(authData(attested(2, []byte("id"), nil)))})},
+		{"public key not a map", encodeCBOR(map[any]any{"authData": withFlags(authData(attested(2, []byte("id"), encodeCBOR(int64(1)))))})},
+		{"unsupported algorithm", encodeCBOR(map[any]any{"authData": withFlags(authData(attested(2, []byte("id"),
+			encodeCBOR(map[any]any{int64(1): int64(1), int64(3): int64(-8), int64(-1): int64(6), int64(-2): make([]byte, 32)}))))})},
+		{"point not on curve", encodeCBOR(map[any]any{"authData": withFlags(authData(attested(2, []byte("id"),
+			encodeCBOR(map[any]any{int64(1): int64(2), int64(3): int64(AlgES256), int64(-1): int64(1),
+				int64(-2): bytes.Repeat([]byte{1}, 32), int64(-3): bytes.Repeat([]byte{2}, 32)}))))})},
+		{"short RSA key", encodeCBOR(map[any]any{"authData": withFlags(authData(attested(2, []byte("id"),
+			encodeCBOR(map[any]any{int64(1): int64(3), int64(3): int64(AlgRS256), int64(-1): make([]byte, 128), int64(-2): []byte{1, 0, 1}}))))})},
+	}
+	for _, tt := range tests {
+		if _, err := rp.VerifyRegistration(challenge, clientData, tt.obj); err == nil {
+			t.Errorf("%s: VerifyRegistration succeeded, want error", tt.name)
+		}
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	valid := []struct {
+		in   []byte
+		want any
+	}{
+		{[]byte{0x00}, int64(0)},
+		{[]byte{0x18, 0x64}, int64(100)},
+		{[]byte{0x39, 0x01, 0x00}, int64(-257)},
+		{[]byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0x62, 'h', 'i'}, "hi"},
+		{[]byte{0xf5}, true},
+		{[]byte{0xf6}, nil},
+	}
+	for _, tt := range valid {
+		got, rest, err := decodeCBOR(tt.in)
+		if err != nil || len(rest) != 0 || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("decodeCBOR(%x) = %v, %x, %v, want %v", tt.in, got, rest, err, tt.want)
+		}
+	}
+
+	malformed := map[string][]byte{
+		"empty":                 {},
+		"truncated argument":    {0x19, 0x01},
+		"byte string too long":  {0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"array too long":        {0x9b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"map too long":          {0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"integer overflow":      {0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"negative overflow":     {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"indefinite length":     {0x5f, 0x41, 0x00, 0xff},
+		"reserved info":         {0x1c},
+		"tag":                   {0xc0, 0x00},
+		"float":                 {0xfa, 0, 0, 0, 0},
+		"array as map key":      {0xa1, 0x80, 0x00},
+		"map without value":     {0xa1, 0x01},
+		"array missing an item": {0x82, 0x01},
+		"nested too deep":       append(bytes.Repeat([]byte{0x81}, maxCBORDepth+1), 0x00),
+	}
+	for name, in := range malformed {
+		if got, _, err := decodeCBOR(in); err == nil {
+			t.Errorf("%s: decodeCBOR(%x) = %v, want error", name, in, got)
+		}
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add([]byte{0xa1, 0x61, 'a', 0x81, 0x00})
+	f.Add(encodeCBOR(map[any]any{"authData": []byte{1, 2, 3}, int64(-1): "x"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeCBOR(data)
+	})
+}
+
+// encodeCBOR encodes the types decodeCBOR returns. Map keys are sorted, so
+// the encoding of a value is always the same.
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		case n < 1<<32:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []any:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case map[any]any:
+		var pairs [][2][]byte
+		for key, val := range v {
+			pairs = append(pairs, [2][]byte{encodeCBOR(key), encodeCBOR(val)})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i][0], pairs[j][0]) < 0 })
+		out := head(5, uint64(len(v)))
+		for _, p := range pairs {
+			out = append(append(out, p[0]...), p[1]...)
+		}
+		return out
+	}
+	panic(fmt.Sprintf("cannot encode %T", v))
+}
@@ -0,0 +1,148 @@
+package pinub
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Who may register an account.
+const (
+	RegistrationOpen   = "open"   // everybody
+	RegistrationInvite = "invite" // everybody with an invite code
+	RegistrationClosed = "closed" // nobody
+)
+
+const (
+	// userInviteTTL is how long the invites of users work.
+	userInviteTTL = 7 * 24 * time.Hour
+	// userInviteLimit is how many working invites a user may have at once.
+	userInviteLimit = 5
+)
+
+// registration returns who may register, RegistrationOpen if unset.
+func (a *App) registration() string {
+	if a.Registration == "" {
+		return RegistrationOpen
+	}
+
+	return a.Registration
+}
+
+// usersInvite reports whether users other than admins may create invites.
+func (a *App) usersInvite() bool {
+	return a.UserInvites && a.registration() == RegistrationInvite
+}
+
+// userInvites lets users create and delete their invites, if UserInvites
+// allows it.
+func (a *App) userInvites() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+		if !a.usersInvite() {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.FormValue("action") {
+		case "create":
+			n, err := a.db.UsableInvites(r.Context(), user.ID)
+			if err != nil {
+				http.Error(w, "cannot get invites from database", http.StatusBadRequest)
+				return
+			}
+			if n >= userInviteLimit {
+				a.flash(w, "you have "+strconv.Itoa(n)+" unused invites already")
+				break
+			}
+
+			invite := &Invite{CreatedBy: user.ID, MaxUses: 1}
+			if err := a.db.CreateInvite(r.Context(), invite, userInviteTTL); err != nil {
+				http.Error(w, "cannot create invite", http.StatusBadRequest)
+				return
+			}
+			a.flash(w, "invite created, send the link to whom you want to invite")
+
+		case "delete":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			if err := a.db.DeleteInvite(r.Context(), user.ID, id); err != nil {
+				http.Error(w, "cannot delete invite", http.StatusBadRequest)
+				return
+			}
+			a.flash(w, "invite deleted")
+
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	}
+}
+
+// adminInvites lists all invites and lets admins create invites for any
+// number of accounts and delete any invite.
+func (a *App) adminInvites() http.HandlerFunc {
+	tpl, _ := template.New("admin_invites.html").Funcs(funcs).ParseFS(tpls, "templates/admin_invites.html", layoutTpl)
+
+	type invitesData struct {
+		Registration string
+		Invites      []Invite
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := r.Context().Value(userContextKey).(*User)
+
+		if r.Method == http.MethodGet {
+			invites, err := a.db.Invites(r.Context(), 0)
+			if err != nil {
+				http.Error(w, "cannot get invites from database", http.StatusBadRequest)
+				return
+			}
+
+			render(w, r, tpl, invitesData{a.registration(), invites})
+			return
+		}
+
+		switch action := r.FormValue("action"); action {
+		case "create":
+			uses, err := strconv.Atoi(r.FormValue("uses"))
+			if err != nil || uses < 0 {
+				a.flash(w, "number of uses not valid")
+				break
+			}
+			days, err := strconv.Atoi(r.FormValue("days"))
+			if err != nil || days < 0 {
+				a.flash(w, "number of days not valid")
+				break
+			}
+
+			invite := &Invite{CreatedBy: actor.ID, MaxUses: uses}
+			if err := a.db.CreateInvite(r.Context(), invite, time.Duration(days)*24*time.Hour); err != nil {
+				slog.Error("cannot create invite", err)
+				http.Error(w, "cannot create invite", http.StatusBadRequest)
+				return
+			}
+			a.audit(r, actor, nil, "admin.create-invite", strconv.Itoa(invite.ID))
+			a.flash(w, "invite created")
+
+		case "delete":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			if err := a.db.DeleteInvite(r.Context(), 0, id); err != nil {
+				http.Error(w, "cannot delete invite", http.StatusBadRequest)
+				return
+			}
+			a.audit(r, actor, nil, "admin.delete-invite", strconv.Itoa(id))
+			a.flash(w, "invite deleted")
+
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, r, "/admin/invites", http.StatusSeeOther)
+	}
+}
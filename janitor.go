@@ -0,0 +1,87 @@
+package pinub
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// janitorInterval is how often the janitor cleans up the database.
+const janitorInterval = time.Hour
+
+// janitor removes stale rows from the database every interval until ctx is
+// done.
+func (a *App) janitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		a.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *App) cleanup(ctx context.Context) {
+	if n, err := a.db.DeleteExpiredLogins(ctx); err != nil {
+		slog.Error("cannot delete expired logins", err)
+	} else if n > 0 {
+		slog.Info("deleted expired logins", "count", n)
+	}
+
+	if n, err := a.db.DeleteExpiredPasswordResets(ctx); err != nil {
+		slog.Error("cannot delete expired password resets", err)
+	} else if n > 0 {
+		slog.Info("deleted expired password resets", "count", n)
+	}
+	if n, err := a.db.DeleteExpiredEmailVerifications(ctx); err != nil {
+		slog.Error("cannot delete expired email verifications", err)
+	} else if n > 0 {
+		slog.Info("deleted expired email verifications", "count", n)
+	}
+	if n, err := a.db.DeleteExpiredEmailReverts(ctx); err != nil {
+		slog.Error("cannot delete expired email reverts", err)
+	} else if n > 0 {
+		slog.Info("deleted expired email reverts", "count", n)
+	}
+
+	if n, err := a.db.DeleteExpiredMagicLinks(ctx); err != nil {
+		slog.Error("cannot delete expired magic links", err)
+	} else if n > 0 {
+		slog.Info("deleted expired magic links", "count", n)
+	}
+
+	if n, err := a.db.DeleteExpiredConfirmations(ctx); err != nil {
+		slog.Error("cannot delete expired confirmations", err)
+	} else if n > 0 {
+		slog.Info("deleted expired confirmations", "count", n)
+	}
+
+	if n, err := a.db.DeleteUsedInvites(ctx); err != nil {
+		slog.Error("cannot delete used invites", err)
+	} else if n > 0 {
+		slog.Info("deleted used invites", "count", n)
+	}
+
+	if n, err := a.db.DeleteScheduledUsers(ctx); err != nil {
+		slog.Error("cannot delete scheduled users", err)
+	} else if n > 0 {
+		slog.Info("deleted users", "count", n)
+	}
+	if a.AuditRetention > 0 {
+		if n, err := a.db.DeleteAuditEvents(ctx, a.AuditRetention); err != nil {
+			slog.Error("cannot delete old audit events", err)
+		} else if n > 0 {
+			slog.Info("deleted old audit events", "count", n)
+		}
+	}
+	a.codeAttempts.Prune()
+	a.magicLinkSends.Prune()
+	a.ipFailures.Prune(ctx)
+	a.emailFailures.Prune(ctx)
+}
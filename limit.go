@@ -0,0 +1,273 @@
+package pinub
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// limiter refuses attempts for a key, like a user ID, once max attempts were
+// counted within window. Callers decide what counts, like wrong codes or sent
+// emails. Attempts older than window are forgotten.
+type limiter struct {
+	max    int
+	window time.Duration
+
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+}
+
+func newLimiter(max int, window time.Duration) *limiter {
+	return &limiter{max: max, window: window, attempts: map[string][]time.Time{}}
+}
+
+// Allow reports whether another attempt for key may be made.
+func (l *limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.recent(key, time.Now())) < l.max
+}
+
+// Add counts an attempt for key.
+func (l *limiter) Add(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.attempts[key] = append(l.recent(key, now), now)
+}
+
+// Reset forgets the attempts of key, like after a successful one.
+func (l *limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key)
+}
+
+// Prune forgets all attempts older than window.
+func (l *limiter) Prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key := range l.attempts {
+		l.recent(key, now)
+	}
+}
+
+// recent drops the attempts of key older than window and returns the rest.
+// l.mu must be held.
+func (l *limiter) recent(key string, now time.Time) []time.Time {
+	attempts := l.attempts[key]
+	for len(attempts) > 0 && now.Sub(attempts[0]) >= l.window {
+		attempts = attempts[1:]
+	}
+	if len(attempts) == 0 {
+		delete(l.attempts, key)
+		return nil
+	}
+	l.attempts[key] = attempts
+
+	return attempts
+}
+
+// backoff slows down repeated failures for a key, like wrong passwords for
+// an email address. The first free failures are not punished; every further
+// one blocks the key twice as long as the one before, up to max. Failures
+// are forgotten a day after the last one. With persist set, the failures
+// are kept in the database as well, so they survive restarts. There, keys
+// start with prefix to tell the backoffs apart.
+//
+// Keys are stored as hashes, so submitted input takes a fixed amount of
+// memory and stays out of the database, and at most backoffMaxKeys are
+// kept; the keys that failed longest ago are forgotten first.
+type backoff struct {
+	prefix  string
+	free    int
+	base    time.Duration
+	max     time.Duration
+	persist *UserService
+
+	mu    sync.Mutex
+	state map[string]*list.Element // of *backoffState, by hashed key
+	// lru holds the states with the most recently used first.
+	lru *list.List
+}
+
+type backoffState struct {
+	LoginFailure
+	hash string
+	// running counts the attempts begun and not ended yet.
+	running int
+}
+
+const (
+	// backoffForget is how long after the last failure a key starts over.
+	backoffForget = 24 * time.Hour
+	// backoffMaxKeys is how many keys a backoff keeps at most.
+	backoffMaxKeys = 100_000
+)
+
+func newBackoff(prefix string, free int, base, max time.Duration, persist *UserService) *backoff {
+	return &backoff{
+		prefix:  prefix,
+		free:    free,
+		base:    base,
+		max:     max,
+		persist: persist,
+		state:   map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Load reads the failures kept in the database.
+func (b *backoff) Load(ctx context.Context) error {
+	if b.persist == nil {
+		return nil
+	}
+
+	failures, err := b.persist.LoginFailures(ctx, b.prefix, time.Now().Add(-backoffForget))
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range failures {
+		s := b.get(strings.TrimPrefix(f.Key, b.prefix), f.FailedAt)
+		s.LoginFailure = f
+	}
+
+	return nil
+}
+
+// Begin starts an attempt for key and returns zero if it may go ahead, or
+// else how long key is blocked for. Begun attempts have to be ended with
+// End. Until then they count as failures, so attempts made at the same
+// time cannot get past the limit: once the free failures are used up,
+// only one attempt runs at a time.
+func (b *backoff) Begin(key string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	s := b.get(hashToken(key), now)
+	if wait := s.BlockedUntil.Sub(now); wait > 0 {
+		return wait
+	}
+	if s.running > 0 && s.Failures+s.running >= b.free {
+		return b.base
+	}
+	s.running++
+
+	return 0
+}
+
+// End ends an attempt for key begun with Begin. A failed attempt counts
+// and blocks key if it failed too often.
+func (b *backoff) End(ctx context.Context, key string, failed bool) {
+	b.mu.Lock()
+	now := time.Now()
+	s := b.get(hashToken(key), now)
+	if s.running > 0 {
+		s.running--
+	}
+	if !failed {
+		if s.Failures == 0 && s.running == 0 {
+			b.remove(s.hash)
+		}
+		b.mu.Unlock()
+		return
+	}
+
+	s.Failures++
+	s.FailedAt = now
+	s.BlockedUntil = now
+	if n := s.Failures - b.free - 1; n >= 0 {
+		delay := b.max
+		if n < 32 && b.base<<n < b.max {
+			delay = b.base << n
+		}
+		s.BlockedUntil = now.Add(delay)
+	}
+	saved := s.LoginFailure
+	b.mu.Unlock()
+
+	if b.persist != nil {
+		if err := b.persist.SaveLoginFailure(ctx, &saved); err != nil {
+			slog.Error("cannot save login failure", err)
+		}
+	}
+}
+
+// Reset forgets the failures of key.
+func (b *backoff) Reset(ctx context.Context, key string) {
+	hash := hashToken(key)
+
+	b.mu.Lock()
+	_, ok := b.state[hash]
+	b.remove(hash)
+	b.mu.Unlock()
+
+	if ok && b.persist != nil {
+		if err := b.persist.DeleteLoginFailure(ctx, b.prefix+hash); err != nil {
+			slog.Error("cannot delete login failure", err)
+		}
+	}
+}
+
+// Prune forgets keys whose last failure is too long ago.
+func (b *backoff) Prune(ctx context.Context) {
+	before := time.Now().Add(-backoffForget)
+
+	b.mu.Lock()
+	for hash, e := range b.state {
+		if s := e.Value.(*backoffState); s.running == 0 && s.FailedAt.Before(before) {
+			b.remove(hash)
+		}
+	}
+	b.mu.Unlock()
+
+	if b.persist != nil {
+		if _, err := b.persist.DeleteLoginFailures(ctx, b.prefix, before); err != nil {
+			slog.Error("cannot delete old login failures", err)
+		}
+	}
+}
+
+// get returns the state of the hashed key, marked as used most recently.
+// Keys whose last failure is too long ago start over. A key not known yet
+// is added, and the least recently used key goes if there are too many.
+// b.mu must be held.
+func (b *backoff) get(hash string, now time.Time) *backoffState {
+	if e, ok := b.state[hash]; ok {
+		b.lru.MoveToFront(e)
+		s := e.Value.(*backoffState)
+		if s.Failures > 0 && now.Sub(s.FailedAt) > backoffForget {
+			s.LoginFailure = LoginFailure{Key: b.prefix + hash}
+		}
+		return s
+	}
+
+	s := &backoffState{LoginFailure: LoginFailure{Key: b.prefix + hash}, hash: hash}
+	b.state[hash] = b.lru.PushFront(s)
+	if b.lru.Len() > backoffMaxKeys {
+		b.remove(b.lru.Back().Value.(*backoffState).hash)
+	}
+
+	return s
+}
+
+// remove forgets the hashed key. b.mu must be held.
+func (b *backoff) remove(hash string) {
+	if e, ok := b.state[hash]; ok {
+		b.lru.Remove(e)
+		delete(b.state, hash)
+	}
+}
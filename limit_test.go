@@ -0,0 +1,75 @@
+package pinub
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBackoffParallel(t *testing.T) {
+	ctx := context.Background()
+	b := newBackoff("test:", 2, time.Minute, time.Hour, nil)
+
+	// attempts running at the same time use up the free failures
+	if b.Begin("a") != 0 || b.Begin("a") != 0 {
+		t.Fatal("free attempts refused")
+	}
+	if b.Begin("a") == 0 {
+		t.Fatal("more parallel attempts than free failures allowed")
+	}
+	b.End(ctx, "a", true)
+	b.End(ctx, "a", true)
+
+	// past the free failures, one attempt runs at a time
+	if b.Begin("a") != 0 {
+		t.Fatal("attempt after free failures refused")
+	}
+	if b.Begin("a") == 0 {
+		t.Fatal("parallel attempt after free failures allowed")
+	}
+	b.End(ctx, "a", true)
+
+	if wait := b.Begin("a"); wait <= 0 || wait > time.Minute {
+		t.Fatalf("Begin after too many failures = %v, want up to a minute", wait)
+	}
+	if b.Begin("b") != 0 {
+		t.Fatal("other key blocked")
+	}
+	b.End(ctx, "b", false)
+
+	b.Reset(ctx, "a")
+	if b.Begin("a") != 0 {
+		t.Fatal("key blocked after Reset")
+	}
+}
+
+func TestBackoffBounded(t *testing.T) {
+	ctx := context.Background()
+	b := newBackoff("test:", 0, time.Minute, time.Hour, nil)
+
+	b.Begin("first")
+	b.End(ctx, "first", true)
+	for i := 0; i < backoffMaxKeys; i++ {
+		key := strconv.Itoa(i)
+		b.Begin(key)
+		b.End(ctx, key, true)
+	}
+	if n := len(b.state); n != backoffMaxKeys {
+		t.Fatalf("backoff keeps %d keys, want %d", n, backoffMaxKeys)
+	}
+	if b.Begin("first") != 0 {
+		t.Error("least recently used key not forgotten")
+	}
+	if b.Begin(strconv.Itoa(backoffMaxKeys-1)) == 0 {
+		t.Error("recently used key forgotten")
+	}
+
+	// successful attempts leave nothing behind
+	b = newBackoff("test:", 0, time.Minute, time.Hour, nil)
+	b.Begin("ok")
+	b.End(ctx, "ok", false)
+	if n := len(b.state); n != 0 {
+		t.Errorf("backoff keeps %d keys after a success, want 0", n)
+	}
+}
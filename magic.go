@@ -0,0 +1,141 @@
+package pinub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"dab.io/pinub/internal/mailer"
+	"golang.org/x/exp/slog"
+)
+
+// magicLinkTTL is how long the link in a sign in email works.
+const magicLinkTTL = 15 * time.Minute
+
+// magicLink sends a link that signs in without a password to the email
+// address entered. The answer is the same whether or not an account with
+// the address exists.
+func (a *App) magicLink() http.HandlerFunc {
+	tpl, _ := template.New("magic.html").Funcs(funcs).ParseFS(tpls, "templates/magic.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.MagicLinks {
+			http.NotFound(w, r)
+			return
+		}
+
+		f := newForm(r)
+
+		// show form
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		addr, err := mail.ParseAddress(f.Value("email"))
+		if err != nil {
+			f.Fail("email", "email address is not valid")
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, f)
+			return
+		}
+
+		// limit the emails to an address, known or not, so pinub cannot be
+		// used to flood an inbox
+		key := strings.ToLower(addr.Address)
+		if !a.magicLinkSends.Allow(key) {
+			f.Fail("email", "too many links sent to this address, try again in a few minutes")
+			renderStatus(w, r, http.StatusTooManyRequests, tpl, f)
+			return
+		}
+		a.magicLinkSends.Add(key)
+
+		linkURL := a.absURL(r, "/signin/link")
+		a.background(func(ctx context.Context) {
+			if err := a.sendMagicLink(ctx, addr.Address, linkURL); err != nil {
+				slog.Error("cannot send magic link", err)
+			}
+		})
+
+		a.flash(w, "if an account exists for "+addr.Address+", a link to sign in is on its way")
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+	}
+}
+
+// sendMagicLink mails a link to linkURL with a new magic link token to the
+// account with the email address, if there is one.
+func (a *App) sendMagicLink(ctx context.Context, email, linkURL string) error {
+	user, err := a.db.ByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := a.db.CreateMagicLink(ctx, user, token, magicLinkTTL); err != nil {
+		return err
+	}
+
+	link := linkURL + "?token=" + url.QueryEscape(token)
+	return a.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Sign in to pinub",
+		Body: fmt.Sprintf("Open this link within the next %.0f minutes to sign in to pinub:\n\n%s\n\n"+
+			"The link works once. If you did not ask for it, ignore this email.\n",
+			magicLinkTTL.Minutes(), link),
+	})
+}
+
+// signinLink signs in with the token of a magic link. Mail scanners open
+// links to check them, so the link shows a button and only its POST uses
+// up the token.
+func (a *App) signinLink() http.HandlerFunc {
+	tpl, _ := template.New("magic_link.html").Funcs(funcs).ParseFS(tpls, "templates/magic_link.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.MagicLinks {
+			http.NotFound(w, r)
+			return
+		}
+
+		// keep the token out of the Referer header of links on the page
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		f := newForm(r)
+
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		user, err := a.db.ByMagicLink(r.Context(), f.Value("token"))
+		if err != nil {
+			a.flash(w, "the link to sign in is not valid anymore")
+			http.Redirect(w, r, "/signin/email", http.StatusSeeOther)
+			return
+		}
+
+		remember := len(f.Value("remember")) > 0
+		if user.TwoFactor() {
+			a.startSecondFactor(w, r, user, remember)
+			return
+		}
+		if err := a.startSession(w, r, user, remember, "magic link"); err != nil {
+			http.Error(w, "cannot create session", http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,99 @@
+package pinub
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// OpenDB opens the SQLite database at dsn. Foreign keys are enforced on
+// every connection, so deleting a user deletes what references them.
+func OpenDB(dsn string) (*sql.DB, error) {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+
+	return sql.Open("sqlite", dsn+sep+"_pragma=foreign_keys(1)")
+}
+
+// Migrate creates the schema of a new database or brings the schema of an
+// existing one up to date. Everything using the database runs it first.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, schemaSQL); err != nil {
+		return fmt.Errorf("cannot create schema: %w", err)
+	}
+	if err := migrate(ctx, db); err != nil {
+		return fmt.Errorf("cannot run migrations: %w", err)
+	}
+
+	return nil
+}
+
+// migrate brings the database schema up to date. schema.sql describes the
+// initial schema; every file in migrations/ changes it one step further. The
+// number of applied migrations is stored in SQLite's user_version pragma, so
+// each file runs exactly once and files must never be renamed or reordered.
+func migrate(ctx context.Context, db *sql.DB) error {
+	// Migrations recreate tables, and dropping a table with foreign keys on
+	// deletes the rows referencing it. SQLite ignores the pragma inside a
+	// transaction, so it is turned off for the connection around them.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF;"); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), "PRAGMA foreign_keys = ON;"); err != nil {
+			// never hand the connection to anyone else without foreign keys
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA user_version;").Scan(&version); err != nil {
+		return err
+	}
+
+	files, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for i := version; i < len(files); i++ {
+		stmts, err := migrations.ReadFile(files[i])
+		if err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, string(stmts)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", files[i], err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d;", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", files[i], err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("%s: %w", files[i], err)
+		}
+	}
+
+	return nil
+}
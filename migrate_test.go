@@ -0,0 +1,84 @@
+package pinub
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"testing"
+)
+
+// Migrations recreating the users table keep the rows referencing it.
+func TestMigrateForeignKeys(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "pinub.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, schemaSQL); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"INSERT INTO users (id, email, password) VALUES (1, 'old@example.com', 'x');",
+		"INSERT INTO links (id, url) VALUES (1, 'https://go.dev/');",
+		"INSERT INTO user_links (user_id, link_id) VALUES (1, 1);",
+	} {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_links;").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("pins after migrations: %d, %v", n, err)
+	}
+
+	// every connection enforces foreign keys again, so the pin goes with
+	// its user
+	db.SetMaxIdleConns(0)
+	if _, err := db.ExecContext(ctx, "DELETE FROM users WHERE id = 1;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_links;").Scan(&n); err != nil || n != 0 {
+		t.Errorf("pins after deleting their user: %d, %v", n, err)
+	}
+}
+
+// Commands like make-admin may be the first to open a database, so Migrate
+// creates the schema of a new one and runs again without changes.
+func TestMigrateNew(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "pinub.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for range 2 {
+		if err := Migrate(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := fs.Glob(migrations, "migrations/*.sql")
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version;").Scan(&version); err != nil || version != len(files) {
+		t.Errorf("user_version %d, %v, want %d", version, err, len(files))
+	}
+
+	us := &UserService{DB: db}
+	if err := us.CreateUser(ctx, &User{Email: "admin@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := us.ByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := us.SetAdmin(ctx, user, true); err != nil {
+		t.Error(err)
+	}
+}
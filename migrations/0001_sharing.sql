@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN "username" VARYING CHARACTER (32);
+ALTER TABLE users ADD COLUMN "visibility" VARYING CHARACTER (8) NOT NULL DEFAULT 'private';
+ALTER TABLE users ADD COLUMN "share_token" VARYING CHARACTER (43);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username ON users ("username");
+CREATE UNIQUE INDEX IF NOT EXISTS users_share_token ON users ("share_token");
+
+ALTER TABLE user_links ADD COLUMN "hidden" BOOLEAN NOT NULL DEFAULT FALSE;
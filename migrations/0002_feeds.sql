@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN "feed_token" VARYING CHARACTER (43);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_feed_token ON users ("feed_token");
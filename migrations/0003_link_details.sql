@@ -0,0 +1,2 @@
+ALTER TABLE user_links ADD COLUMN "title" VARYING CHARACTER (256) NOT NULL DEFAULT '';
+ALTER TABLE user_links ADD COLUMN "notes" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,14 @@
+-- Logins used to store the session token itself. SQLite cannot hash the
+-- existing tokens, so the table is recreated and everybody signs in again.
+DROP TABLE logins;
+
+CREATE TABLE logins (
+  "user_id" INTEGER NOT NULL,
+  -- hex encoded SHA-256 of the session token in the cookie
+  "token" VARYING CHARACTER (64) NOT NULL UNIQUE,
+  "user_agent" VARYING CHARACTER (256) NOT NULL DEFAULT '',
+  "ip" VARYING CHARACTER (45) NOT NULL DEFAULT '',
+  "active_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY ("user_id", "token")
+);
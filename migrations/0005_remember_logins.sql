@@ -0,0 +1 @@
+ALTER TABLE logins ADD COLUMN "remember" BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,15 @@
+ALTER TABLE users ADD COLUMN "verified_at" DATETIME;
+
+-- accounts from before addresses were confirmed keep working as they did
+UPDATE users SET verified_at = created_at;
+
+CREATE TABLE IF NOT EXISTS email_verifications (
+  -- hex encoded SHA-256 of the token in the link sent by email
+  "token" VARYING CHARACTER (64) PRIMARY KEY,
+  "user_id" INTEGER NOT NULL,
+  -- address to confirm, differs from users.email for a change of address
+  "email" VARYING CHARACTER (254) NOT NULL,
+  "expires_at" DATETIME NOT NULL,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY ("user_id") REFERENCES users ("id") ON DELETE CASCADE
+);
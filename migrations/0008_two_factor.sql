@@ -0,0 +1,12 @@
+-- base32 encoded TOTP secret, NULL while two-factor authentication is off
+ALTER TABLE users ADD COLUMN "totp_secret" VARYING CHARACTER (32);
+-- last TOTP step a code was accepted for, so no code works twice
+ALTER TABLE users ADD COLUMN "totp_step" INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  "user_id" INTEGER NOT NULL,
+  -- hex encoded SHA-256 of the normalized code
+  "code" VARYING CHARACTER (64) NOT NULL,
+  PRIMARY KEY ("user_id", "code"),
+  FOREIGN KEY ("user_id") REFERENCES users ("id") ON DELETE CASCADE
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS passkeys (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  "user_id" INTEGER NOT NULL,
+  "credential_id" BLOB NOT NULL UNIQUE,
+  -- PKIX, ASN.1 DER encoded
+  "public_key" BLOB NOT NULL,
+  -- COSE algorithm identifier
+  "algorithm" INTEGER NOT NULL,
+  "sign_count" INTEGER NOT NULL DEFAULT 0,
+  "name" VARYING CHARACTER (64) NOT NULL,
+  "used_at" DATETIME,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY ("user_id") REFERENCES users ("id") ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS passkeys_user_id ON passkeys ("user_id");
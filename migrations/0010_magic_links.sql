@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS magic_links (
+  -- hex encoded SHA-256 of the token in the link sent by email
+  "token" VARYING CHARACTER (64) PRIMARY KEY,
+  "user_id" INTEGER NOT NULL,
+  "expires_at" DATETIME NOT NULL,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY ("user_id") REFERENCES users ("id") ON DELETE CASCADE
+);
@@ -0,0 +1,39 @@
+-- Accounts that sign in with OpenID Connect have no password. SQLite cannot
+-- drop NOT NULL from a column, so the users table is recreated.
+CREATE TABLE users_new (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  "email" VARYING CHARACTER (254) NOT NULL UNIQUE,
+  -- NULL for accounts without a password
+  "password" VARYING CHARACTER (80),
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "username" VARYING CHARACTER (32),
+  "visibility" VARYING CHARACTER (8) NOT NULL DEFAULT 'private',
+  "share_token" VARYING CHARACTER (43),
+  "feed_token" VARYING CHARACTER (43),
+  "verified_at" DATETIME,
+  "totp_secret" VARYING CHARACTER (32),
+  "totp_step" INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO users_new (id, email, password, created_at, username, visibility,
+    share_token, feed_token, verified_at, totp_secret, totp_step)
+  SELECT id, email, password, created_at, username, visibility,
+    share_token, feed_token, verified_at, totp_secret, totp_step
+  FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username ON users ("username");
+CREATE UNIQUE INDEX IF NOT EXISTS users_share_token ON users ("share_token");
+CREATE UNIQUE INDEX IF NOT EXISTS users_feed_token ON users ("feed_token");
+
+-- accounts at OpenID Connect providers linked to pinub accounts
+CREATE TABLE IF NOT EXISTS identities (
+  "issuer" VARYING CHARACTER (256) NOT NULL,
+  "subject" VARYING CHARACTER (256) NOT NULL,
+  "user_id" INTEGER NOT NULL,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY ("issuer", "subject"),
+  FOREIGN KEY ("user_id") REFERENCES users ("id") ON DELETE CASCADE
+);
@@ -0,0 +1,8 @@
+-- failed sign ins by IP address or email, kept when App.PersistLoginLimits
+-- is set so the limits survive restarts
+CREATE TABLE IF NOT EXISTS login_failures (
+  "key" VARYING CHARACTER (300) PRIMARY KEY,
+  "failures" INTEGER NOT NULL,
+  "failed_at" DATETIME NOT NULL,
+  "blocked_until" DATETIME NOT NULL
+);
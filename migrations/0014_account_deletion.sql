@@ -0,0 +1,2 @@
+-- accounts are deleted at delete_at, unless their users change their mind
+ALTER TABLE users ADD COLUMN "delete_at" DATETIME;
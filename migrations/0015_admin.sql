@@ -0,0 +1,21 @@
+-- admins manage the other accounts at /admin
+ALTER TABLE users ADD COLUMN "is_admin" BOOLEAN NOT NULL DEFAULT FALSE;
+-- disabled accounts cannot sign in
+ALTER TABLE users ADD COLUMN "disabled_at" DATETIME;
+
+-- who did what to which account
+CREATE TABLE IF NOT EXISTS audit_events (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  -- the account the event is about, kept after it is deleted
+  "user_id" INTEGER,
+  -- the user who caused the event, like an admin, NULL if unknown
+  "actor_id" INTEGER,
+  "action" VARYING CHARACTER (64) NOT NULL,
+  "detail" TEXT NOT NULL DEFAULT '',
+  "ip" VARYING CHARACTER (45) NOT NULL DEFAULT '',
+  "user_agent" VARYING CHARACTER (256) NOT NULL DEFAULT '',
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_user_id ON audit_events ("user_id");
+CREATE INDEX IF NOT EXISTS audit_events_created_at ON audit_events ("created_at");
@@ -0,0 +1,15 @@
+-- codes that let people register while registration is invite-only
+CREATE TABLE IF NOT EXISTS invites (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  "code" VARYING CHARACTER (43) NOT NULL UNIQUE,
+  -- the user who created the invite, NULL from the command line
+  "created_by" INTEGER,
+  -- how many accounts may be registered with the code, 0 for any number
+  "max_uses" INTEGER NOT NULL DEFAULT 1,
+  "uses" INTEGER NOT NULL DEFAULT 0,
+  -- NULL for codes that do not expire
+  "expires_at" DATETIME,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS invites_created_by ON invites ("created_by");
@@ -0,0 +1,3 @@
+-- keys are hashes of the IP address or email now, the failures of the last
+-- day counted under the plain keys are dropped rather than kept unused
+DELETE FROM login_failures;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS link_tags (
+  "user_id" INTEGER NOT NULL,
+  "link_id" INTEGER NOT NULL,
+  -- lowercase, see parseTags
+  "tag" VARYING CHARACTER (64) NOT NULL,
+  PRIMARY KEY ("user_id", "link_id", "tag"),
+  FOREIGN KEY ("user_id", "link_id") REFERENCES user_links ("user_id", "link_id") ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS link_tags_tag ON link_tags ("user_id", "tag");
+
+-- tags shared on their own, whatever the visibility of all pins of the user
+CREATE TABLE IF NOT EXISTS tag_shares (
+  "user_id" INTEGER NOT NULL,
+  "tag" VARYING CHARACTER (64) NOT NULL,
+  "visibility" VARYING CHARACTER (8) NOT NULL DEFAULT 'private',
+  "share_token" VARYING CHARACTER (43) UNIQUE,
+  PRIMARY KEY ("user_id", "tag"),
+  FOREIGN KEY ("user_id") REFERENCES users ("id") ON DELETE CASCADE
+);
@@ -0,0 +1,14 @@
+-- Foreign keys are enforced from now on. They never were before, so rows
+-- referencing users or links that are gone are removed first.
+DELETE FROM user_links WHERE user_id NOT IN (SELECT id FROM users)
+  OR link_id NOT IN (SELECT id FROM links);
+DELETE FROM link_tags WHERE NOT EXISTS (SELECT 1 FROM user_links ul
+  WHERE ul.user_id = link_tags.user_id AND ul.link_id = link_tags.link_id);
+DELETE FROM tag_shares WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM password_resets WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM email_verifications WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM email_reverts WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM recovery_codes WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM passkeys WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM magic_links WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM identities WHERE user_id NOT IN (SELECT id FROM users);
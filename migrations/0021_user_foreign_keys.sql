@@ -0,0 +1,44 @@
+-- Sessions and invites go with the user who has them. SQLite cannot add a
+-- foreign key to a table, so both are recreated.
+CREATE TABLE logins_new (
+  "user_id" INTEGER NOT NULL,
+  -- hex encoded SHA-256 of the session token in the cookie
+  "token" VARYING CHARACTER (64) NOT NULL UNIQUE,
+  "user_agent" VARYING CHARACTER (256) NOT NULL DEFAULT '',
+  "ip" VARYING CHARACTER (45) NOT NULL DEFAULT '',
+  "active_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "remember" BOOLEAN NOT NULL DEFAULT TRUE,
+  PRIMARY KEY ("user_id", "token"),
+  FOREIGN KEY ("user_id") REFERENCES users ("id") ON DELETE CASCADE
+);
+
+INSERT INTO logins_new (user_id, token, user_agent, ip, active_at, created_at, remember)
+  SELECT user_id, token, user_agent, ip, active_at, created_at, remember
+  FROM logins WHERE user_id IN (SELECT id FROM users);
+
+DROP TABLE logins;
+ALTER TABLE logins_new RENAME TO logins;
+
+CREATE TABLE invites_new (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  "code" VARYING CHARACTER (43) NOT NULL UNIQUE,
+  -- the user who created the invite, NULL from the command line
+  "created_by" INTEGER,
+  -- how many accounts may be registered with the code, 0 for any number
+  "max_uses" INTEGER NOT NULL DEFAULT 1,
+  "uses" INTEGER NOT NULL DEFAULT 0,
+  -- NULL for codes that do not expire
+  "expires_at" DATETIME,
+  "created_at" DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY ("created_by") REFERENCES users ("id") ON DELETE CASCADE
+);
+
+INSERT INTO invites_new (id, code, created_by, max_uses, uses, expires_at, created_at)
+  SELECT id, code, created_by, max_uses, uses, expires_at, created_at
+  FROM invites WHERE created_by IS NULL OR created_by IN (SELECT id FROM users);
+
+DROP TABLE invites;
+ALTER TABLE invites_new RENAME TO invites;
+
+CREATE INDEX IF NOT EXISTS invites_created_by ON invites ("created_by");
@@ -0,0 +1,176 @@
+package pinub
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"dab.io/pinub/internal/cookies"
+	"dab.io/pinub/internal/oidc"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// oidcCookieName holds state, nonce and PKCE verifier while the user
+	// signs in at the OpenID Connect provider.
+	oidcCookieName = "oidc"
+	oidcMaxAge     = 10 * 60
+)
+
+// oidcSignin sends the user to the OpenID Connect provider to sign in.
+func (a *App) oidcSignin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.OIDC == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		auth, err := oidc.NewAuth()
+		if err != nil {
+			http.Error(w, "cannot start sign in", http.StatusInternalServerError)
+			return
+		}
+		authURL, err := a.OIDC.AuthURL(r.Context(), auth, a.absURL(r, "/signin/oidc/callback"))
+		if err != nil {
+			slog.Error("cannot reach OpenID Connect provider", err)
+			a.flash(w, "cannot reach "+a.OIDCName+", try again later")
+			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			return
+		}
+
+		remember := "0"
+		if len(r.FormValue("remember")) > 0 {
+			remember = "1"
+		}
+		cookie := http.Cookie{
+			Name:     oidcCookieName,
+			Value:    strings.Join([]string{auth.State, auth.Nonce, auth.Verifier, remember}, " "),
+			Path:     "/signin/oidc",
+			MaxAge:   oidcMaxAge,
+			HttpOnly: true,
+			Secure:   !a.InsecureDev,
+			// sent along when the provider redirects back
+			SameSite: http.SameSiteLaxMode,
+		}
+		if err := cookies.WriteEncrypted(w, cookie, a.Keys); err != nil {
+			http.Error(w, "cannot save cookie", http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, r, authURL, http.StatusSeeOther)
+	}
+}
+
+// oidcCallback signs in the user the OpenID Connect provider sent back. Users
+// are found by their identity at the provider, or else by the email address
+// the provider confirmed. Users pinub does not know yet get an account
+// without a password.
+func (a *App) oidcCallback() http.HandlerFunc {
+	fail := func(w http.ResponseWriter, r *http.Request, msg string) {
+		a.flash(w, msg)
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.OIDC == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		value, err := cookies.ReadEncrypted(r, oidcCookieName, a.Keys)
+		http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/signin/oidc", MaxAge: -1})
+		fields := strings.Fields(value)
+		if err != nil || len(fields) != 4 {
+			fail(w, r, "signing in took too long, try again")
+			return
+		}
+		auth := &oidc.Auth{State: fields[0], Nonce: fields[1], Verifier: fields[2]}
+		remember := fields[3] == "1"
+
+		if subtle.ConstantTimeCompare([]byte(r.FormValue("state")), []byte(auth.State)) != 1 {
+			fail(w, r, "signing in failed, try again")
+			return
+		}
+		if errCode := r.FormValue("error"); len(errCode) > 0 {
+			slog.Info("OpenID Connect sign in failed", "error", errCode, "description", r.FormValue("error_description"))
+			fail(w, r, "signing in with "+a.OIDCName+" failed")
+			return
+		}
+
+		claims, err := a.OIDC.Exchange(r.Context(), auth, r.FormValue("code"), a.absURL(r, "/signin/oidc/callback"))
+		if err != nil {
+			slog.Error("OpenID Connect sign in failed", err)
+			fail(w, r, "signing in with "+a.OIDCName+" failed")
+			return
+		}
+
+		user, err := a.db.ByIdentity(r.Context(), claims.Issuer, claims.Subject)
+		if errors.Is(err, sql.ErrNoRows) {
+			user, err = a.linkIdentity(r, claims)
+			if errors.Is(err, errEmailNotVerified) {
+				fail(w, r, a.OIDCName+" did not confirm your email address")
+				return
+			}
+			if errors.Is(err, errRegistrationClosed) {
+				fail(w, r, "there is no pinub account for your email address, and registration is not open")
+				return
+			}
+		}
+		if err != nil {
+			slog.Error("cannot link OpenID Connect identity", err)
+			http.Error(w, "cannot sign in", http.StatusBadRequest)
+			return
+		}
+
+		if user.TwoFactor() {
+			a.startSecondFactor(w, r, user, remember)
+			return
+		}
+		if err := a.startSession(w, r, user, remember, a.OIDCName); err != nil {
+			http.Error(w, "cannot create session", http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+var (
+	errEmailNotVerified   = errors.New("email address not verified by the provider")
+	errRegistrationClosed = errors.New("registration is not open")
+)
+
+// linkIdentity links the identity to the user with the same email address,
+// or to a new user without a password if registration is open. The provider
+// has to have confirmed the address, or anybody could take over accounts
+// with it.
+func (a *App) linkIdentity(r *http.Request, claims *oidc.Claims) (*User, error) {
+	addr, err := mail.ParseAddress(claims.Email)
+	if err != nil || !claims.EmailVerified {
+		return nil, errEmailNotVerified
+	}
+
+	user, err := a.db.ByEmail(r.Context(), addr.Address)
+	if errors.Is(err, sql.ErrNoRows) {
+		if a.registration() != RegistrationOpen {
+			return nil, errRegistrationClosed
+		}
+		now := time.Now()
+		user = &User{Email: addr.Address, VerifiedAt: &now}
+		err = a.db.CreateUser(r.Context(), user)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.db.AddIdentity(r.Context(), user, claims.Issuer, claims.Subject); err != nil {
+		return nil, err
+	}
+	a.audit(r, user, user, "identity.link", claims.Issuer)
+
+	return user, nil
+}
@@ -0,0 +1,189 @@
+package pinub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"dab.io/pinub/internal/oidc"
+	"dab.io/pinub/internal/oidc/oidctest"
+)
+
+// newTestProvider lets users of a sign in with a new OpenID Connect
+// provider.
+func newTestProvider(t *testing.T, a *App) *oidctest.Server {
+	t.Helper()
+
+	srv, err := oidctest.NewServer("pinub", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	a.OIDC = &oidc.Provider{Issuer: srv.URL, ClientID: "pinub", ClientSecret: "secret"}
+	a.OIDCName = "Test ID"
+
+	return srv
+}
+
+// oidcSignIn signs in at the provider and returns the URL it sends the
+// browser back to.
+func (c *testClient) oidcSignIn(provider *oidctest.Server) string {
+	c.t.Helper()
+
+	resp, err := c.Get(c.srv.URL + "/signin/oidc")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		c.t.Fatalf("sign in with provider: %s", resp.Status)
+	}
+	back, err := provider.Authorize(resp.Header.Get("Location"))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return strings.TrimPrefix(back, c.srv.URL)
+}
+
+// callback returns the browser to pinub and returns the notice shown after,
+// if any.
+func (c *testClient) callback(path string) (*http.Response, string) {
+	c.t.Helper()
+
+	resp, err := c.Get(c.srv.URL + path)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Location") != "/signin" {
+		return resp, ""
+	}
+	_, body := c.get("/signin")
+
+	return resp, html.UnescapeString(body)
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	provider := newTestProvider(t, a)
+	createUser(t, a, "oidc@example.com")
+	provider.Claims = map[string]any{"email": "oidc@example.com", "email_verified": true}
+
+	tests := []struct {
+		name   string
+		state  func(string) string
+		notice string
+	}{
+		{"other state", func(string) string { return "forged" }, "signing in failed"},
+		{"no state", func(string) string { return "" }, "signing in failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, srv)
+			back, _ := url.Parse(c.oidcSignIn(provider))
+			q := back.Query()
+			q.Set("state", tt.state(q.Get("state")))
+			back.RawQuery = q.Encode()
+
+			resp, body := c.callback(back.String())
+			if resp.StatusCode != http.StatusSeeOther || !strings.Contains(body, tt.notice) {
+				t.Errorf("callback: %s, want notice %q", resp.Status, tt.notice)
+			}
+			if c.signedIn() {
+				t.Error("signed in")
+			}
+		})
+	}
+
+	// a callback the browser did not start is refused before the provider
+	// is asked for a token
+	c := newTestClient(t, srv)
+	back := newTestClient(t, srv).oidcSignIn(provider)
+	if _, body := c.callback(back); !strings.Contains(body, "signing in took too long") {
+		t.Error("callback without cookie not refused")
+	}
+	if provider.Tokens() != 0 || c.signedIn() {
+		t.Error("signed in with the code of another browser")
+	}
+}
+
+func TestOIDCLinkIdentity(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	provider := newTestProvider(t, a)
+	ctx := context.Background()
+
+	linked := createUser(t, a, "linked@example.com")
+	if err := a.db.AddIdentity(ctx, linked, provider.URL, "linked-subject"); err != nil {
+		t.Fatal(err)
+	}
+	existing := createUser(t, a, "existing@example.com")
+
+	tests := []struct {
+		name         string
+		registration string
+		claims       map[string]any
+		// user signed in, or the notice shown
+		user   string
+		notice string
+	}{
+		{"existing identity", "", map[string]any{"sub": "linked-subject", "email": "changed@example.com"}, "linked@example.com", ""},
+		{"existing identity with registration closed", RegistrationClosed, map[string]any{"sub": "linked-subject"}, "linked@example.com", ""},
+		{"existing verified email", "", map[string]any{"sub": "existing-subject", "email": "existing@example.com", "email_verified": true}, "existing@example.com", ""},
+		{"existing unverified email", "", map[string]any{"sub": "attacker", "email": "existing@example.com", "email_verified": false}, "", "did not confirm your email address"},
+		{"existing email, verification missing", "", map[string]any{"sub": "attacker", "email": "existing@example.com"}, "", "did not confirm your email address"},
+		{"new user", "", map[string]any{"sub": "new-subject", "email": "new@example.com", "email_verified": true}, "new@example.com", ""},
+		{"new user with registration closed", RegistrationClosed, map[string]any{"sub": "closed-subject", "email": "closed@example.com", "email_verified": true}, "", "registration is not open"},
+		{"new user with invites only", RegistrationInvite, map[string]any{"sub": "closed-subject", "email": "closed@example.com", "email_verified": true}, "", "registration is not open"},
+		{"no email", "", map[string]any{"sub": "anonymous"}, "", "did not confirm your email address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Registration = tt.registration
+			provider.Claims = tt.claims
+			c := newTestClient(t, srv)
+
+			resp, body := c.callback(c.oidcSignIn(provider))
+			if tt.user == "" {
+				if !strings.Contains(body, tt.notice) {
+					t.Errorf("callback: %s, want notice %q", resp.Status, tt.notice)
+				}
+				if c.signedIn() {
+					t.Error("signed in")
+				}
+				if _, err := a.db.ByIdentity(ctx, provider.URL, tt.claims["sub"].(string)); !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("identity linked: %v", err)
+				}
+				return
+			}
+
+			if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+				t.Fatalf("callback: %s to %s", resp.Status, resp.Header.Get("Location"))
+			}
+			if _, body := c.get("/profile"); !strings.Contains(body, tt.user) {
+				t.Errorf("not signed in as %s", tt.user)
+			}
+			user, err := a.db.ByIdentity(ctx, provider.URL, tt.claims["sub"].(string))
+			if err != nil || user.Email != tt.user {
+				t.Errorf("identity linked to %v, want %s: %v", user, tt.user, err)
+			}
+		})
+	}
+
+	// linking an email address adds the identity, it keeps the password
+	if user, err := a.db.ByEmail(ctx, "existing@example.com"); err != nil || user.ID != existing.ID || len(user.Password) == 0 {
+		t.Errorf("existing user changed: %+v, %v", user, err)
+	}
+	// new users have a confirmed email address and no password
+	if user, err := a.db.ByEmail(ctx, "new@example.com"); err != nil || user.VerifiedAt == nil || len(user.Password) > 0 {
+		t.Errorf("new user: %+v, %v", user, err)
+	}
+	if _, err := a.db.ByEmail(ctx, "closed@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("user created with registration closed: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package pinub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"dab.io/pinub/internal/cookies"
+	"dab.io/pinub/internal/webauthn"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// webauthnCookieName holds the challenge of a passkey ceremony in
+	// progress.
+	webauthnCookieName = "webauthn"
+	webauthnMaxAge     = 5 * 60
+)
+
+// base64URL is binary data in JSON, encoded like the browser encodes it in
+// the client data.
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	*b = decoded
+
+	return err
+}
+
+// relyingParty is pinub as seen by the browser. Passkeys work on localhost
+// over plain HTTP, but not on IP addresses.
+func (a *App) relyingParty(r *http.Request) webauthn.RelyingParty {
+	u, _ := url.Parse(a.absURL(r, "/"))
+
+	return webauthn.RelyingParty{ID: u.Hostname(), Origin: u.Scheme + "://" + u.Host}
+}
+
+// userHandle identifies the user in their passkeys.
+func userHandle(user *User) []byte {
+	return []byte(strconv.Itoa(user.ID))
+}
+
+// startCeremony sends a new challenge for the ceremony to the browser. The
+// ceremony names the step and user it is valid for.
+func (a *App) startCeremony(w http.ResponseWriter, ceremony string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	cookie := http.Cookie{
+		Name:     webauthnCookieName,
+		Value:    ceremony + ":" + challenge,
+		Path:     "/passkeys",
+		MaxAge:   webauthnMaxAge,
+		HttpOnly: true,
+		Secure:   !a.InsecureDev,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	return challenge, cookies.WriteEncrypted(w, cookie, a.Keys)
+}
+
+// finishCeremony returns the challenge of the ceremony and forgets it, so it
+// can be answered once.
+func (a *App) finishCeremony(w http.ResponseWriter, r *http.Request, ceremony string) string {
+	http.SetCookie(w, &http.Cookie{Name: webauthnCookieName, Path: "/passkeys", MaxAge: -1})
+
+	value, err := cookies.ReadEncrypted(r, webauthnCookieName, a.Keys)
+	if err != nil {
+		return ""
+	}
+	challenge, ok := strings.CutPrefix(value, ceremony+":")
+	if !ok {
+		return ""
+	}
+
+	return challenge
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("cannot encode JSON", err)
+	}
+}
+
+type publicKeyParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   base64URL `json:"id"`
+}
+
+// passkeyCreateOptions starts adding a passkey to the account of the user,
+// who confirms it with their password. The answer is the argument of
+// navigator.credentials.create, with binary data base64 URL encoded.
+func (a *App) passkeyCreateOptions() http.HandlerFunc {
+	type rpEntity struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	type userEntity struct {
+		ID          base64URL `json:"id"`
+		Name        string    `json:"name"`
+		DisplayName string    `json:"displayName"`
+	}
+	type authenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+	type creationOptions struct {
+		Challenge              string                 `json:"challenge"`
+		RP                     rpEntity               `json:"rp"`
+		User                   userEntity             `json:"user"`
+		PubKeyCredParams       []publicKeyParam       `json:"pubKeyCredParams"`
+		Timeout                int                    `json:"timeout"`
+		Attestation            string                 `json:"attestation"`
+		AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+		ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		if !a.confirmed(r, user, r.FormValue("pass")) {
+			http.Error(w, confirmFailure(user), http.StatusUnprocessableEntity)
+			return
+		}
+
+		passkeys, err := a.db.Passkeys(r.Context(), user)
+		if err != nil {
+			http.Error(w, "cannot get passkeys from database", http.StatusBadRequest)
+			return
+		}
+
+		challenge, err := a.startCeremony(w, "create:"+strconv.Itoa(user.ID))
+		if err != nil {
+			http.Error(w, "cannot start passkey ceremony", http.StatusInternalServerError)
+			return
+		}
+
+		options := creationOptions{
+			Challenge:   challenge,
+			RP:          rpEntity{ID: a.relyingParty(r).ID, Name: "pinub"},
+			User:        userEntity{ID: userHandle(user), Name: user.Email, DisplayName: user.Email},
+			Timeout:     webauthnMaxAge * 1000,
+			Attestation: "none",
+			AuthenticatorSelection: authenticatorSelection{
+				ResidentKey:      "required",
+				UserVerification: "preferred",
+			},
+			ExcludeCredentials: []credentialDescriptor{},
+		}
+		for _, alg := range webauthn.Algorithms {
+			options.PubKeyCredParams = append(options.PubKeyCredParams, publicKeyParam{"public-key", alg})
+		}
+		for _, pk := range passkeys {
+			options.ExcludeCredentials = append(options.ExcludeCredentials, credentialDescriptor{"public-key", pk.CredentialID})
+		}
+
+		writeJSON(w, options)
+	}
+}
+
+// passkeyCreate stores the passkey the browser created.
+func (a *App) passkeyCreate() http.HandlerFunc {
+	type attestationResponse struct {
+		Name     string    `json:"name"`
+		ID       base64URL `json:"id"`
+		Response struct {
+			ClientDataJSON    base64URL `json:"clientDataJSON"`
+			AttestationObject base64URL `json:"attestationObject"`
+		} `json:"response"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+		challenge := a.finishCeremony(w, r, "create:"+strconv.Itoa(user.ID))
+
+		var resp attestationResponse
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&resp); err != nil {
+			http.Error(w, "cannot read passkey", http.StatusBadRequest)
+			return
+		}
+
+		cred, err := a.relyingParty(r).VerifyRegistration(challenge, resp.Response.ClientDataJSON, resp.Response.AttestationObject)
+		if err != nil {
+			slog.Info("passkey registration failed", "error", err)
+			http.Error(w, "passkey not valid", http.StatusBadRequest)
+			return
+		}
+		if !bytes.Equal(cred.ID, resp.ID) {
+			http.Error(w, "passkey not valid", http.StatusBadRequest)
+			return
+		}
+
+		name := strings.TrimSpace(resp.Name)
+		if len(name) == 0 {
+			name = "passkey"
+		}
+		if len(name) > 64 {
+			name = name[:64]
+		}
+		pk := &Passkey{
+			CredentialID: cred.ID,
+			PublicKey:    cred.PublicKey,
+			Algorithm:    cred.Algorithm,
+			SignCount:    cred.SignCount,
+			Name:         name,
+		}
+		if err := a.db.AddPasskey(r.Context(), user, pk); err != nil {
+			http.Error(w, "cannot save passkey", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "passkey.add", pk.Name)
+
+		a.flash(w, "passkey added")
+		writeJSON(w, map[string]string{"redirect": "/profile"})
+	}
+}
+
+// passkeyGetOptions starts signing in with a passkey. The answer is the
+// argument of navigator.credentials.get. The browser offers the passkeys it
+// has for pinub, so the user does not type their email.
+func (a *App) passkeyGetOptions() http.HandlerFunc {
+	type requestOptions struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		Timeout          int    `json:"timeout"`
+		UserVerification string `json:"userVerification"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge, err := a.startCeremony(w, "get")
+		if err != nil {
+			http.Error(w, "cannot start passkey ceremony", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, requestOptions{
+			Challenge: challenge,
+			RPID:      a.relyingParty(r).ID,
+			Timeout:   webauthnMaxAge * 1000,
+			// a verified passkey stands in for the password and the
+			// second factor
+			UserVerification: "required",
+		})
+	}
+}
+
+var errPasskey = errors.New("passkey not valid")
+
+// passkeyGet signs in the owner of the passkey the browser used.
+func (a *App) passkeyGet() http.HandlerFunc {
+	type assertionResponse struct {
+		ID       base64URL `json:"id"`
+		Remember bool      `json:"remember"`
+		Response struct {
+			ClientDataJSON    base64URL `json:"clientDataJSON"`
+			AuthenticatorData base64URL `json:"authenticatorData"`
+			Signature         base64URL `json:"signature"`
+			UserHandle        base64URL `json:"userHandle"`
+		} `json:"response"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge := a.finishCeremony(w, r, "get")
+
+		var resp assertionResponse
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&resp); err != nil {
+			http.Error(w, "cannot read passkey", http.StatusBadRequest)
+			return
+		}
+
+		user, pk, err := a.db.ByPasskey(r.Context(), resp.ID)
+		if err != nil {
+			http.Error(w, errPasskey.Error(), http.StatusUnauthorized)
+			return
+		}
+		if len(resp.Response.UserHandle) > 0 && !bytes.Equal(resp.Response.UserHandle, userHandle(user)) {
+			http.Error(w, errPasskey.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		cred := &webauthn.Credential{
+			ID:        pk.CredentialID,
+			PublicKey: pk.PublicKey,
+			Algorithm: pk.Algorithm,
+			SignCount: pk.SignCount,
+		}
+		signCount, err := a.relyingParty(r).VerifyAssertion(challenge, cred,
+			resp.Response.ClientDataJSON, resp.Response.AuthenticatorData, resp.Response.Signature, true)
+		if err != nil {
+			slog.Info("passkey sign in failed", "error", err, "passkey", pk.ID)
+			http.Error(w, errPasskey.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := a.db.UsePasskey(r.Context(), pk, signCount); err != nil {
+			slog.Error("cannot update passkey", err)
+		}
+
+		if err := a.startSession(w, r, user, resp.Remember, "passkey"); err != nil {
+			http.Error(w, "cannot create session", http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, map[string]string{"redirect": "/"})
+	}
+}
+
+// passkeyDelete removes a passkey of the user.
+func (a *App) passkeyDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "passkey not found", http.StatusBadRequest)
+			return
+		}
+		if err := a.db.DeletePasskey(r.Context(), user, id); err != nil {
+			http.Error(w, "cannot delete passkey", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "passkey.delete", "")
+
+		a.flash(w, "passkey removed")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	}
+}
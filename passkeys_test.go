@@ -0,0 +1,129 @@
+package pinub
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"dab.io/pinub/internal/webauthn"
+)
+
+// passkeyAssertion answers a new passkey challenge of pinub with key for
+// the credential, like an authenticator would, naming handle as its user.
+func passkeyAssertion(t *testing.T, c *testClient, key *ecdsa.PrivateKey, credID, handle []byte) string {
+	t.Helper()
+
+	resp, body := c.postJSON("/passkeys/get/options", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("passkey options: %s %s", resp.Status, body)
+	}
+	var options struct {
+		Challenge string `json:"challenge"`
+		RPID      string `json:"rpId"`
+	}
+	if err := json.Unmarshal([]byte(body), &options); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(c.srv.URL)
+	clientData, _ := json.Marshal(map[string]string{
+		"type":      "webauthn.get",
+		"challenge": options.Challenge,
+		"origin":    u.Scheme + "://" + u.Host,
+	})
+	rpIDHash := sha256.Sum256([]byte(options.RPID))
+	// user present and verified, signature counter 1
+	authData := binary.BigEndian.AppendUint32(append(rpIDHash[:], 0x05), 1)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	assertion, _ := json.Marshal(map[string]any{
+		"id": b64(credID),
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(handle),
+		},
+	})
+
+	return string(assertion)
+}
+
+func TestPasskeyGet(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	user := createUser(t, a, "passkey@example.com")
+	other := createUser(t, a, "other@example.com")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := &Passkey{CredentialID: []byte("credential"), PublicKey: der, Algorithm: webauthn.AlgES256, Name: "test"}
+	if err := a.db.AddPasskey(context.Background(), user, pk); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		handle []byte
+		status int
+	}{
+		{"user handle of another user", userHandle(other), http.StatusUnauthorized},
+		{"unknown user handle", []byte(strconv.Itoa(user.ID + 100)), http.StatusUnauthorized},
+		{"user handle of the owner", userHandle(user), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, srv)
+			resp, body := c.postJSON("/passkeys/get", passkeyAssertion(t, c, key, pk.CredentialID, tt.handle))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("sign in with passkey: %s %s, want %d", resp.Status, body, tt.status)
+			}
+			if signedIn := c.signedIn(); signedIn != (tt.status == http.StatusOK) {
+				t.Errorf("signed in = %v after %s", signedIn, resp.Status)
+			}
+		})
+	}
+}
+
+func TestPasskeyGetReplay(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	user := createUser(t, a, "passkey@example.com")
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pk := &Passkey{CredentialID: []byte("credential"), PublicKey: der, Algorithm: webauthn.AlgES256, Name: "test"}
+	if err := a.db.AddPasskey(context.Background(), user, pk); err != nil {
+		t.Fatal(err)
+	}
+
+	// the challenge is answered once, a replayed answer does not count
+	c := newTestClient(t, srv)
+	assertion := passkeyAssertion(t, c, key, pk.CredentialID, nil)
+	if resp, body := c.postJSON("/passkeys/get", assertion); resp.StatusCode != http.StatusOK {
+		t.Fatalf("sign in with passkey: %s %s", resp.Status, body)
+	}
+	if resp, _ := c.postJSON("/passkeys/get", assertion); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replayed sign in with passkey: %s, want 401", resp.Status)
+	}
+}
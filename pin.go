@@ -0,0 +1,97 @@
+package pinub
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// bookmarklet returns a javascript: link that opens the pin form at pinURL
+// in a popup, filled with the address, title, keywords and selected text of
+// the current page.
+func bookmarklet(pinURL string) template.URL {
+	return template.URL("javascript:(function(){" +
+		"var e=encodeURIComponent,k=document.querySelector('meta[name=keywords]');" +
+		"window.open('" + template.JSEscapeString(pinURL) + "?url='+e(location.href)+" +
+		"'&title='+e(document.title)+'&tags='+e(k?k.content:'')+" +
+		"'&selection='+e(String(window.getSelection()))," +
+		"'pinub','width=480,height=560');})();")
+}
+
+// pin shows a compact form to pin the link given in the url parameter,
+// meant to be opened by the bookmarklet. Title, tags and notes are filled
+// with the title, tags and selection parameters unless the link is already
+// pinned; tags that are not valid are dropped. The user's tags are shown
+// as hints. Saving replaces title, notes and tags of the pin.
+func (a *App) pin() http.HandlerFunc {
+	tpl, _ := template.New("pin.html").Funcs(funcs).ParseFS(tpls, "templates/pin.html", layoutTpl)
+
+	type pinData struct {
+		Link   *Link
+		Pinned bool
+		Saved  bool
+		// Tags are all tags of the user.
+		Tags []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		rawLink := strings.TrimSpace(r.FormValue("url"))
+		url, err := parseLink(rawLink)
+		if err != nil {
+			http.Error(w, "link is not valid", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			data := pinData{}
+
+			data.Link, err = a.db.Link(r.Context(), user, url)
+			switch err {
+			case nil:
+				data.Pinned = true
+			case sql.ErrNoRows:
+				data.Link = &Link{
+					URL:   url,
+					Title: strings.TrimSpace(r.FormValue("title")),
+					Notes: strings.TrimSpace(r.FormValue("selection")),
+					Tags:  suggestedTags(r.FormValue("tags")),
+				}
+			default:
+				http.Error(w, "cannot get link from database", http.StatusBadRequest)
+				return
+			}
+			if data.Tags, err = a.db.Tags(r.Context(), user); err != nil {
+				http.Error(w, "cannot get tags from database", http.StatusBadRequest)
+				return
+			}
+
+			render(w, r, tpl, data)
+			return
+		}
+
+		tags, err := parseTags(r.FormValue("tags"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		link := &Link{
+			URL:   url,
+			Title: strings.TrimSpace(r.FormValue("title")),
+			Notes: strings.TrimSpace(r.FormValue("notes")),
+			Tags:  tags,
+		}
+		if err := a.db.Addlink(r.Context(), user, link); err != nil {
+			http.Error(w, "cannot add link to user", http.StatusBadRequest)
+			return
+		}
+		if err := a.db.UpdateLink(r.Context(), user, link); err != nil {
+			http.Error(w, "cannot update link", http.StatusBadRequest)
+			return
+		}
+
+		render(w, r, tpl, pinData{Link: link, Saved: true})
+	}
+}
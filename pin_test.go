@@ -0,0 +1,72 @@
+package pinub
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSuggestedTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		tags []string
+	}{
+		{"", nil},
+		{"Go, web development, #golang", []string{"development", "go", "golang", "web"}},
+		{"go, a/b, c.d, Go", []string{"go"}},
+		{"a b c d e f g h i j k l m n o p q r s t u v", strings.Fields("a b c d e f g h i j k l m n o p q r s t")},
+	}
+	for _, tt := range tests {
+		if tags := suggestedTags(tt.in); !slices.Equal(tags, tt.tags) {
+			t.Errorf("suggestedTags(%q) = %q, want %q", tt.in, tags, tt.tags)
+		}
+	}
+}
+
+func TestPinForm(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	createUser(t, a, "pin@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("pin@example.com")
+
+	form := func(params url.Values) string {
+		t.Helper()
+
+		status, body := c.get("/pin?" + params.Encode())
+		if status != http.StatusOK {
+			t.Fatalf("pin form %v: %d", params, status)
+		}
+		return body
+	}
+
+	body := form(url.Values{"url": {"https://go.dev/"}, "title": {"Go"}, "tags": {"Go, a/b, web"}, "selection": {"a language"}})
+	for _, want := range []string{`value="Go"`, `name="tags" value="go web"`, ">a language</textarea>", "pin a <b>link</b>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("new pin form lacks %s", want)
+		}
+	}
+
+	resp, _ := c.post("/pin", url.Values{"url": {"https://go.dev/"}, "title": {"Go"}, "tags": {"go lang"}, "notes": {"mine"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pin: %s", resp.Status)
+	}
+
+	// a pinned link shows what was saved, not the parameters
+	body = form(url.Values{"url": {"https://go.dev/"}, "title": {"Other"}, "tags": {"other"}, "selection": {"other"}})
+	for _, want := range []string{"already pinned", `name="tags" value="go lang"`, ">mine</textarea>", "your tags: go lang"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("pinned form lacks %s", want)
+		}
+	}
+}
+
+func TestBookmarklet(t *testing.T) {
+	js := string(bookmarklet("https://pinub.example/pin"))
+	for _, want := range []string{"'https://pinub.example/pin?url='", "meta[name=keywords]", "'&tags='", "'&selection='"} {
+		if !strings.Contains(js, want) {
+			t.Errorf("bookmarklet lacks %s: %s", want, js)
+		}
+	}
+}
@@ -1,19 +1,30 @@
 package pinub
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/mail"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"dab.io/pinub/internal/cookies"
-	"golang.org/x/crypto/bcrypt"
+	"dab.io/pinub/internal/mailer"
+	"dab.io/pinub/internal/oidc"
+	"dab.io/pinub/internal/password"
 	"golang.org/x/exp/slog"
 	_ "modernc.org/sqlite"
 )
@@ -35,69 +46,273 @@ const (
 
 	// context key for storing user object
 	userContextKey key = 0
+	// context key for storing the CSRF token of the request
+	csrfContextKey key = 1
+	// context key for storing the function returning the flash message
+	flashContextKey key = 2
 )
 
 type App struct {
 	ListenAddress string
 	DSN           string
-	SecretKey     []byte
-
-	db *UserService
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout limit
+	// how long the server waits for clients, like those of http.Server.
+	// Zero means no limit.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long running requests and background work,
+	// like sending emails, may take to finish on shutdown. Zero cuts them
+	// off right away.
+	ShutdownTimeout time.Duration
+	// Keys encrypt and decrypt the cookies.
+	Keys *cookies.Keyring
+	// InsecureDev allows cookies over plain HTTP for local development.
+	InsecureDev bool
+	// BaseURL is the public URL of pinub used in feeds. If empty, it is
+	// derived from the request.
+	BaseURL string
+	// SessionIdleTimeout and SessionLifetime limit how long sessions last
+	// without activity and in total. Zero means no limit.
+	SessionIdleTimeout time.Duration
+	SessionLifetime    time.Duration
+	// Mailer sends emails like password reset links.
+	Mailer mailer.Mailer
+	// Unverified is what users may do before they confirm their email
+	// address: UnverifiedAllow, UnverifiedLimit or UnverifiedBlock. Empty
+	// means UnverifiedAllow.
+	Unverified string
+	// MagicLinks allows signing in with a link sent by email instead of the
+	// password.
+	MagicLinks bool
+	// OIDC is the OpenID Connect provider users may sign in with, shown as
+	// OIDCName. Nil turns it off.
+	OIDC     *oidc.Provider
+	OIDCName string
+	// ProxyHeader names the request header, like X-Forwarded-Email, with
+	// the email address of the user an authenticating proxy signed in.
+	// It is trusted only on requests from TrustedProxies. Empty turns it
+	// off.
+	ProxyHeader    string
+	TrustedProxies []netip.Prefix
+	// ReverseProxies are the addresses of proxies, like the edge of fly.io,
+	// that forward requests to pinub. Requests from them name the address
+	// of the client in X-Forwarded-For or Fly-Client-IP.
+	ReverseProxies []netip.Prefix
+	// DisableLocalSignin turns off signing in and registering with pinub
+	// itself, like when ProxyHeader or OIDC take care of it.
+	DisableLocalSignin bool
+	// Registration is who may register: RegistrationOpen,
+	// RegistrationInvite or RegistrationClosed. Empty means
+	// RegistrationOpen. Accounts named by ProxyHeader are created anyway,
+	// the proxy decides who gets in.
+	Registration string
+	// UserInvites lets users invite others while registration is
+	// invite-only. Otherwise only admins create invites.
+	UserInvites bool
+	// PersistLoginLimits keeps failed sign ins in the database, so their
+	// limits survive restarts.
+	PersistLoginLimits bool
+	// Passwords decides which passwords users may choose. Nil means
+	// password.DefaultPolicy.
+	Passwords *password.Policy
+	// DeletionGrace is how long users may change their mind after deleting
+	// their account. Zero deletes it at the next cleanup.
+	DeletionGrace time.Duration
+	// AuditRetention is how long audit events are kept. Zero keeps them
+	// forever.
+	AuditRetention time.Duration
+	// Hasher hashes new passwords. Passwords hashed differently are hashed
+	// again when their users sign in. Nil means password.DefaultHasher.
+	Hasher *password.Hasher
+
+	db             *UserService
+	codeAttempts   *limiter
+	magicLinkSends *limiter
+	ipFailures     *backoff
+	emailFailures  *backoff
+	// dummyHash is checked against the password for unknown email
+	// addresses, so they take as long as known ones.
+	dummyHash string
+	// workers counts the goroutines started by background, work is their
+	// context and stopWork cancels it.
+	workers  sync.WaitGroup
+	work     context.Context
+	stopWork context.CancelFunc
 }
 
-func (a *App) Start() {
-	db, err := sql.Open("sqlite", a.DSN)
+// Start serves pinub until ctx is done and shuts down gracefully then. It
+// returns an error if pinub cannot start or the server fails.
+func (a *App) Start(ctx context.Context) error {
+	db, err := OpenDB(a.DSN)
 	if err != nil {
-		slog.Error("cannot open database", err, "dsn", a.DSN)
+		return fmt.Errorf("cannot open database: %w", err)
 	}
+	// closed last, after requests and background work are done
 	defer db.Close()
 
-	if err := db.Ping(); err != nil {
-		slog.Error("cannot ping database", err, "dsn", a.DSN)
+	handler, err := a.setup(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer a.stopWork()
+
+	return a.serve(ctx, handler)
+}
+
+// setup brings the database up to date and prepares everything else
+// serving needs. It returns the handler of all pages.
+func (a *App) setup(ctx context.Context, db *sql.DB) (http.Handler, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("cannot ping database: %w", err)
+	}
+	if err := Migrate(ctx, db); err != nil {
+		return nil, err
+	}
+	a.db = &UserService{
+		DB:          db,
+		IdleTimeout: a.SessionIdleTimeout,
+		Lifetime:    a.SessionLifetime,
+	}
+	a.work, a.stopWork = context.WithCancel(context.Background())
+	// five wrong codes lock the second step of signing in for 15 minutes
+	a.codeAttempts = newLimiter(5, 15*time.Minute)
+	// three sign in links per address every 15 minutes
+	a.magicLinkSends = newLimiter(3, 15*time.Minute)
+	// wrong passwords slow down signing in with the address from the sixth
+	// on, and from the same IP address from the 21st on, which might be
+	// shared by many users
+	var persist *UserService
+	if a.PersistLoginLimits {
+		persist = a.db
+	}
+	a.emailFailures = newBackoff("email:", 5, time.Second, 15*time.Minute, persist)
+	a.ipFailures = newBackoff("ip:", 20, time.Second, 15*time.Minute, persist)
+	for _, b := range []*backoff{a.emailFailures, a.ipFailures} {
+		if err := b.Load(ctx); err != nil {
+			return nil, fmt.Errorf("cannot load login failures: %w", err)
+		}
+	}
+
+	if a.Mailer == nil {
+		a.Mailer = &mailer.Log{}
+	}
+	if a.Passwords == nil {
+		a.Passwords = password.DefaultPolicy
 	}
-	if _, err := db.Exec(schemaSQL); err != nil {
-		slog.Error("cannot run migrations", err, "dsn", a.DSN)
+	if a.Hasher == nil {
+		a.Hasher = password.DefaultHasher
+	}
+	var err error
+	if a.dummyHash, err = a.Hasher.Hash("not a password"); err != nil {
+		return nil, fmt.Errorf("cannot hash password: %w", err)
+	}
+	if a.BaseURL == "" {
+		slog.Warn("BASE_URL is not set, links in emails use the Host header of the request")
 	}
-	a.db = &UserService{DB: db}
 
 	m := http.NewServeMux()
-	m.HandleFunc("/", private(a.index()))
+	m.HandleFunc("/", private(a.verified(a.index())))
 	m.HandleFunc("/home", a.home())
-	m.HandleFunc("/signin", a.signin())
-	m.HandleFunc("/register", a.register())
+	m.HandleFunc("/signin", a.local(a.signin()))
+	m.HandleFunc("/signin/code", a.local(a.signinCode()))
+	m.HandleFunc("/signin/email", a.local(a.magicLink()))
+	m.HandleFunc("/signin/link", a.local(a.signinLink()))
+	m.HandleFunc("GET /signin/oidc", a.oidcSignin())
+	m.HandleFunc("GET /signin/oidc/callback", a.oidcCallback())
+	m.HandleFunc("/register", a.local(a.register()))
+	m.HandleFunc("/forgot", a.local(a.forgot()))
+	m.HandleFunc("/reset", a.local(a.reset()))
 	m.HandleFunc("/profile", private(a.profile()))
-	m.HandleFunc("/signout", private(a.signout()))
+	m.HandleFunc("/profile/sessions", private(a.sessions()))
+	m.HandleFunc("/profile/2fa", private(a.twoFactor()))
+	m.HandleFunc("GET /profile/export", private(a.export()))
+	m.HandleFunc("/profile/confirm", private(a.confirm()))
+	m.HandleFunc("POST /profile/delete", private(a.deleteAccount()))
+	m.HandleFunc("POST /profile/invites", private(a.verified(a.userInvites())))
+	m.HandleFunc("GET /admin", admin(a.adminUsers()))
+	m.HandleFunc("POST /admin/users/{id}", admin(a.adminUser()))
+	m.HandleFunc("/admin/invites", admin(a.adminInvites()))
+	m.HandleFunc("GET /admin/audit", admin(a.adminAudit()))
+	m.HandleFunc("POST /passkeys/create/options", private(a.passkeyCreateOptions()))
+	m.HandleFunc("POST /passkeys/create", private(a.passkeyCreate()))
+	m.HandleFunc("POST /passkeys/get/options", a.local(a.passkeyGetOptions()))
+	m.HandleFunc("POST /passkeys/get", a.local(a.passkeyGet()))
+	m.HandleFunc("POST /passkeys/delete", private(a.passkeyDelete()))
+	m.HandleFunc("/verify", a.verify())
+	m.HandleFunc("POST /verify/resend", private(a.resendVerification()))
+	m.HandleFunc("/verify/revert", a.revertEmail())
+	m.HandleFunc("/sharing", private(a.verified(a.sharing())))
+	m.HandleFunc("POST /sharing/tag", private(a.verified(a.tagSharing())))
+	m.HandleFunc("GET /tags/{tag}", private(a.verified(a.tagged())))
+	m.HandleFunc("/hide", private(a.verified(a.hide())))
+	m.HandleFunc("/pin", private(a.verified(a.pin())))
+	m.HandleFunc("/feeds", private(a.verified(a.feeds())))
+	m.HandleFunc("POST /signout", private(a.signout()))
 	m.HandleFunc("/_healthz", healthz(db))
 
-	slog.Info("starting", "address", a.ListenAddress)
-	slog.Error("server failed", http.ListenAndServe(a.ListenAddress, logreq(a.auth(m))))
+	// Shared pages are served without looking at the session cookie, so
+	// their responses are the same for every visitor and can be cached.
+	s := http.NewServeMux()
+	s.Handle("/", a.auth(a.csrf(a.flashes(m))))
+	s.HandleFunc("GET /u/{username}", a.shared(a.publicListing))
+	s.HandleFunc("GET /u/{username}/t/{tag}", a.shared(a.publicListing))
+	s.HandleFunc("GET /s/{token}", a.shared(a.unlistedListing))
+	s.HandleFunc("GET /s/{token}/t/{tag}", a.shared(a.unlistedListing))
+	s.HandleFunc("GET /u/{username}/{feed}", a.feed(a.publicListing))
+	s.HandleFunc("GET /u/{username}/t/{tag}/{feed}", a.feed(a.publicListing))
+	s.HandleFunc("GET /s/{token}/{feed}", a.feed(a.unlistedListing))
+	s.HandleFunc("GET /s/{token}/t/{tag}/{feed}", a.feed(a.unlistedListing))
+	s.HandleFunc("GET /f/{token}/{feed}", a.feed(a.privateListing))
+	s.HandleFunc("GET /f/{token}/t/{tag}/{feed}", a.feed(a.privateListing))
+
+	return logreq(s), nil
 }
 
-func (a *App) index() http.HandlerFunc {
-	tpl, _ := template.New("index.html").Funcs(template.FuncMap{
-		// remove http and https scheme from urls
-		"lremove": func(prefix, s string) string {
-			return strings.TrimPrefix(s, prefix)
-		},
-		// timesince for createdAt
-		"timesince": func(createdAt *time.Time) string {
-			diff := time.Since(*createdAt)
-			if diff.Hours() > 24 {
-				return createdAt.Format("02.01.06 15:04:05")
-			}
-			if diff.Hours() > 1 {
-				return fmt.Sprintf("%.0fh ago", diff.Hours())
-			}
-			if diff.Minutes() > 1 {
-				return fmt.Sprintf("%.0fm ago", diff.Minutes())
-			}
+// funcs are the template functions available to pages listing links.
+var funcs = template.FuncMap{
+	// remove http and https scheme from urls
+	"lremove": func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	// timesince for createdAt
+	"timesince": func(createdAt *time.Time) string {
+		diff := time.Since(*createdAt)
+		if diff.Hours() > 24 {
+			return createdAt.Format("02.01.06 15:04:05")
+		}
+		if diff.Hours() > 1 {
+			return fmt.Sprintf("%.0fh ago", diff.Hours())
+		}
+		if diff.Minutes() > 1 {
+			return fmt.Sprintf("%.0fm ago", diff.Minutes())
+		}
+
+		return fmt.Sprintf("%.0fs ago", diff.Seconds())
+	},
+	"format": func(at *time.Time, format string) string {
+		return at.Format(format)
+	},
+	"join": strings.Join,
+	// what happened in an audit event, in words
+	"action": describeAction,
+	// hidden form field with the CSRF token, replaced in render
+	"csrfField": func() template.HTML {
+		return ""
+	},
+	// one-time notice left by App.flash, replaced in render
+	"flash": func() string {
+		return ""
+	},
+	// whether somebody is signed in, replaced in render
+	"signedIn": func() bool {
+		return false
+	},
+}
 
-			return fmt.Sprintf("%.0fs ago", diff.Seconds())
-		},
-		"format": func(at *time.Time, format string) string {
-			return at.Format(format)
-		},
-	}).ParseFS(tpls, "templates/index.html", layoutTpl)
+func (a *App) index() http.HandlerFunc {
+	tpl, _ := template.New("index.html").Funcs(funcs).ParseFS(tpls, "templates/index.html", layoutTpl)
 
 	ignoredFiles := map[string]bool{
 		"apple-touch-icon-152x152-precomposed.png": true,
@@ -108,10 +323,6 @@ func (a *App) index() http.HandlerFunc {
 		"apple-touch-icon.png":                     true,
 		"favicon.ico":                              true,
 	}
-	var data struct {
-		User  *User
-		Links []Link
-	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(userContextKey).(*User)
@@ -119,15 +330,7 @@ func (a *App) index() http.HandlerFunc {
 		rawLink := strings.TrimSpace(r.URL.String())[1:]
 		// show list of links
 		if len(rawLink) == 0 {
-			links, err := a.db.Links(r.Context(), user)
-			if err != nil {
-				http.Error(w, "cannot get links from database", http.StatusBadRequest)
-			}
-
-			data.User = user
-			data.Links = links
-
-			render(w, tpl, data)
+			a.renderLinks(w, r, tpl, user, "")
 			return
 		}
 
@@ -137,26 +340,32 @@ func (a *App) index() http.HandlerFunc {
 			return
 		}
 
-		// fix https:/example.com - single :/ after scheme
-		if strings.Contains(rawLink, ":/") && !strings.Contains(rawLink, "://") {
-			rawLink = strings.Join(strings.SplitN(rawLink, ":/", 2), "://")
-		}
-
-		if !strings.HasPrefix(rawLink, "http") {
-			rawLink = "http://" + rawLink
-		}
-		if len(rawLink) < 10 {
+		linkURL, err := parseLink(rawLink)
+		if err == errLinkTooShort {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-
-		url, err := url.Parse(rawLink)
 		if err != nil {
 			http.Error(w, "link is not valid ", http.StatusBadRequest)
+			return
+		}
+
+		// Only pin right away if the user typed the address or followed a
+		// link on pinub. Any other site could embed the address in an
+		// <img src>, so those requests have to be confirmed in the form.
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "none" && site != "same-origin" {
+			http.Redirect(w, r, "/pin?url="+url.QueryEscape(linkURL), http.StatusSeeOther)
+			return
+		}
+
+		if a.restricted(user, true) {
+			a.flash(w, "please confirm your email address first")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
 		}
 
 		link := &Link{
-			URL: url.String(),
+			URL: linkURL,
 		}
 
 		if err := a.db.Addlink(r.Context(), user, link); err != nil {
@@ -164,66 +373,142 @@ func (a *App) index() http.HandlerFunc {
 			return
 		}
 
+		a.flash(w, "link pinned")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
 }
 
+var errLinkTooShort = errors.New("link is too short")
+
+// parseLink turns whatever the user typed after pinub's hostname into a
+// link.
+func parseLink(rawLink string) (string, error) {
+	// fix https:/example.com - single :/ after scheme
+	if strings.Contains(rawLink, ":/") && !strings.Contains(rawLink, "://") {
+		rawLink = strings.Join(strings.SplitN(rawLink, ":/", 2), "://")
+	}
+
+	if !strings.HasPrefix(rawLink, "http") {
+		rawLink = "http://" + rawLink
+	}
+	if len(rawLink) < 10 {
+		return "", errLinkTooShort
+	}
+
+	u, err := url.Parse(rawLink)
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
 func (a *App) home() http.HandlerFunc {
-	tpl, _ := template.ParseFS(tpls, "templates/home.html", layoutTpl)
+	tpl, _ := template.New("home.html").Funcs(funcs).ParseFS(tpls, "templates/home.html", layoutTpl)
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		render(w, tpl, nil)
+		render(w, r, tpl, nil)
 	}
 }
 
 func (a *App) signin() http.HandlerFunc {
-	tpl, _ := template.ParseFS(tpls, "templates/signin.html", layoutTpl)
+	tpl, _ := template.New("signin.html").Funcs(funcs).ParseFS(tpls, "templates/signin.html", layoutTpl)
+
+	type signinData struct {
+		*form
+		MagicLinks bool
+		OIDCName   string
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		f := newForm(r)
+		data := signinData{f, a.MagicLinks, ""}
+		if a.OIDC != nil {
+			data.OIDCName = a.OIDCName
+		}
+
 		// show form
 		if r.Method == http.MethodGet {
-			render(w, tpl, nil)
+			render(w, r, tpl, data)
 			return
 		}
 
 		// check for valid email
-		mail, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+		mail, err := mail.ParseAddress(f.Value("email"))
 		if err != nil {
-			http.Error(w, "email address is not valid", http.StatusBadRequest)
+			f.Fail("email", "email address is not valid")
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, data)
 			return
 		}
 
-		// check if user is already present
-		user, err := a.db.ByEmail(r.Context(), mail.Address)
-		if err != nil {
-			http.Error(w, "email is unknown", http.StatusBadRequest)
+		// the attempt counts from here, so parallel requests cannot try
+		// more passwords than the limits allow
+		ip, email := a.clientIP(r), strings.ToLower(mail.Address)
+		wait := a.ipFailures.Begin(ip)
+		if wait == 0 {
+			if wait = a.emailFailures.Begin(email); wait > 0 {
+				a.ipFailures.End(r.Context(), ip, false)
+			}
+		}
+		if wait > 0 {
+			wait = wait.Truncate(time.Second) + time.Second
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+			f.Fail("password", "too many failed attempts, try again in "+wait.String())
+			renderStatus(w, r, http.StatusTooManyRequests, tpl, data)
 			return
 		}
 
-		pass := strings.TrimSpace(r.FormValue("password"))
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(pass)); err != nil {
-			http.Error(w, "password not valid", http.StatusBadRequest)
+		// unknown addresses take as long as wrong passwords and fail with
+		// the same error, so they do not tell who has an account
+		user, err := a.db.ByEmail(r.Context(), mail.Address)
+		hash := a.dummyHash
+		if err == nil && user.Password != "" {
+			hash = user.Password
+		}
+		valid, verr := password.Verify(f.Value("password"), hash)
+		if verr != nil {
+			slog.Error("cannot verify password", verr)
+		}
+		failed := !valid || err != nil || user.Password == ""
+		a.ipFailures.End(r.Context(), ip, failed)
+		a.emailFailures.End(r.Context(), email, failed)
+		if failed {
+			if err != nil {
+				// nobody to tell about it, only admins see it
+				a.audit(r, nil, nil, "signin.failed", "password for unknown "+email)
+			} else {
+				a.audit(r, nil, user, "signin.failed", "password")
+			}
+			f.Fail("password", "email or password not valid")
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, data)
 			return
 		}
+		a.emailFailures.Reset(r.Context(), email)
 
-		// create token
-		if err := a.db.CreateToken(r.Context(), user); err != nil {
-			http.Error(w, "cannot create token", http.StatusBadRequest)
+		if user.Disabled() {
+			a.audit(r, user, user, "signin.failed", "account is disabled")
+			f.Fail("password", errDisabled.Error())
+			renderStatus(w, r, http.StatusForbidden, tpl, data)
 			return
 		}
 
-		// set the cookie
-		cookie := http.Cookie{
-			Name:     cookieName,
-			Value:    user.Token,
-			Path:     "/",
-			MaxAge:   cookieMaxAge,
-			HttpOnly: true,
-			Secure:   false,
-			SameSite: http.SameSiteStrictMode,
+		// move the password to the preferred hash while it is at hand
+		if a.Hasher.NeedsRehash(user.Password) {
+			if hash, err := a.Hasher.Hash(f.Value("password")); err != nil {
+				slog.Error("cannot hash password", err)
+			} else if err := a.db.UpdatePassword(r.Context(), user, hash); err != nil {
+				slog.Error("cannot update password", err)
+			}
+		}
+
+		remember := len(f.Value("remember")) > 0
+		if user.TwoFactor() {
+			a.startSecondFactor(w, r, user, remember)
+			return
 		}
-		if err := cookies.WriteEncrypted(w, cookie, a.SecretKey); err != nil {
-			http.Error(w, "cannot save cookie", http.StatusBadRequest)
+
+		if err := a.startSession(w, r, user, remember, "password"); err != nil {
+			http.Error(w, "cannot create session", http.StatusBadRequest)
 			return
 		}
 
@@ -233,6 +518,13 @@ func (a *App) signin() http.HandlerFunc {
 
 func (a *App) signout() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		if err := a.db.DeleteToken(r.Context(), user.Token); err != nil {
+			slog.Error("cannot delete token", err)
+		}
+		a.audit(r, user, user, "signout", "")
+
 		if cookie, err := r.Cookie(cookieName); err == nil { // if NO error
 			// remove cookie
 			cookie.MaxAge = -1
@@ -244,123 +536,228 @@ func (a *App) signout() http.HandlerFunc {
 }
 
 func (a *App) register() http.HandlerFunc {
-	tpl, _ := template.ParseFS(tpls, "templates/register.html", layoutTpl)
+	tpl, _ := template.New("register.html").Funcs(funcs).ParseFS(tpls, "templates/register.html", layoutTpl)
+
+	type registerData struct {
+		*form
+		Registration string
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		f := newForm(r)
+		data := registerData{f, a.registration()}
+
 		// show form
 		if r.Method == http.MethodGet {
-			render(w, tpl, nil)
+			render(w, r, tpl, data)
+			return
+		}
+		if data.Registration == RegistrationClosed {
+			renderStatus(w, r, http.StatusForbidden, tpl, data)
 			return
 		}
 
+		invite := f.Value("invite")
+		if data.Registration == RegistrationInvite {
+			ok, err := a.db.InviteUsable(r.Context(), invite)
+			if err != nil {
+				http.Error(w, "cannot get invite from database", http.StatusBadRequest)
+				return
+			}
+			if !ok {
+				f.Fail("invite", "invite code is not valid or used up")
+			}
+		}
+
 		// check for password equals second password
-		password := strings.TrimSpace(r.FormValue("password"))
-		passrepa := strings.TrimSpace(r.FormValue("passrepa"))
-		if len(password) < 3 {
-			http.Error(w, "password is too short", http.StatusBadRequest)
-			return
+		password := f.Value("password")
+		if err := a.Passwords.Check(password, f.Value("email")); err != nil {
+			f.Fail("password", err.Error())
 		}
-		if password != passrepa {
-			http.Error(w, "passwords do not match", http.StatusBadRequest)
-			return
+		if password != f.Value("passrepa") {
+			f.Fail("passrepa", "passwords do not match")
 		}
 		// check for valid email
-		mail, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+		mail, err := mail.ParseAddress(f.Value("email"))
 		if err != nil {
-			http.Error(w, "email address is not valid", http.StatusBadRequest)
-			return
+			f.Fail("email", "email address is not valid")
+		} else if _, err := a.db.ByEmail(r.Context(), mail.Address); err == nil {
+			// user is already present
+			f.Fail("email", "email already in database")
 		}
 
-		// check if user is already present
-		user, err := a.db.ByEmail(r.Context(), mail.Address)
-		if user != nil {
-			http.Error(w, "email already in database", http.StatusBadRequest)
+		if !f.Valid() {
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, data)
 			return
 		}
 
 		// hash password
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		user = &User{
+		hash, err := a.Hasher.Hash(password)
+		if err != nil {
+			http.Error(w, "cannot hash password", http.StatusBadRequest)
+			return
+		}
+		user := &User{
 			Email:    mail.Address,
-			Password: string(hash),
+			Password: hash,
 		}
 
 		// create user
-		if err := a.db.CreateUser(r.Context(), user); err != nil {
+		if data.Registration == RegistrationInvite {
+			err = a.db.CreateInvitedUser(r.Context(), user, invite)
+		} else {
+			err = a.db.CreateUser(r.Context(), user)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			// somebody else used the invite up meanwhile
+			f.Fail("invite", "invite code is not valid or used up")
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, data)
+			return
+		}
+		if err != nil {
 			http.Error(w, "cannot create user", http.StatusBadRequest)
 			return
 		}
 
-		// create token
-		if err := a.db.CreateToken(r.Context(), user); err != nil {
-			http.Error(w, "cannot create token", http.StatusBadRequest)
+		a.audit(r, user, user, "register", "")
+		if err := a.startSession(w, r, user, true, "registration"); err != nil {
+			http.Error(w, "cannot create session", http.StatusBadRequest)
 			return
 		}
 
-		// set the cookie
-		cookie := http.Cookie{
-			Name:     cookieName,
-			Value:    user.Token,
-			Path:     "/",
-			MaxAge:   cookieMaxAge,
-			HttpOnly: true,
-			Secure:   false,
-			SameSite: http.SameSiteLaxMode,
-		}
-		if err := cookies.WriteEncrypted(w, cookie, a.SecretKey); err != nil {
-			http.Error(w, "cannot save cookie", http.StatusBadRequest)
+		a.startVerification(r, user, user.Email)
+
+		a.flash(w, "welcome to pinub, please confirm your email address with the link sent to "+user.Email)
+		if a.restricted(user, false) {
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
 			return
 		}
-
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
 }
 
 func (a *App) profile() http.HandlerFunc {
-	tpl, _ := template.ParseFS(tpls, "templates/profile.html", layoutTpl)
+	tpl, _ := template.New("profile.html").Funcs(funcs).ParseFS(tpls, "templates/profile.html", layoutTpl)
+
+	type profileData struct {
+		*User
+		Form        *form
+		Bookmarklet template.URL
+		// PendingEmail is the address the user wants to change to.
+		PendingEmail string
+		// RecoveryCodes is the number of unused recovery codes.
+		RecoveryCodes int
+		Passkeys      []Passkey
+		// DeletionGrace is how long a deleted account is kept.
+		DeletionGrace string
+		// CanInvite tells whether the user may create Invites.
+		CanInvite bool
+		Invites   []Invite
+		// Events is the recent activity of the account.
+		Events []AuditEvent
+		// SharedTags are the tags shared on their own.
+		SharedTags []TagShare
+		// Confirmed tells whether a user without a password may change
+		// their account right now, OIDCName how they sign in again if not.
+		Confirmed bool
+		OIDCName  string
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(userContextKey).(*User)
+		f := newForm(r)
+		data := profileData{user, f, bookmarklet(a.absURL(r, "/pin")), "", 0, nil, inWords(a.DeletionGrace),
+			a.usersInvite(), nil, nil, nil, a.recentlyConfirmed(r, user), ""}
+		if a.OIDC != nil {
+			data.OIDCName = a.OIDCName
+		}
+
+		pending, err := a.db.PendingEmail(r.Context(), user)
+		if err != nil {
+			http.Error(w, "cannot get pending email from database", http.StatusBadRequest)
+			return
+		}
+		data.PendingEmail = pending
+
+		if data.Passkeys, err = a.db.Passkeys(r.Context(), user); err != nil {
+			http.Error(w, "cannot get passkeys from database", http.StatusBadRequest)
+			return
+		}
+		if data.Events, err = a.db.AuditEvents(r.Context(), user.ID, recentAuditEvents, 0); err != nil {
+			http.Error(w, "cannot get audit events from database", http.StatusBadRequest)
+			return
+		}
+		if data.SharedTags, err = a.db.TagShares(r.Context(), user); err != nil {
+			http.Error(w, "cannot get shared tags from database", http.StatusBadRequest)
+			return
+		}
+		if data.CanInvite {
+			if data.Invites, err = a.db.Invites(r.Context(), user.ID); err != nil {
+				http.Error(w, "cannot get invites from database", http.StatusBadRequest)
+				return
+			}
+		}
+		if user.TwoFactor() {
+			if data.RecoveryCodes, err = a.db.RecoveryCodes(r.Context(), user); err != nil {
+				http.Error(w, "cannot get recovery codes from database", http.StatusBadRequest)
+				return
+			}
+		}
 
 		if r.Method == http.MethodGet {
-			render(w, tpl, user)
+			render(w, r, tpl, data)
 			return
 		}
 
 		// check for valid password
-		pass := strings.TrimSpace(r.FormValue("pass"))
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(pass)); err != nil {
-			http.Error(w, "password not valid", http.StatusBadRequest)
-			return
+		if !a.confirmed(r, user, f.Value("pass")) {
+			f.Fail("pass", confirmFailure(user))
 		}
 
-		// update email
-		mail, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+		// check for valid email
+		mail, err := mail.ParseAddress(f.Value("email"))
 		if err != nil {
-			http.Error(w, "cannot parse email", http.StatusBadRequest)
-			return
+			f.Fail("email", "email address is not valid")
+		} else if other, err := a.db.ByEmail(r.Context(), mail.Address); err == nil && other.ID != user.ID {
+			f.Fail("email", "email already in database")
+		}
+
+		newpass := f.Value("newpass")
+		if len(newpass) > 0 {
+			if err := a.Passwords.Check(newpass, user.Email, f.Value("email")); err != nil {
+				f.Fail("newpass", err.Error())
+			}
 		}
-		if err := a.db.UpdateEmail(r.Context(), user, mail.Address); err != nil {
-			http.Error(w, "cannot update email", http.StatusBadRequest)
+
+		if !f.Valid() {
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, data)
 			return
 		}
 
+		// the new email takes effect once it is confirmed
+		notice := "profile updated"
+		if mail.Address != user.Email {
+			a.startVerification(r, user, mail.Address)
+			notice = "profile updated, confirm your new email address with the link sent to " + mail.Address
+		}
+
 		// update password
-		newpass := strings.TrimSpace(r.FormValue("newpass"))
 		if len(newpass) > 0 {
 			// hash password
-			hash, err := bcrypt.GenerateFromPassword([]byte(newpass), bcrypt.DefaultCost)
+			hash, err := a.Hasher.Hash(newpass)
 			if err != nil {
 				http.Error(w, "cannot hash password", http.StatusBadRequest)
 				return
 			}
 
-			if err := a.db.UpdatePassword(r.Context(), user, string(hash)); err != nil {
+			if err := a.db.UpdatePassword(r.Context(), user, hash); err != nil {
 				http.Error(w, "cannot update password", http.StatusBadRequest)
 				return
 			}
+			a.audit(r, user, user, "password.change", "")
 		}
 
+		a.flash(w, notice)
 		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 	}
 }
@@ -376,21 +773,67 @@ func healthz(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+var errDisabled = errors.New("account is disabled")
+
+// startSession signs the user in on the device of the request. Method is
+// how they proved who they are, for the audit log.
+func (a *App) startSession(w http.ResponseWriter, r *http.Request, user *User, remember bool, method string) error {
+	if user.Disabled() {
+		return errDisabled
+	}
+
+	login := &Login{
+		UserAgent: r.UserAgent(),
+		IP:        a.clientIP(r),
+		Remember:  remember,
+	}
+	if err := a.db.CreateToken(r.Context(), user, login); err != nil {
+		return err
+	}
+	a.audit(r, user, user, "signin", method)
+	if err := a.setConfirmed(w, user); err != nil {
+		return err
+	}
+
+	return a.setSessionCookie(w, user)
+}
+
+// setSessionCookie hands the session token of the user to the browser. Only
+// remembered sessions survive closing the browser.
+func (a *App) setSessionCookie(w http.ResponseWriter, user *User) error {
+	cookie := http.Cookie{
+		Name:     cookieName,
+		Value:    user.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !a.InsecureDev,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if user.Remember {
+		cookie.MaxAge = cookieMaxAge
+	}
+
+	return cookies.WriteEncrypted(w, cookie, a.Keys)
+}
+
 func (a *App) auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if token, err := cookies.ReadEncrypted(r, cookieName, a.SecretKey); err == nil { // if NO error
+		// the proxy signs users in on every request, no cookie needed
+		if len(a.ProxyHeader) > 0 && a.fromTrustedProxy(r) {
+			if user := a.proxyUser(r.Context(), r); user != nil {
+				ctx := context.WithValue(r.Context(), userContextKey, user)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token, err := cookies.ReadEncrypted(r, cookieName, a.Keys); err == nil { // if NO error
 			if user, err := a.db.ByToken(r.Context(), token); err == nil { // of NO error
 				// extend the cookie
-				cookie := http.Cookie{
-					Name:     cookieName,
-					Value:    user.Token,
-					Path:     "/",
-					MaxAge:   cookieMaxAge,
-					HttpOnly: true,
-					Secure:   false,
-					SameSite: http.SameSiteLaxMode,
-				}
-				if err := cookies.WriteEncrypted(w, cookie, a.SecretKey); err != nil {
+				if err := a.setSessionCookie(w, user); err != nil {
 					slog.Error("cannot save cookie", err)
 				}
 
@@ -437,14 +880,89 @@ func private(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-func render(w http.ResponseWriter, tpl *template.Template, data interface{}) {
+func render(w http.ResponseWriter, r *http.Request, tpl *template.Template, data interface{}) {
+	renderStatus(w, r, http.StatusOK, tpl, data)
+}
+
+// renderStatus renders the template like render, but responds with status.
+func renderStatus(w http.ResponseWriter, r *http.Request, status int, tpl *template.Template, data interface{}) {
+	// templates that have been executed cannot be cloned anymore, so tpl
+	// itself is never executed.
+	tpl, err := tpl.Clone()
+	if err != nil {
+		slog.Error("error cloning template", err)
+		return
+	}
+	token, _ := r.Context().Value(csrfContextKey).(string)
+	notice := ""
+	if pop, ok := r.Context().Value(flashContextKey).(func() string); ok {
+		notice = pop()
+	}
+	tpl.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` +
+				template.HTMLEscapeString(token) + `">`)
+		},
+		"flash": func() string {
+			return notice
+		},
+		"signedIn": func() bool {
+			_, ok := r.Context().Value(userContextKey).(*User)
+			return ok
+		},
+	})
+
 	w.Header().Set("Content-Type", "text/html; charset=utf8")
+	w.WriteHeader(status)
 
 	if err := tpl.Execute(w, data); err != nil {
 		slog.Error("error executing template", err)
 	}
 }
 
+// renderCached renders the template like render, but lets shared caches
+// store the page and answers conditional requests. The ETag is derived from
+// the rendered page, so hiding a pin invalidates it even though modtime
+// stays the same.
+func renderCached(w http.ResponseWriter, r *http.Request, tpl *template.Template, data interface{}, modtime time.Time) {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		slog.Error("error executing template", err)
+		http.Error(w, "cannot render page", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", "text/html; charset=utf8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(buf.Bytes()))
+}
+
+// absURL returns the absolute URL of path on this pinub instance.
+func (a *App) absURL(r *http.Request, path string) string {
+	if len(a.BaseURL) > 0 {
+		return strings.TrimSuffix(a.BaseURL, "/") + path
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + path
+}
+
+// randomToken returns a URL safe string of 32 random bytes.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // statusRecorder is used to overwrite the WriteHeader function in
 // http.ResponseWriter. WriteHeader will save the status code of a request
 // in this struct's status field. Later on we can use this field to log the
@@ -469,7 +987,7 @@ func logreq(next http.Handler) http.Handler {
 
 		next.ServeHTTP(rec, r)
 
-		defer slog.Info(
+		slog.Info(
 			"access",
 			"remote_addr", r.RemoteAddr,
 			"duration", time.Since(start).String(),
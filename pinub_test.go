@@ -0,0 +1,203 @@
+package pinub
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"dab.io/pinub/internal/cookies"
+	"dab.io/pinub/internal/mailer"
+	"dab.io/pinub/internal/password"
+)
+
+// testPassword passes the default password policy.
+const testPassword = "correct horse battery staple"
+
+// newTestApp serves pinub with a new database for the test. Emails go to
+// the returned mailer.
+func newTestApp(t *testing.T) (*App, *httptest.Server, *mailer.Memory) {
+	t.Helper()
+
+	key, err := cookies.NewKey(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mailer.Memory{}
+	a := &App{
+		DSN:         filepath.Join(t.TempDir(), "pinub.sqlite3"),
+		Keys:        cookies.NewKeyring(key),
+		InsecureDev: true,
+		Mailer:      m,
+		// hashing fast keeps the tests quick
+		Hasher: &password.Hasher{
+			Algorithm: password.Argon2id,
+			Argon2:    password.Argon2Params{Memory: 64, Time: 1, Threads: 1},
+		},
+	}
+
+	db, err := OpenDB(a.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.NotFoundHandler())
+	a.BaseURL = srv.URL
+	handler, err := a.setup(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Handler = handler
+	t.Cleanup(func() {
+		srv.Close()
+		a.stopWork()
+		a.workers.Wait()
+		db.Close()
+	})
+
+	return a, srv, m
+}
+
+// createUser stores a confirmed user with testPassword.
+func createUser(t *testing.T, a *App, email string) *User {
+	t.Helper()
+
+	hash, err := a.Hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	user := &User{Email: email, Password: hash, VerifiedAt: &now}
+	if err := a.db.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// waitForMail waits for the background work sending emails and returns
+// the last email sent.
+func waitForMail(t *testing.T, a *App, m *mailer.Memory) mailer.Message {
+	t.Helper()
+
+	a.workers.Wait()
+	msg, ok := m.Last()
+	if !ok {
+		t.Fatal("no email sent")
+	}
+
+	return msg
+}
+
+// testClient is a browser with its own cookies.
+type testClient struct {
+	t   *testing.T
+	srv *httptest.Server
+	*http.Client
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &testClient{t: t, srv: srv, Client: client}
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// get returns the status and body of the page at path.
+func (c *testClient) get(path string) (int, string) {
+	c.t.Helper()
+
+	resp, err := c.Get(c.srv.URL + path)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(body)
+}
+
+// csrfToken returns the CSRF token of the browser.
+func (c *testClient) csrfToken() string {
+	c.t.Helper()
+
+	_, body := c.get("/signin")
+	match := csrfFieldPattern.FindStringSubmatch(body)
+	if match == nil {
+		c.t.Fatal("no CSRF token on the sign in page")
+	}
+
+	return match[1]
+}
+
+// post submits the form to path like a form of pinub and returns the
+// response with its body read.
+func (c *testClient) post(path string, form url.Values) (*http.Response, string) {
+	c.t.Helper()
+
+	form.Set(csrfField, c.csrfToken())
+	resp, err := c.PostForm(c.srv.URL+path, form)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	return resp, string(body)
+}
+
+// postJSON sends body to path like the scripts of pinub do.
+func (c *testClient) postJSON(path, body string) (*http.Response, string) {
+	c.t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, c.srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set(csrfHeader, c.csrfToken())
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+
+	return resp, string(data)
+}
+
+// signIn signs in with email and testPassword.
+func (c *testClient) signIn(email string) {
+	c.t.Helper()
+
+	resp, body := c.post("/signin", url.Values{"email": {email}, "password": {testPassword}})
+	if resp.StatusCode != http.StatusSeeOther {
+		c.t.Fatalf("sign in: %s %s", resp.Status, body)
+	}
+}
+
+// signedIn reports whether the browser has a session.
+func (c *testClient) signedIn() bool {
+	c.t.Helper()
+
+	status, _ := c.get("/profile")
+
+	return status == http.StatusOK
+}
@@ -0,0 +1,122 @@
+package pinub
+
+import (
+	"context"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// fromTrustedProxy reports whether the request comes straight from one of
+// the TrustedProxies. Only they may tell who the user is.
+func (a *App) fromTrustedProxy(r *http.Request) bool {
+	addr, ok := remoteAddr(r)
+
+	return ok && containsAddr(a.TrustedProxies, addr)
+}
+
+// clientIP returns the IP address the request was sent from. Requests from
+// ReverseProxies are sent by the right-most address in X-Forwarded-For that
+// is not one of the proxies, or else by the address in Fly-Client-IP. The
+// addresses left of it were sent by the client and prove nothing.
+func (a *App) clientIP(r *http.Request) string {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !containsAddr(a.ReverseProxies, addr) {
+		return addr.String()
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !containsAddr(a.ReverseProxies, addr) {
+				break
+			}
+		}
+
+		return addr.String()
+	}
+	if client, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("Fly-Client-IP"))); err == nil {
+		return client.Unmap().String()
+	}
+
+	return addr.String()
+}
+
+// remoteAddr returns the address the request came straight from.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addrPort.Addr().Unmap(), true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyUser returns the user the trusted proxy signed in, as named in the
+// ProxyHeader. Users are created the first time the proxy names them. It
+// returns nil if the header is empty or not an email address.
+func (a *App) proxyUser(ctx context.Context, r *http.Request) *User {
+	value := r.Header.Get(a.ProxyHeader)
+	if len(value) == 0 {
+		return nil
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		slog.Warn("proxy sent an invalid email address", "header", a.ProxyHeader, "value", value)
+		return nil
+	}
+
+	user, err := a.db.ByEmail(ctx, addr.Address)
+	if err != nil {
+		// the proxy vouches for the address
+		now := time.Now()
+		user = &User{Email: addr.Address, VerifiedAt: &now}
+		if err := a.db.CreateUser(ctx, user); err != nil {
+			// another request may have created the user meanwhile
+			if user, err = a.db.ByEmail(ctx, addr.Address); err != nil {
+				slog.Error("cannot create user named by proxy", err, "email", addr.Address)
+				return nil
+			}
+		}
+	}
+	if user.Disabled() {
+		return nil
+	}
+
+	return user
+}
+
+// local serves next only if local sign in is allowed. Behind a proxy that
+// signs users in, pinub may leave that to the proxy alone.
+func (a *App) local(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.DisableLocalSignin {
+			http.NotFound(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
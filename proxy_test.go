@@ -0,0 +1,87 @@
+package pinub
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	a := &App{ReverseProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fdaa::/16"),
+	}}
+
+	tests := []struct {
+		remote    string
+		forwarded []string
+		fly       string
+		ip        string
+	}{
+		// not from a proxy, headers are lies
+		{"192.0.2.1:1234", []string{"203.0.113.1"}, "203.0.113.2", "192.0.2.1"},
+		{"[2001:db8::1]:1234", nil, "", "2001:db8::1"},
+		{"[::ffff:192.0.2.1]:1234", nil, "", "192.0.2.1"},
+		// from a proxy
+		{"10.0.0.1:1234", []string{"203.0.113.1"}, "", "203.0.113.1"},
+		{"[fdaa::1]:1234", []string{"203.0.113.1"}, "", "203.0.113.1"},
+		{"10.0.0.1:1234", nil, "203.0.113.2", "203.0.113.2"},
+		{"10.0.0.1:1234", []string{"203.0.113.1"}, "203.0.113.2", "203.0.113.1"},
+		// the client wrote the left hops, the proxies the right ones
+		{"10.0.0.1:1234", []string{"198.51.100.7, 203.0.113.1"}, "", "203.0.113.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.7", "203.0.113.1, 10.0.0.2"}, "", "203.0.113.1"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"10.0.0.1:1234", []string{"203.0.113.1, garbage"}, "", "10.0.0.1"},
+		{"10.0.0.1:1234", nil, "garbage", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+		for _, hops := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", hops)
+		}
+		if len(tt.fly) > 0 {
+			r.Header.Set("Fly-Client-IP", tt.fly)
+		}
+		if ip := a.clientIP(r); ip != tt.ip {
+			t.Errorf("clientIP(%s, %q, %q) = %s, want %s", tt.remote, tt.forwarded, tt.fly, ip, tt.ip)
+		}
+	}
+}
+
+// forwardedFor sends requests as if a reverse proxy forwarded them from
+// the client at addr.
+type forwardedFor string
+
+func (addr forwardedFor) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Forwarded-For", string(addr))
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Clients behind the same reverse proxy fail to sign in on their own.
+func TestSigninBackoffForwarded(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	a.ReverseProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	createUser(t, a, "victim@example.com")
+
+	attacker := newTestClient(t, srv)
+	attacker.Transport = forwardedFor("203.0.113.1")
+	blocked := false
+	for i := 0; i < 30 && !blocked; i++ {
+		// a new address each time, so only the IP address limit applies
+		resp, _ := attacker.post("/signin", url.Values{
+			"email":    {"guess" + string(rune('a'+i)) + "@example.com"},
+			"password": {"wrong"},
+		})
+		blocked = resp.StatusCode == http.StatusTooManyRequests
+	}
+	if !blocked {
+		t.Fatal("attacker never blocked")
+	}
+
+	victim := newTestClient(t, srv)
+	victim.Transport = forwardedFor("203.0.113.2")
+	victim.signIn("victim@example.com")
+}
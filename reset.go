@@ -0,0 +1,138 @@
+package pinub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"dab.io/pinub/internal/mailer"
+	"golang.org/x/exp/slog"
+)
+
+// passwordResetTTL is how long the link in a password reset email works.
+const passwordResetTTL = time.Hour
+
+// forgot sends a link to reset the password to the email address entered.
+// The answer is the same whether or not an account with the address exists.
+func (a *App) forgot() http.HandlerFunc {
+	tpl, _ := template.New("forgot.html").Funcs(funcs).ParseFS(tpls, "templates/forgot.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := newForm(r)
+
+		// show form
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		addr, err := mail.ParseAddress(f.Value("email"))
+		if err != nil {
+			f.Fail("email", "email address is not valid")
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, f)
+			return
+		}
+
+		// Talking to the mail server takes long enough to tell known
+		// addresses from unknown ones, so it happens after answering.
+		resetURL := a.absURL(r, "/reset")
+		a.background(func(ctx context.Context) {
+			if err := a.sendPasswordReset(ctx, addr.Address, resetURL); err != nil {
+				slog.Error("cannot send password reset", err)
+			}
+		})
+
+		a.flash(w, "if an account exists for "+addr.Address+", a link to reset its password is on its way")
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+	}
+}
+
+// sendPasswordReset mails a link to resetURL with a new reset token to the
+// account with the email address, if there is one.
+func (a *App) sendPasswordReset(ctx context.Context, email, resetURL string) error {
+	user, err := a.db.ByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := a.db.CreatePasswordReset(ctx, user, token, passwordResetTTL); err != nil {
+		return err
+	}
+
+	link := resetURL + "?token=" + url.QueryEscape(token)
+	return a.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your pinub password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your pinub account.\n\n"+
+			"To choose a new password, open this link within the next %.0f minutes:\n\n%s\n\n"+
+			"If it was not you, ignore this email and your password stays the same.\n",
+			passwordResetTTL.Minutes(), link),
+	})
+}
+
+// reset sets a new password for the account the reset link was sent to and
+// signs it out everywhere.
+func (a *App) reset() http.HandlerFunc {
+	tpl, _ := template.New("reset.html").Funcs(funcs).ParseFS(tpls, "templates/reset.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// keep the token out of the Referer header of links on the page
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		f := newForm(r)
+		token := f.Value("token")
+
+		user, err := a.db.ByPasswordReset(r.Context(), token)
+		if err != nil {
+			a.flash(w, "the link to reset your password is not valid anymore")
+			http.Redirect(w, r, "/forgot", http.StatusSeeOther)
+			return
+		}
+
+		// show form
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		password := f.Value("password")
+		if err := a.Passwords.Check(password, user.Email); err != nil {
+			f.Fail("password", err.Error())
+		}
+		if password != f.Value("passrepa") {
+			f.Fail("passrepa", "passwords do not match")
+		}
+		if !f.Valid() {
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, f)
+			return
+		}
+
+		hash, err := a.Hasher.Hash(password)
+		if err != nil {
+			http.Error(w, "cannot hash password", http.StatusBadRequest)
+			return
+		}
+		if _, err := a.db.ResetPassword(r.Context(), token, hash); err != nil {
+			a.flash(w, "the link to reset your password is not valid anymore")
+			http.Redirect(w, r, "/forgot", http.StatusSeeOther)
+			return
+		}
+		a.audit(r, user, user, "password.reset", "")
+
+		a.flash(w, "password changed, sign in with your new password")
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,153 @@
+package pinub
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"dab.io/pinub/internal/mailer"
+)
+
+// newPassword passes the default password policy and differs from
+// testPassword.
+const newPassword = "purple elephants juggle tangerines"
+
+var resetLinkPattern = regexp.MustCompile(`/reset\?token=(\S+)`)
+
+// forgot asks for a link to reset the password of email and returns the
+// token in the link.
+func forgot(t *testing.T, a *App, m *mailer.Memory, c *testClient, email string) string {
+	t.Helper()
+
+	resp, body := c.post("/forgot", url.Values{"email": {email}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("forgot password: %s %s", resp.Status, body)
+	}
+	msg := waitForMail(t, a, m)
+	match := resetLinkPattern.FindStringSubmatch(msg.Body)
+	if msg.To != email || match == nil {
+		t.Fatalf("no reset link for %s in email to %s:\n%s", email, msg.To, msg.Body)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// reset sets newPassword with the reset token and returns where the
+// browser is sent after.
+func (c *testClient) reset(token string) string {
+	c.t.Helper()
+
+	resp, body := c.post("/reset", url.Values{"token": {token}, "password": {newPassword}, "passrepa": {newPassword}})
+	if resp.StatusCode != http.StatusSeeOther {
+		c.t.Fatalf("reset password: %s %s", resp.Status, body)
+	}
+
+	return resp.Header.Get("Location")
+}
+
+// signsIn reports whether email and password sign in.
+func (c *testClient) signsIn(email, password string) bool {
+	c.t.Helper()
+
+	resp, _ := c.post("/signin", url.Values{"email": {email}, "password": {password}})
+
+	return resp.StatusCode == http.StatusSeeOther
+}
+
+func TestPasswordReset(t *testing.T) {
+	a, srv, m := newTestApp(t)
+	createUser(t, a, "reset@example.com")
+
+	// signed in elsewhere, and signed out by the reset
+	other := newTestClient(t, srv)
+	other.signIn("reset@example.com")
+
+	c := newTestClient(t, srv)
+	token := forgot(t, a, m, c, "reset@example.com")
+	if status, _ := c.get("/reset?token=" + url.QueryEscape(token)); status != http.StatusOK {
+		t.Fatalf("reset form: %d", status)
+	}
+	if location := c.reset(token); location != "/signin" {
+		t.Fatalf("reset password: redirected to %s", location)
+	}
+
+	if other.signedIn() {
+		t.Error("session survived the password reset")
+	}
+	if c.signsIn("reset@example.com", testPassword) {
+		t.Error("old password still signs in")
+	}
+	if !c.signsIn("reset@example.com", newPassword) {
+		t.Error("new password does not sign in")
+	}
+
+	// the link works once
+	if location := newTestClient(t, srv).reset(token); location != "/forgot" {
+		t.Errorf("reset password again: redirected to %s", location)
+	}
+}
+
+// A reset uses up the other reset links sent to the user as well.
+func TestPasswordResetOtherLinks(t *testing.T) {
+	a, srv, m := newTestApp(t)
+	createUser(t, a, "reset@example.com")
+	c := newTestClient(t, srv)
+
+	first := forgot(t, a, m, c, "reset@example.com")
+	second := forgot(t, a, m, c, "reset@example.com")
+	if c.reset(second) != "/signin" {
+		t.Fatal("reset password failed")
+	}
+	if status, _ := c.get("/reset?token=" + url.QueryEscape(first)); status != http.StatusSeeOther {
+		t.Errorf("earlier reset link still works: %d", status)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	a, srv, m := newTestApp(t)
+	createUser(t, a, "reset@example.com")
+	c := newTestClient(t, srv)
+
+	token := forgot(t, a, m, c, "reset@example.com")
+	_, err := a.db.DB.ExecContext(context.Background(),
+		"UPDATE password_resets SET expires_at = datetime('now', '-1 seconds') WHERE token = $1;", hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := c.get("/reset?token=" + url.QueryEscape(token)); status != http.StatusSeeOther {
+		t.Errorf("expired reset form: %d", status)
+	}
+	if location := c.reset(token); location != "/forgot" {
+		t.Errorf("reset password with expired link: redirected to %s", location)
+	}
+	if !c.signsIn("reset@example.com", testPassword) {
+		t.Error("expired link changed the password")
+	}
+	if n, err := a.db.DeleteExpiredPasswordResets(context.Background()); err != nil || n != 1 {
+		t.Errorf("expired links deleted: %d, %v", n, err)
+	}
+}
+
+// Nobody learns from forgot whether an account exists.
+func TestForgotUnknown(t *testing.T) {
+	a, srv, m := newTestApp(t)
+	createUser(t, a, "reset@example.com")
+	c := newTestClient(t, srv)
+
+	known, _ := c.post("/forgot", url.Values{"email": {"reset@example.com"}})
+	unknown, _ := c.post("/forgot", url.Values{"email": {"unknown@example.com"}})
+	if known.StatusCode != unknown.StatusCode || known.Header.Get("Location") != unknown.Header.Get("Location") {
+		t.Errorf("forgot answers %s for known and %s for unknown addresses", known.Status, unknown.Status)
+	}
+	a.workers.Wait()
+	if msgs := m.Messages(); len(msgs) != 1 || msgs[0].To != "reset@example.com" {
+		t.Errorf("emails sent: %+v", msgs)
+	}
+}
@@ -0,0 +1,100 @@
+package pinub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/exp/slog"
+)
+
+// serve answers requests with handler on ListenAddress and runs the
+// janitor until ctx is done. Then it shuts down in order: it stops the
+// janitor, stops taking requests, lets running requests finish and waits
+// for the background work they started. Everything together may take
+// ShutdownTimeout, after that running requests are cut off and background
+// work is cancelled. serve returns only after all background work ended,
+// so the database can be closed then.
+func (a *App) serve(ctx context.Context, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:              a.ListenAddress,
+		Handler:           handler,
+		ReadHeaderTimeout: a.ReadHeaderTimeout,
+		ReadTimeout:       a.ReadTimeout,
+		WriteTimeout:      a.WriteTimeout,
+		IdleTimeout:       a.IdleTimeout,
+	}
+	ln, err := net.Listen("tcp", a.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	a.background(func(context.Context) {
+		a.janitor(janitorCtx, janitorInterval)
+	})
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- srv.Serve(ln)
+	}()
+	slog.Info("starting", "address", ln.Addr().String())
+
+	select {
+	case err := <-failed:
+		stopJanitor()
+		a.stopWork()
+		a.workers.Wait()
+		return fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "timeout", a.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+	defer cancel()
+	stopJanitor()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("requests did not finish in time", err)
+		srv.Close()
+	}
+	if err := <-failed; !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server failed", err)
+	}
+
+	// requests may have left emails to send
+	done := make(chan struct{})
+	go func() {
+		a.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		select {
+		case <-done:
+		default:
+			slog.Warn("background work did not finish in time, cancelling it")
+			a.stopWork()
+			<-done
+		}
+	}
+
+	slog.Info("stopped")
+
+	return nil
+}
+
+// background runs f in a goroutine that shutting down waits for, like for
+// sending emails after answering the request. The context passed to f is
+// cancelled when shutting down takes too long.
+func (a *App) background(f func(ctx context.Context)) {
+	a.workers.Add(1)
+	go func() {
+		defer a.workers.Done()
+		f(a.work)
+	}()
+}
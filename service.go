@@ -2,37 +2,204 @@ package pinub
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Visibility of a user's pin list to visitors without an account.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityPublic   = "public"   // listed under /u/{username}
+	VisibilityUnlisted = "unlisted" // reachable only through /s/{share token}
+)
+
 type User struct {
-	ID        int
-	Email     string
-	Password  string
-	Token     string
-	CreatedAt *time.Time
+	ID         int
+	Email      string
+	Password   string
+	Token      string
+	Remember   bool // session of Token outlives the browser
+	Username   string
+	Visibility string
+	ShareToken string
+	FeedToken  string
+	VerifiedAt *time.Time // nil until the email address is confirmed
+	TOTPSecret string     // empty without two-factor authentication
+	DeleteAt   *time.Time // set while the account is about to be deleted
+	IsAdmin    bool
+	DisabledAt *time.Time // set while the account may not sign in
+	CreatedAt  *time.Time
+}
+
+// TwoFactor reports whether signing in needs a code besides the password.
+func (u *User) TwoFactor() bool {
+	return len(u.TOTPSecret) > 0
+}
+
+// Disabled reports whether an admin disabled the account.
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// Verified reports whether the user confirmed their email address.
+func (u *User) Verified() bool {
+	return u.VerifiedAt != nil
 }
 
 type Link struct {
-	ID        int
-	URL       string
+	ID    int
+	URL   string
+	Title string
+	Notes string
+	// Tags are sorted, see parseTags.
+	Tags      []string
+	Hidden    bool
+	CreatedAt *time.Time
+}
+
+// TagShare is how the pins with a tag are shared with people that have no
+// account, on top of the visibility of all pins of the user.
+type TagShare struct {
+	Tag        string
+	Visibility string
+	ShareToken string
+}
+
+// Login is a session of a user on one device.
+type Login struct {
+	// ID is the hashed session token, safe to show to the user.
+	ID        string
+	UserAgent string
+	IP        string
+	Remember  bool
+	// Current is set for the session of the request listing the logins.
+	Current   bool
+	ActiveAt  *time.Time
+	CreatedAt *time.Time
+}
+
+// Passkey is a WebAuthn credential a user signs in with.
+type Passkey struct {
+	ID           int
+	CredentialID []byte
+	PublicKey    []byte
+	Algorithm    int
+	SignCount    uint32
+	Name         string
+	UsedAt       *time.Time
+	CreatedAt    *time.Time
+}
+
+// UserSummary is a user as listed for admins.
+type UserSummary struct {
+	User
+	Pins int
+	// ActiveAt is when the user last used pinub, nil without sessions.
+	ActiveAt *time.Time
+}
+
+// AuditEvent records who did what to which account.
+type AuditEvent struct {
+	ID int
+	// UserID is the account the event is about, zero if none. User is its
+	// email address, empty if the account is gone.
+	UserID int
+	User   string
+	// ActorID is the user who caused the event, zero if unknown. Actor is
+	// their email address.
+	ActorID   int
+	Actor     string
+	Action    string
+	Detail    string
+	IP        string
+	UserAgent string
+	CreatedAt *time.Time
+}
+
+// Invite is a code that lets people register while registration is
+// invite-only.
+type Invite struct {
+	ID   int
+	Code string
+	// CreatedBy is the user who created the invite, zero from the command
+	// line. Creator is their email address.
+	CreatedBy int
+	Creator   string
+	// MaxUses is how many accounts may be registered with the code, zero
+	// for any number.
+	MaxUses int
+	Uses    int
+	// ExpiresAt is when the code stops working, nil if it does not.
+	ExpiresAt *time.Time
 	CreatedAt *time.Time
 }
 
+// Identity is an account at an OpenID Connect provider linked to a user.
+type Identity struct {
+	Issuer    string
+	Subject   string
+	CreatedAt *time.Time
+}
+
+// LoginFailure counts the failed sign ins for an IP address or email. Key
+// holds their hash.
+type LoginFailure struct {
+	Key          string
+	Failures     int
+	FailedAt     time.Time
+	BlockedUntil time.Time
+}
+
 type UserService struct {
 	DB *sql.DB
+
+	// IdleTimeout ends sessions that have not been used for this long.
+	IdleTimeout time.Duration
+	// Lifetime ends sessions this long after sign in, however active they
+	// are. Zero durations disable the respective limit.
+	Lifetime time.Duration
+}
+
+// unexpired is the condition on the logins table l that holds for sessions
+// within IdleTimeout and Lifetime, given as $1 and $2 in seconds.
+const unexpired = "($1 = 0 OR l.active_at > datetime('now', '-' || $1 || ' seconds')) " +
+	" AND ($2 = 0 OR l.created_at > datetime('now', '-' || $2 || ' seconds'))"
+
+func (us *UserService) limits() (idle, lifetime int64) {
+	return int64(us.IdleTimeout.Seconds()), int64(us.Lifetime.Seconds())
+}
+
+// userColumns are the columns of the users table scanned by scanUser.
+const userColumns = "u.id, u.email, COALESCE(u.password, ''), COALESCE(u.username, ''), u.visibility, " +
+	"COALESCE(u.share_token, ''), COALESCE(u.feed_token, ''), u.verified_at, " +
+	"COALESCE(u.totp_secret, ''), u.delete_at, u.is_admin, u.disabled_at, u.created_at"
+
+func scanUser(row *sql.Row, user *User, dest ...any) error {
+	return row.Scan(append([]any{&user.ID, &user.Email, &user.Password, &user.Username,
+		&user.Visibility, &user.ShareToken, &user.FeedToken, &user.VerifiedAt, &user.TOTPSecret, &user.DeleteAt, &user.IsAdmin, &user.DisabledAt, &user.CreatedAt}, dest...)...)
+}
+
+func (us *UserService) ByID(ctx context.Context, id int) (*User, error) {
+	user := &User{}
+
+	query := "SELECT " + userColumns + " FROM users u WHERE u.id = $1 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, id), user)
+
+	return user, err
 }
 
 func (us *UserService) ByEmail(ctx context.Context, email string) (*User, error) {
 	user := &User{}
 
-	query := "SELECT id, email, password, created_at FROM users WHERE email = $1 LIMIT 1;"
-	err := us.DB.
-		QueryRowContext(ctx, query, email).
-		Scan(&user.ID, &user.Email, &user.Password, &user.CreatedAt)
+	query := "SELECT " + userColumns + " FROM users u WHERE u.email = $1 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, email), user)
 
 	return user, err
 }
@@ -40,35 +207,200 @@ func (us *UserService) ByEmail(ctx context.Context, email string) (*User, error)
 func (us *UserService) ByToken(ctx context.Context, token string) (*User, error) {
 	user := &User{}
 
-	query := "SELECT u.id, u.email, u.password, u.created_at, l.token FROM users u " +
-		" JOIN logins l ON u.id = l.user_id AND l.token = $1 LIMIT 1;"
-	err := us.DB.
-		QueryRowContext(ctx, query, token).
-		Scan(&user.ID, &user.Email, &user.Password, &user.CreatedAt, &user.Token)
+	idle, lifetime := us.limits()
+	query := "SELECT " + userColumns + ", l.remember FROM users u " +
+		" JOIN logins l ON u.id = l.user_id AND l.token = $3 WHERE " + unexpired + " AND u.disabled_at IS NULL LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, idle, lifetime, hashToken(token)), user, &user.Remember)
+	user.Token = token
 
 	return user, err
 }
 
-func (us *UserService) CreateUser(ctx context.Context, user *User) error {
-	query := "INSERT INTO users (email, password) VALUES ($1, $2) RETURNING id, created_at;"
+// ByUsername returns the user with the given username, regardless of the
+// visibility of their pins.
+func (us *UserService) ByUsername(ctx context.Context, username string) (*User, error) {
+	user := &User{}
+
+	query := "SELECT " + userColumns + " FROM users u WHERE u.username = $1 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, username), user)
+
+	return user, err
+}
 
+// ByShareToken returns the user owning the unlisted share token.
+func (us *UserService) ByShareToken(ctx context.Context, token string) (*User, error) {
+	user := &User{}
+
+	query := "SELECT " + userColumns + " FROM users u WHERE u.share_token = $1 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, token), user)
+
+	return user, err
+}
+
+const insertUser = "INSERT INTO users (email, password, verified_at) VALUES ($1, NULLIF($2, ''), $3) RETURNING id, created_at;"
+
+// CreateUser stores a new user. Users with an empty password cannot sign in
+// with a password.
+func (us *UserService) CreateUser(ctx context.Context, user *User) error {
 	return us.DB.
-		QueryRowContext(ctx, query, user.Email, user.Password).
+		QueryRowContext(ctx, insertUser, user.Email, user.Password, user.VerifiedAt).
 		Scan(&user.ID, &user.CreatedAt)
 }
 
-func (us *UserService) CreateToken(ctx context.Context, user *User) error {
-	uuid := uuid.NewString()
-	query := "INSERT INTO logins (user_id, token) VALUES ($1, $2) RETURNING token;"
+// CreateInvitedUser stores a new user registered with the invite code, which
+// is used up by one. It returns sql.ErrNoRows if the code does not work
+// (anymore).
+func (us *UserService) CreateInvitedUser(ctx context.Context, user *User, code string) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	return us.DB.
-		QueryRowContext(ctx, query, user.ID, uuid).
-		Scan(&user.Token)
+	var id int
+	query := "UPDATE invites SET uses = uses + 1 WHERE code = $1 AND " + usableInvite + " RETURNING id;"
+	if err := tx.QueryRowContext(ctx, query, code).Scan(&id); err != nil {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, insertUser, user.Email, user.Password, user.VerifiedAt).
+		Scan(&user.ID, &user.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ByIdentity returns the user linked to the subject at the OpenID Connect
+// provider issuer.
+func (us *UserService) ByIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	user := &User{}
+
+	query := "SELECT " + userColumns + " FROM users u " +
+		" JOIN identities i ON u.id = i.user_id AND i.issuer = $1 AND i.subject = $2 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, issuer, subject), user)
+
+	return user, err
+}
+
+// AddIdentity links the subject at the OpenID Connect provider issuer to the
+// user. Identities are linked by an email address the provider confirmed,
+// so the address of the user counts as confirmed too.
+func (us *UserService) AddIdentity(ctx context.Context, user *User, issuer, subject string) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO identities (issuer, subject, user_id) VALUES ($1, $2, $3);"
+	if _, err := tx.ExecContext(ctx, query, issuer, subject, user.ID); err != nil {
+		return err
+	}
+	query = "UPDATE users SET verified_at = COALESCE(verified_at, CURRENT_TIMESTAMP) WHERE id = $1 RETURNING verified_at;"
+	if err := tx.QueryRowContext(ctx, query, user.ID).Scan(&user.VerifiedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// hashToken returns the form of a session token that is stored in the
+// database. A leaked database must not allow to take over sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken starts a new session for the user on the device described by
+// login. The token is set in user.Token and never stored as is.
+func (us *UserService) CreateToken(ctx context.Context, user *User, login *Login) error {
+	token := uuid.NewString()
+	userAgent := login.UserAgent
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+
+	query := "INSERT INTO logins (user_id, token, user_agent, ip, remember) VALUES ($1, $2, $3, $4, $5);"
+	if _, err := us.DB.ExecContext(ctx, query, user.ID, hashToken(token), userAgent, login.IP, login.Remember); err != nil {
+		return err
+	}
+	user.Token = token
+	user.Remember = login.Remember
+
+	return nil
 }
 
 func (us *UserService) UpdateToken(ctx context.Context, token string) error {
 	query := "UPDATE logins SET active_at = datetime('now') WHERE token = $1"
-	_, err := us.DB.ExecContext(ctx, query, token)
+	_, err := us.DB.ExecContext(ctx, query, hashToken(token))
+
+	return err
+}
+
+// DeleteExpiredLogins removes the sessions that ended because of
+// IdleTimeout or Lifetime and returns how many there were.
+func (us *UserService) DeleteExpiredLogins(ctx context.Context) (int64, error) {
+	idle, lifetime := us.limits()
+	query := "DELETE FROM logins AS l WHERE NOT (" + unexpired + ");"
+	res, err := us.DB.ExecContext(ctx, query, idle, lifetime)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteToken ends the session with the given token.
+func (us *UserService) DeleteToken(ctx context.Context, token string) error {
+	query := "DELETE FROM logins WHERE token = $1;"
+	_, err := us.DB.ExecContext(ctx, query, hashToken(token))
+
+	return err
+}
+
+// Logins returns the sessions of the user, most recently active first.
+func (us *UserService) Logins(ctx context.Context, user *User) ([]Login, error) {
+	query := `
+		SELECT l.token, l.user_agent, l.ip, l.remember, l.active_at, l.created_at FROM logins l
+		WHERE l.user_id = $3 AND ` + unexpired + `
+		ORDER BY l.active_at DESC;`
+
+	idle, lifetime := us.limits()
+	rows, err := us.DB.QueryContext(ctx, query, idle, lifetime, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	current := hashToken(user.Token)
+
+	var logins []Login
+	for rows.Next() {
+		var login Login
+		if err := rows.Scan(&login.ID, &login.UserAgent, &login.IP, &login.Remember, &login.ActiveAt, &login.CreatedAt); err != nil {
+			return nil, err
+		}
+		login.Current = login.ID == current
+
+		logins = append(logins, login)
+	}
+
+	return logins, rows.Err()
+}
+
+// DeleteLogin ends one session of the user, identified by Login.ID.
+func (us *UserService) DeleteLogin(ctx context.Context, user *User, id string) error {
+	query := "DELETE FROM logins WHERE user_id = $1 AND token = $2;"
+	_, err := us.DB.ExecContext(ctx, query, user.ID, id)
+
+	return err
+}
+
+// DeleteLogins ends all sessions of the user.
+func (us *UserService) DeleteLogins(ctx context.Context, user *User) error {
+	query := "DELETE FROM logins WHERE user_id = $1;"
+	_, err := us.DB.ExecContext(ctx, query, user.ID)
 
 	return err
 }
@@ -86,35 +418,1067 @@ func (us *UserService) UpdatePassword(ctx context.Context, user *User, password
 
 	return us.DB.
 		QueryRowContext(ctx, query, password, user.ID).
-		Scan(&user.Email)
+		Scan(&user.Password)
 }
 
-func (us *UserService) Links(ctx context.Context, user *User) ([]Link, error) {
-	query := `
-		SELECT l.id, l.url, ul.created_at FROM links l
-		JOIN user_links ul ON l.id = ul.link_id AND ul.user_id = $1
-		ORDER BY ul.created_at DESC;`
+// ByFeedToken returns the user owning the secret token of a private feed.
+func (us *UserService) ByFeedToken(ctx context.Context, token string) (*User, error) {
+	user := &User{}
 
-	rows, err := us.DB.QueryContext(ctx, query, user.ID)
+	query := "SELECT " + userColumns + " FROM users u WHERE u.feed_token = $1 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, token), user)
+
+	return user, err
+}
+
+// UpdateSharing changes the username and the visibility of the user's pins.
+// An empty username removes it.
+func (us *UserService) UpdateSharing(ctx context.Context, user *User, username, visibility string) error {
+	query := "UPDATE users SET username = NULLIF($1, ''), visibility = $2 WHERE id = $3 " +
+		" RETURNING COALESCE(username, ''), visibility;"
+
+	return us.DB.
+		QueryRowContext(ctx, query, username, visibility, user.ID).
+		Scan(&user.Username, &user.Visibility)
+}
+
+// UpdateShareToken replaces the token of the user's unlisted share link. The
+// previous link stops working.
+func (us *UserService) UpdateShareToken(ctx context.Context, user *User, token string) error {
+	query := "UPDATE users SET share_token = $1 WHERE id = $2 RETURNING share_token;"
+
+	return us.DB.
+		QueryRowContext(ctx, query, token, user.ID).
+		Scan(&user.ShareToken)
+}
+
+// UpdateFeedToken replaces the secret token of the user's private feeds.
+// Feed readers subscribed with the previous token lose access.
+func (us *UserService) UpdateFeedToken(ctx context.Context, user *User, token string) error {
+	query := "UPDATE users SET feed_token = $1 WHERE id = $2 RETURNING feed_token;"
+
+	return us.DB.
+		QueryRowContext(ctx, query, token, user.ID).
+		Scan(&user.FeedToken)
+}
+
+// CreatePasswordReset stores the token of a password reset link for the
+// user. The link stops working after ttl.
+func (us *UserService) CreatePasswordReset(ctx context.Context, user *User, token string, ttl time.Duration) error {
+	query := "INSERT INTO password_resets (token, user_id, expires_at) " +
+		" VALUES ($1, $2, datetime('now', '+' || $3 || ' seconds'));"
+	_, err := us.DB.ExecContext(ctx, query, hashToken(token), user.ID, int64(ttl.Seconds()))
+
+	return err
+}
+
+// ByPasswordReset returns the user the unexpired password reset token was
+// created for.
+func (us *UserService) ByPasswordReset(ctx context.Context, token string) (*User, error) {
+	user := &User{}
+
+	query := "SELECT " + userColumns + " FROM users u " +
+		" JOIN password_resets pr ON u.id = pr.user_id AND pr.token = $1 " +
+		" WHERE pr.expires_at > datetime('now') LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, hashToken(token)), user)
+
+	return user, err
+}
+
+// ResetPassword sets the password of the user with a valid password reset
+// token. The token and all other tokens of the user are used up, and all
+// sessions of the user end.
+func (us *UserService) ResetPassword(ctx context.Context, token, password string) (*User, error) {
+	tx, err := us.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var links []Link
-	for rows.Next() {
-		var link Link
-		if err := rows.Scan(&link.ID, &link.URL, &link.CreatedAt); err != nil {
-			return nil, err
-		}
+	user := &User{}
+	query := "DELETE FROM password_resets WHERE token = $1 AND expires_at > datetime('now') RETURNING user_id;"
+	if err := tx.QueryRowContext(ctx, query, hashToken(token)).Scan(&user.ID); err != nil {
+		return nil, err
+	}
 
-		links = append(links, link)
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password = $1 WHERE id = $2;", password, user.ID); err != nil {
+		return nil, err
 	}
-	if err := rows.Err(); err != nil {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = $1;", user.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM logins WHERE user_id = $1;", user.ID); err != nil {
 		return nil, err
 	}
 
-	return links, err
+	return user, tx.Commit()
+}
+
+// DeleteExpiredPasswordResets removes password reset tokens that cannot be
+// used anymore.
+func (us *UserService) DeleteExpiredPasswordResets(ctx context.Context) (int64, error) {
+	query := "DELETE FROM password_resets WHERE expires_at <= datetime('now');"
+	res, err := us.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// CreateMagicLink stores the token of a link that signs the user in without
+// their password. The link works once within ttl.
+func (us *UserService) CreateMagicLink(ctx context.Context, user *User, token string, ttl time.Duration) error {
+	query := "INSERT INTO magic_links (token, user_id, expires_at) " +
+		" VALUES ($1, $2, datetime('now', '+' || $3 || ' seconds'));"
+	_, err := us.DB.ExecContext(ctx, query, hashToken(token), user.ID, int64(ttl.Seconds()))
+
+	return err
+}
+
+// ByMagicLink uses up the unexpired magic link token and returns the user it
+// signs in. Following the link proves the user owns the email address, so
+// the address counts as confirmed.
+func (us *UserService) ByMagicLink(ctx context.Context, token string) (*User, error) {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	query := "DELETE FROM magic_links WHERE token = $1 AND expires_at > datetime('now') RETURNING user_id;"
+	if err := tx.QueryRowContext(ctx, query, hashToken(token)).Scan(&id); err != nil {
+		return nil, err
+	}
+	query = "UPDATE users SET verified_at = CURRENT_TIMESTAMP WHERE id = $1 AND verified_at IS NULL;"
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return nil, err
+	}
+
+	user := &User{}
+	query = "SELECT " + userColumns + " FROM users u WHERE u.id = $1 LIMIT 1;"
+	if err := scanUser(tx.QueryRowContext(ctx, query, id), user); err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
+
+// DeleteExpiredMagicLinks removes magic links that cannot be used anymore.
+func (us *UserService) DeleteExpiredMagicLinks(ctx context.Context) (int64, error) {
+	query := "DELETE FROM magic_links WHERE expires_at <= datetime('now');"
+	res, err := us.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// CreateConfirmation stores the token of a link that confirms a change to
+// the account of a user without a password. The link works once within ttl.
+func (us *UserService) CreateConfirmation(ctx context.Context, user *User, token string, ttl time.Duration) error {
+	query := "INSERT INTO confirmations (token, user_id, expires_at) " +
+		" VALUES ($1, $2, datetime('now', '+' || $3 || ' seconds'));"
+	_, err := us.DB.ExecContext(ctx, query, hashToken(token), user.ID, int64(ttl.Seconds()))
+
+	return err
+}
+
+// UseConfirmation uses up the unexpired confirmation token of the user. It
+// returns sql.ErrNoRows if the token is not theirs or not valid anymore.
+func (us *UserService) UseConfirmation(ctx context.Context, user *User, token string) error {
+	query := "DELETE FROM confirmations WHERE token = $1 AND user_id = $2 AND expires_at > datetime('now') RETURNING user_id;"
+	var id int
+
+	return us.DB.QueryRowContext(ctx, query, hashToken(token), user.ID).Scan(&id)
+}
+
+// DeleteExpiredConfirmations removes confirmation links that cannot be used
+// anymore.
+func (us *UserService) DeleteExpiredConfirmations(ctx context.Context) (int64, error) {
+	query := "DELETE FROM confirmations WHERE expires_at <= datetime('now');"
+	res, err := us.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// CreateEmailVerification stores the token of the link that confirms email
+// as the address of the user. Links sent earlier stop working, and this one
+// works for ttl.
+func (us *UserService) CreateEmailVerification(ctx context.Context, user *User, email, token string, ttl time.Duration) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id = $1;", user.ID); err != nil {
+		return err
+	}
+	query := "INSERT INTO email_verifications (token, user_id, email, expires_at) " +
+		" VALUES ($1, $2, $3, datetime('now', '+' || $4 || ' seconds'));"
+	if _, err := tx.ExecContext(ctx, query, hashToken(token), user.ID, email, int64(ttl.Seconds())); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PendingEmail returns the new address the user asked to change to, if its
+// confirmation link still works.
+func (us *UserService) PendingEmail(ctx context.Context, user *User) (string, error) {
+	var email string
+
+	query := "SELECT email FROM email_verifications " +
+		" WHERE user_id = $1 AND email != $2 AND expires_at > datetime('now') LIMIT 1;"
+	err := us.DB.QueryRowContext(ctx, query, user.ID, user.Email).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return email, err
+}
+
+// VerifyEmail confirms the address the unexpired token was sent to and makes
+// it the email of its user. It returns the user with the confirmed address
+// and the address the user had before.
+func (us *UserService) VerifyEmail(ctx context.Context, token string) (user *User, previous string, err error) {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	user = &User{}
+	query := "DELETE FROM email_verifications WHERE token = $1 AND expires_at > datetime('now') RETURNING user_id, email;"
+	if err := tx.QueryRowContext(ctx, query, hashToken(token)).Scan(&user.ID, &user.Email); err != nil {
+		return nil, "", err
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT email FROM users WHERE id = $1;", user.ID).Scan(&previous); err != nil {
+		return nil, "", err
+	}
+
+	query = "UPDATE users SET email = $1, verified_at = CURRENT_TIMESTAMP WHERE id = $2 RETURNING verified_at;"
+	if err := tx.QueryRowContext(ctx, query, user.Email, user.ID).Scan(&user.VerifiedAt); err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id = $1;", user.ID); err != nil {
+		return nil, "", err
+	}
+
+	return user, previous, tx.Commit()
+}
+
+// CreateEmailRevert stores the token of the link that changes the email
+// of the user back to the previous address. The link works for ttl.
+func (us *UserService) CreateEmailRevert(ctx context.Context, user *User, previous, token string, ttl time.Duration) error {
+	query := "INSERT INTO email_reverts (token, user_id, email, expires_at) " +
+		" VALUES ($1, $2, $3, datetime('now', '+' || $4 || ' seconds'));"
+	_, err := us.DB.ExecContext(ctx, query, hashToken(token), user.ID, previous, int64(ttl.Seconds()))
+
+	return err
+}
+
+// RevertEmail gives the user of the unexpired token back the address the
+// token was sent to. Pending changes of address, password reset links and
+// all sessions of the user end, as whoever changed the address may have
+// them. It returns the user with the restored address.
+func (us *UserService) RevertEmail(ctx context.Context, token string) (*User, error) {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user := &User{}
+	query := "DELETE FROM email_reverts WHERE token = $1 AND expires_at > datetime('now') RETURNING user_id, email;"
+	if err := tx.QueryRowContext(ctx, query, hashToken(token)).Scan(&user.ID, &user.Email); err != nil {
+		return nil, err
+	}
+
+	query = "UPDATE users SET email = $1, verified_at = CURRENT_TIMESTAMP WHERE id = $2 RETURNING verified_at;"
+	if err := tx.QueryRowContext(ctx, query, user.Email, user.ID).Scan(&user.VerifiedAt); err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"email_reverts", "email_verifications", "password_resets", "magic_links", "confirmations", "logins"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = $1;", user.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, tx.Commit()
+}
+
+// DeleteExpiredEmailReverts removes links to restore an email address that
+// cannot be used anymore.
+func (us *UserService) DeleteExpiredEmailReverts(ctx context.Context) (int64, error) {
+	query := "DELETE FROM email_reverts WHERE expires_at <= datetime('now');"
+	res, err := us.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteExpiredEmailVerifications removes confirmation links that cannot be
+// used anymore.
+func (us *UserService) DeleteExpiredEmailVerifications(ctx context.Context) (int64, error) {
+	query := "DELETE FROM email_verifications WHERE expires_at <= datetime('now');"
+	res, err := us.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// EnableTOTP turns on two-factor authentication with the secret. step is the
+// step of the code the user confirmed the secret with. The recovery codes
+// replace any earlier ones.
+func (us *UserService) EnableTOTP(ctx context.Context, user *User, secret string, step int64, codes []string) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET totp_secret = $1, totp_step = $2 WHERE id = $3;"
+	if _, err := tx.ExecContext(ctx, query, secret, step, user.ID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, user, codes); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.TOTPSecret = secret
+
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication and removes the recovery
+// codes of the user.
+func (us *UserService) DisableTOTP(ctx context.Context, user *User) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET totp_secret = NULL, totp_step = 0 WHERE id = $1;"
+	if _, err := tx.ExecContext(ctx, query, user.ID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, user, nil); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.TOTPSecret = ""
+
+	return nil
+}
+
+// UseTOTP records that a code of step was accepted. It reports false if a
+// code of the same or a later step was accepted before.
+func (us *UserService) UseTOTP(ctx context.Context, user *User, step int64) (bool, error) {
+	query := "UPDATE users SET totp_step = $1 WHERE id = $2 AND totp_step < $1;"
+	res, err := us.DB.ExecContext(ctx, query, step, user.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+// ReplaceRecoveryCodes stores new recovery codes for the user. The old ones
+// stop working.
+func (us *UserService) ReplaceRecoveryCodes(ctx context.Context, user *User, codes []string) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, user, codes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, user *User, codes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1;", user.ID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		query := "INSERT INTO recovery_codes (user_id, code) VALUES ($1, $2);"
+		if _, err := tx.ExecContext(ctx, query, user.ID, hashToken(code)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code of the user. It reports false if
+// the user has no such code.
+func (us *UserService) UseRecoveryCode(ctx context.Context, user *User, code string) (bool, error) {
+	query := "DELETE FROM recovery_codes WHERE user_id = $1 AND code = $2;"
+	res, err := us.DB.ExecContext(ctx, query, user.ID, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+// RecoveryCodes returns the number of unused recovery codes of the user.
+func (us *UserService) RecoveryCodes(ctx context.Context, user *User) (int, error) {
+	var n int
+
+	query := "SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1;"
+	err := us.DB.QueryRowContext(ctx, query, user.ID).Scan(&n)
+
+	return n, err
+}
+
+// passkeyColumns are the columns of the passkeys table p in the order of
+// the fields of Passkey.
+const passkeyColumns = "p.id, p.credential_id, p.public_key, p.algorithm, p.sign_count, p.name, p.used_at, p.created_at"
+
+func passkeyFields(pk *Passkey) []any {
+	return []any{&pk.ID, &pk.CredentialID, &pk.PublicKey, &pk.Algorithm, &pk.SignCount, &pk.Name, &pk.UsedAt, &pk.CreatedAt}
+}
+
+// AddPasskey stores a new passkey of the user.
+func (us *UserService) AddPasskey(ctx context.Context, user *User, pk *Passkey) error {
+	query := "INSERT INTO passkeys (user_id, credential_id, public_key, algorithm, sign_count, name) " +
+		" VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at;"
+
+	return us.DB.
+		QueryRowContext(ctx, query, user.ID, pk.CredentialID, pk.PublicKey, pk.Algorithm, pk.SignCount, pk.Name).
+		Scan(&pk.ID, &pk.CreatedAt)
+}
+
+// Passkeys returns the passkeys of the user, the oldest first.
+func (us *UserService) Passkeys(ctx context.Context, user *User) ([]Passkey, error) {
+	query := "SELECT " + passkeyColumns + " FROM passkeys p WHERE p.user_id = $1 ORDER BY p.created_at, p.id;"
+	rows, err := us.DB.QueryContext(ctx, query, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		var pk Passkey
+		if err := rows.Scan(passkeyFields(&pk)...); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, pk)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// ByPasskey returns the user owning the passkey with the WebAuthn credential
+// ID, and the passkey itself.
+func (us *UserService) ByPasskey(ctx context.Context, credentialID []byte) (*User, *Passkey, error) {
+	user, pk := &User{}, &Passkey{}
+
+	query := "SELECT " + userColumns + ", " + passkeyColumns + " FROM users u " +
+		" JOIN passkeys p ON u.id = p.user_id AND p.credential_id = $1 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, credentialID), user, passkeyFields(pk)...)
+
+	return user, pk, err
+}
+
+// UsePasskey records a sign in with the passkey and its new signature
+// counter.
+func (us *UserService) UsePasskey(ctx context.Context, pk *Passkey, signCount uint32) error {
+	query := "UPDATE passkeys SET sign_count = $1, used_at = CURRENT_TIMESTAMP WHERE id = $2;"
+	_, err := us.DB.ExecContext(ctx, query, signCount, pk.ID)
+
+	return err
+}
+
+// DeletePasskey removes a passkey of the user.
+func (us *UserService) DeletePasskey(ctx context.Context, user *User, id int) error {
+	query := "DELETE FROM passkeys WHERE id = $1 AND user_id = $2;"
+	_, err := us.DB.ExecContext(ctx, query, id, user.ID)
+
+	return err
+}
+
+// Identities returns the accounts at OpenID Connect providers linked to the
+// user.
+func (us *UserService) Identities(ctx context.Context, user *User) ([]Identity, error) {
+	query := "SELECT issuer, subject, created_at FROM identities WHERE user_id = $1 ORDER BY created_at;"
+	rows, err := us.DB.QueryContext(ctx, query, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var id Identity
+		if err := rows.Scan(&id.Issuer, &id.Subject, &id.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+
+	return identities, rows.Err()
+}
+
+// ScheduleDeletion deletes the account of the user after grace and signs it
+// out everywhere.
+func (us *UserService) ScheduleDeletion(ctx context.Context, user *User, grace time.Duration) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET delete_at = datetime('now', '+' || $1 || ' seconds') WHERE id = $2 RETURNING delete_at;"
+	if err := tx.QueryRowContext(ctx, query, int64(grace.Seconds()), user.ID).Scan(&user.DeleteAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM logins WHERE user_id = $1;", user.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelDeletion keeps the account of the user.
+func (us *UserService) CancelDeletion(ctx context.Context, user *User) error {
+	if _, err := us.DB.ExecContext(ctx, "UPDATE users SET delete_at = NULL WHERE id = $1;", user.ID); err != nil {
+		return err
+	}
+	user.DeleteAt = nil
+
+	return nil
+}
+
+// DeleteUser deletes the user with everything stored about them. Foreign
+// keys delete the rows referencing the user; what they cannot reach is
+// deleted here: links nobody else pinned, the failed sign ins with the
+// address and the audit events about the user. Details of other events
+// naming the address go as well.
+func (us *UserService) DeleteUser(ctx context.Context, user *User) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "DELETE FROM links WHERE id IN (SELECT link_id FROM user_links WHERE user_id = $1) " +
+		" AND id NOT IN (SELECT link_id FROM user_links WHERE user_id <> $1);"
+	if _, err := tx.ExecContext(ctx, query, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM login_failures WHERE key = $1;", "email:"+hashToken(strings.ToLower(user.Email))); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM audit_events WHERE user_id = $1;", user.ID); err != nil {
+		return err
+	}
+	query = "UPDATE audit_events SET detail = '' WHERE $1 <> '' AND instr(lower(detail), lower($1)) > 0;"
+	if _, err := tx.ExecContext(ctx, query, user.Email); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1;", user.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteScheduledUsers deletes the accounts whose grace period is over and
+// records that in the audit log.
+func (us *UserService) DeleteScheduledUsers(ctx context.Context) (int64, error) {
+	query := "SELECT id, email FROM users WHERE delete_at <= datetime('now');"
+	rows, err := us.DB.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Email); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for i := range users {
+		if err := us.DeleteUser(ctx, &users[i]); err != nil {
+			return n, err
+		}
+		n++
+
+		e := &AuditEvent{UserID: users[i].ID, Action: "account.deleted"}
+		if err := us.AddAuditEvent(ctx, e); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// SearchUsers returns the users whose email or username contain query,
+// oldest first, with their number of pins and last activity.
+func (us *UserService) SearchUsers(ctx context.Context, query string, limit, offset int) ([]UserSummary, error) {
+	// the latest session is joined as a row, so its active_at keeps the
+	// DATETIME type the driver scans into time.Time
+	q := "SELECT " + userColumns + ", " +
+		" (SELECT COUNT(*) FROM user_links ul WHERE ul.user_id = u.id), l.active_at FROM users u " +
+		" LEFT JOIN logins l ON l.rowid = (SELECT l2.rowid FROM logins l2 WHERE l2.user_id = u.id ORDER BY l2.active_at DESC LIMIT 1) " +
+		" WHERE instr(lower(u.email), lower($1)) > 0 OR instr(lower(COALESCE(u.username, '')), lower($1)) > 0 " +
+		" ORDER BY u.id LIMIT $2 OFFSET $3;"
+	rows, err := us.DB.QueryContext(ctx, q, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []UserSummary
+	for rows.Next() {
+		var s UserSummary
+		u := &s.User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Password, &u.Username, &u.Visibility, &u.ShareToken, &u.FeedToken,
+			&u.VerifiedAt, &u.TOTPSecret, &u.DeleteAt, &u.IsAdmin, &u.DisabledAt, &u.CreatedAt, &s.Pins, &s.ActiveAt); err != nil {
+			return nil, err
+		}
+		users = append(users, s)
+	}
+
+	return users, rows.Err()
+}
+
+// SetDisabled disables or enables the account of the user. Disabling signs
+// it out everywhere.
+func (us *UserService) SetDisabled(ctx context.Context, user *User, disabled bool) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET disabled_at = NULL WHERE id = $1 RETURNING disabled_at;"
+	if disabled {
+		query = "UPDATE users SET disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP) WHERE id = $1 RETURNING disabled_at;"
+	}
+	if err := tx.QueryRowContext(ctx, query, user.ID).Scan(&user.DisabledAt); err != nil {
+		return err
+	}
+	if disabled {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM logins WHERE user_id = $1;", user.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SetAdmin grants or revokes the admin role of the user.
+func (us *UserService) SetAdmin(ctx context.Context, user *User, admin bool) error {
+	query := "UPDATE users SET is_admin = $1 WHERE id = $2 RETURNING is_admin;"
+
+	return us.DB.QueryRowContext(ctx, query, admin, user.ID).Scan(&user.IsAdmin)
+}
+
+// AddAuditEvent records the event.
+func (us *UserService) AddAuditEvent(ctx context.Context, e *AuditEvent) error {
+	if len(e.UserAgent) > 256 {
+		e.UserAgent = e.UserAgent[:256]
+	}
+
+	query := "INSERT INTO audit_events (user_id, actor_id, action, detail, ip, user_agent) " +
+		" VALUES (NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5, $6) RETURNING id, created_at;"
+
+	return us.DB.
+		QueryRowContext(ctx, query, e.UserID, e.ActorID, e.Action, e.Detail, e.IP, e.UserAgent).
+		Scan(&e.ID, &e.CreatedAt)
+}
+
+// AuditEvents returns the events about the user with the id userID, or
+// about everyone for zero, newest first. A negative limit returns all.
+func (us *UserService) AuditEvents(ctx context.Context, userID, limit, offset int) ([]AuditEvent, error) {
+	query := "SELECT e.id, COALESCE(e.user_id, 0), COALESCE(u.email, ''), COALESCE(e.actor_id, 0), " +
+		" COALESCE(a.email, ''), e.action, e.detail, e.ip, e.user_agent, e.created_at FROM audit_events e " +
+		" LEFT JOIN users u ON u.id = e.user_id LEFT JOIN users a ON a.id = e.actor_id " +
+		" WHERE $1 = 0 OR e.user_id = $1 ORDER BY e.id DESC LIMIT $2 OFFSET $3;"
+	rows, err := us.DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.User, &e.ActorID, &e.Actor, &e.Action, &e.Detail,
+			&e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// DeleteAuditEvents removes the events older than age.
+func (us *UserService) DeleteAuditEvents(ctx context.Context, age time.Duration) (int64, error) {
+	query := "DELETE FROM audit_events WHERE created_at < datetime('now', '-' || $1 || ' seconds');"
+	res, err := us.DB.ExecContext(ctx, query, int64(age.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// usableInvite is the condition on the invites table that holds for codes
+// that still work.
+const usableInvite = "(max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > datetime('now'))"
+
+// CreateInvite stores the invite with a new random code. The code stops
+// working after ttl, or never for zero.
+func (us *UserService) CreateInvite(ctx context.Context, invite *Invite, ttl time.Duration) error {
+	code, err := randomToken()
+	if err != nil {
+		return err
+	}
+	invite.Code = code
+
+	query := "INSERT INTO invites (code, created_by, max_uses, expires_at) " +
+		" VALUES ($1, NULLIF($2, 0), $3, CASE WHEN $4 > 0 THEN datetime('now', '+' || $4 || ' seconds') END) " +
+		" RETURNING id, expires_at, created_at;"
+
+	return us.DB.
+		QueryRowContext(ctx, query, invite.Code, invite.CreatedBy, invite.MaxUses, int64(ttl.Seconds())).
+		Scan(&invite.ID, &invite.ExpiresAt, &invite.CreatedAt)
+}
+
+// Invites returns the invites created by the user with the id createdBy,
+// newest first, or all invites for zero.
+func (us *UserService) Invites(ctx context.Context, createdBy int) ([]Invite, error) {
+	query := "SELECT i.id, i.code, COALESCE(i.created_by, 0), COALESCE(u.email, ''), i.max_uses, i.uses, " +
+		" i.expires_at, i.created_at FROM invites i LEFT JOIN users u ON u.id = i.created_by " +
+		" WHERE $1 = 0 OR i.created_by = $1 ORDER BY i.id DESC;"
+	rows, err := us.DB.QueryContext(ctx, query, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		var i Invite
+		if err := rows.Scan(&i.ID, &i.Code, &i.CreatedBy, &i.Creator, &i.MaxUses, &i.Uses,
+			&i.ExpiresAt, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+
+	return invites, rows.Err()
+}
+
+// UsableInvites returns how many invites of the user with the id createdBy
+// still work.
+func (us *UserService) UsableInvites(ctx context.Context, createdBy int) (int, error) {
+	var n int
+	query := "SELECT COUNT(*) FROM invites WHERE created_by = $1 AND " + usableInvite + ";"
+	err := us.DB.QueryRowContext(ctx, query, createdBy).Scan(&n)
+
+	return n, err
+}
+
+// InviteUsable reports whether the invite code still works.
+func (us *UserService) InviteUsable(ctx context.Context, code string) (bool, error) {
+	var n int
+	query := "SELECT COUNT(*) FROM invites WHERE code = $1 AND " + usableInvite + ";"
+	err := us.DB.QueryRowContext(ctx, query, code).Scan(&n)
+
+	return n > 0, err
+}
+
+// DeleteInvite deletes the invite with the id if the user with the id
+// createdBy created it, or whoever did for zero.
+func (us *UserService) DeleteInvite(ctx context.Context, createdBy, id int) error {
+	query := "DELETE FROM invites WHERE id = $1 AND ($2 = 0 OR created_by = $2);"
+	_, err := us.DB.ExecContext(ctx, query, id, createdBy)
+
+	return err
+}
+
+// DeleteUsedInvites removes invites that are used up or expired.
+func (us *UserService) DeleteUsedInvites(ctx context.Context) (int64, error) {
+	query := "DELETE FROM invites WHERE NOT (" + usableInvite + ");"
+	res, err := us.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// LoginFailures returns the failures of the keys starting with prefix that
+// failed since.
+func (us *UserService) LoginFailures(ctx context.Context, prefix string, since time.Time) ([]LoginFailure, error) {
+	query := "SELECT key, failures, failed_at, blocked_until FROM login_failures " +
+		" WHERE substr(key, 1, length($1)) = $1 AND failed_at > $2;"
+	rows, err := us.DB.QueryContext(ctx, query, prefix, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []LoginFailure
+	for rows.Next() {
+		var f LoginFailure
+		if err := rows.Scan(&f.Key, &f.Failures, &f.FailedAt, &f.BlockedUntil); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+
+	return failures, rows.Err()
+}
+
+// SaveLoginFailure stores the failures of a key.
+func (us *UserService) SaveLoginFailure(ctx context.Context, f *LoginFailure) error {
+	query := "INSERT INTO login_failures (key, failures, failed_at, blocked_until) VALUES ($1, $2, $3, $4) " +
+		" ON CONFLICT (key) DO UPDATE SET failures = $2, failed_at = $3, blocked_until = $4;"
+	_, err := us.DB.ExecContext(ctx, query, f.Key, f.Failures, f.FailedAt.UTC(), f.BlockedUntil.UTC())
+
+	return err
+}
+
+// DeleteLoginFailure forgets the failures of a key.
+func (us *UserService) DeleteLoginFailure(ctx context.Context, key string) error {
+	_, err := us.DB.ExecContext(ctx, "DELETE FROM login_failures WHERE key = $1;", key)
+
+	return err
+}
+
+// DeleteLoginFailures forgets the keys starting with prefix that did not
+// fail since before.
+func (us *UserService) DeleteLoginFailures(ctx context.Context, prefix string, before time.Time) (int64, error) {
+	query := "DELETE FROM login_failures WHERE substr(key, 1, length($1)) = $1 AND failed_at <= $2;"
+	res, err := us.DB.ExecContext(ctx, query, prefix, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Links returns the links of the user with the tag, including hidden ones.
+// An empty tag returns all links.
+func (us *UserService) Links(ctx context.Context, user *User, tag string) ([]Link, error) {
+	return us.links(ctx, user, true, tag)
+}
+
+// SharedLinks returns the links of the user with the tag that may be shown
+// to others. An empty tag returns all of them.
+func (us *UserService) SharedLinks(ctx context.Context, user *User, tag string) ([]Link, error) {
+	return us.links(ctx, user, false, tag)
+}
+
+// linkColumns selects a link of user_links ul, in the order of scanLink.
+const linkColumns = "l.id, l.url, ul.title, ul.notes, ul.hidden, ul.created_at, " +
+	" COALESCE((SELECT group_concat(lt.tag, ' ') FROM link_tags lt " +
+	" WHERE lt.user_id = ul.user_id AND lt.link_id = ul.link_id), '')"
+
+func scanLink(row interface{ Scan(...any) error }, link *Link) error {
+	var tags string
+	if err := row.Scan(&link.ID, &link.URL, &link.Title, &link.Notes, &link.Hidden, &link.CreatedAt, &tags); err != nil {
+		return err
+	}
+	link.Tags = strings.Fields(tags)
+	sort.Strings(link.Tags)
+
+	return nil
+}
+
+func (us *UserService) links(ctx context.Context, user *User, hidden bool, tag string) ([]Link, error) {
+	query := `
+		SELECT ` + linkColumns + ` FROM links l
+		JOIN user_links ul ON l.id = ul.link_id AND ul.user_id = $1
+		WHERE ($2 OR NOT ul.hidden) AND ($3 = '' OR EXISTS (SELECT 1 FROM link_tags lt
+			WHERE lt.user_id = ul.user_id AND lt.link_id = ul.link_id AND lt.tag = $3))
+		ORDER BY ul.created_at DESC;`
+
+	rows, err := us.DB.QueryContext(ctx, query, user.ID, hidden, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []Link
+	for rows.Next() {
+		var link Link
+		if err := scanLink(rows, &link); err != nil {
+			return nil, err
+		}
+
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return links, err
+}
+
+// Link returns the user's pin of url.
+func (us *UserService) Link(ctx context.Context, user *User, url string) (*Link, error) {
+	link := &Link{}
+
+	query := `
+		SELECT ` + linkColumns + ` FROM links l
+		JOIN user_links ul ON l.id = ul.link_id AND ul.user_id = $1
+		WHERE l.url = $2;`
+	err := scanLink(us.DB.QueryRowContext(ctx, query, user.ID, url), link)
+
+	return link, err
+}
+
+// UpdateLink changes title, notes and tags of one of the user's links.
+func (us *UserService) UpdateLink(ctx context.Context, user *User, link *Link) error {
+	tx, err := us.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE user_links SET title = $1, notes = $2 WHERE user_id = $3 AND link_id = $4;"
+	if _, err := tx.ExecContext(ctx, query, link.Title, link.Notes, user.ID, link.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM link_tags WHERE user_id = $1 AND link_id = $2;", user.ID, link.ID); err != nil {
+		return err
+	}
+	for _, tag := range link.Tags {
+		query := "INSERT OR IGNORE INTO link_tags (user_id, link_id, tag) VALUES ($1, $2, $3);"
+		if _, err := tx.ExecContext(ctx, query, user.ID, link.ID, tag); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Tags returns the tags the user gave their links, sorted.
+func (us *UserService) Tags(ctx context.Context, user *User) ([]string, error) {
+	query := "SELECT DISTINCT tag FROM link_tags WHERE user_id = $1 ORDER BY tag;"
+	rows, err := us.DB.QueryContext(ctx, query, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// TagShare returns how the user shares the tag. Tags that were never shared
+// are private.
+func (us *UserService) TagShare(ctx context.Context, user *User, tag string) (*TagShare, error) {
+	share := &TagShare{Tag: tag, Visibility: VisibilityPrivate}
+
+	query := "SELECT visibility, COALESCE(share_token, '') FROM tag_shares WHERE user_id = $1 AND tag = $2;"
+	err := us.DB.QueryRowContext(ctx, query, user.ID, tag).Scan(&share.Visibility, &share.ShareToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return share, nil
+	}
+
+	return share, err
+}
+
+// TagShares returns the tags the user shares, sorted.
+func (us *UserService) TagShares(ctx context.Context, user *User) ([]TagShare, error) {
+	query := "SELECT tag, visibility, COALESCE(share_token, '') FROM tag_shares " +
+		" WHERE user_id = $1 AND visibility <> $2 ORDER BY tag;"
+	rows, err := us.DB.QueryContext(ctx, query, user.ID, VisibilityPrivate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []TagShare
+	for rows.Next() {
+		var share TagShare
+		if err := rows.Scan(&share.Tag, &share.Visibility, &share.ShareToken); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
+
+// UpdateTagShare changes how the user shares the tag. An empty ShareToken
+// keeps the current one.
+func (us *UserService) UpdateTagShare(ctx context.Context, user *User, share *TagShare) error {
+	query := "INSERT INTO tag_shares (user_id, tag, visibility, share_token) VALUES ($1, $2, $3, NULLIF($4, '')) " +
+		" ON CONFLICT (user_id, tag) DO UPDATE SET visibility = excluded.visibility, " +
+		" share_token = COALESCE(excluded.share_token, tag_shares.share_token) " +
+		" RETURNING COALESCE(share_token, '');"
+
+	return us.DB.
+		QueryRowContext(ctx, query, user.ID, share.Tag, share.Visibility, share.ShareToken).
+		Scan(&share.ShareToken)
+}
+
+// ByTagShareToken returns the user owning the unlisted share token of a tag,
+// and how the tag is shared.
+func (us *UserService) ByTagShareToken(ctx context.Context, token string) (*User, *TagShare, error) {
+	user, share := &User{}, &TagShare{ShareToken: token}
+
+	query := "SELECT " + userColumns + ", ts.tag, ts.visibility FROM users u " +
+		" JOIN tag_shares ts ON u.id = ts.user_id AND ts.share_token = $1 LIMIT 1;"
+	err := scanUser(us.DB.QueryRowContext(ctx, query, token), user, &share.Tag, &share.Visibility)
+
+	return user, share, err
+}
+
+// HideLink hides or reveals one of the user's links on shared pages.
+func (us *UserService) HideLink(ctx context.Context, user *User, linkID int, hidden bool) error {
+	query := "UPDATE user_links SET hidden = $1 WHERE user_id = $2 AND link_id = $3;"
+	_, err := us.DB.ExecContext(ctx, query, hidden, user.ID, linkID)
+
+	return err
 }
 
 func (us *UserService) Addlink(ctx context.Context, user *User, link *Link) error {
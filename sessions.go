@@ -0,0 +1,48 @@
+package pinub
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// sessions lists the devices the user is signed in on and signs out single
+// devices or all of them.
+func (a *App) sessions() http.HandlerFunc {
+	tpl, _ := template.New("sessions.html").Funcs(funcs).ParseFS(tpls, "templates/sessions.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		if r.Method == http.MethodGet {
+			logins, err := a.db.Logins(r.Context(), user)
+			if err != nil {
+				http.Error(w, "cannot get sessions from database", http.StatusBadRequest)
+				return
+			}
+
+			render(w, r, tpl, logins)
+			return
+		}
+
+		// sign out everywhere, including this browser
+		if len(r.FormValue("all")) > 0 {
+			if err := a.db.DeleteLogins(r.Context(), user); err != nil {
+				http.Error(w, "cannot delete sessions", http.StatusBadRequest)
+				return
+			}
+			a.audit(r, user, user, "session.revoke-all", "")
+
+			http.Redirect(w, r, "/home", http.StatusSeeOther)
+			return
+		}
+
+		if err := a.db.DeleteLogin(r.Context(), user, r.FormValue("id")); err != nil {
+			http.Error(w, "cannot delete session", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "session.revoke", "")
+
+		a.flash(w, "session revoked")
+		http.Redirect(w, r, "/profile/sessions", http.StatusSeeOther)
+	}
+}
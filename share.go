@@ -0,0 +1,240 @@
+package pinub
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// usernames end up in /u/{username} and must not need escaping.
+var usernameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,31}$`)
+
+// sharing updates how the pins of the signed in user are shared with people
+// that have no account.
+func (a *App) sharing() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		if r.Method != http.MethodPost {
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		username := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+		if len(username) > 0 && !usernameRe.MatchString(username) {
+			a.flash(w, "username is not valid")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		if len(username) == 0 && len(user.Username) > 0 {
+			shares, err := a.db.TagShares(r.Context(), user)
+			if err != nil {
+				http.Error(w, "cannot get shared tags from database", http.StatusBadRequest)
+				return
+			}
+			for _, share := range shares {
+				if share.Visibility == VisibilityPublic {
+					a.flash(w, "public tags need a username")
+					http.Redirect(w, r, "/profile", http.StatusSeeOther)
+					return
+				}
+			}
+		}
+
+		visibility := r.FormValue("visibility")
+		switch visibility {
+		case VisibilityPrivate, VisibilityUnlisted:
+		case VisibilityPublic:
+			if len(username) == 0 {
+				a.flash(w, "public pins need a username")
+				http.Redirect(w, r, "/profile", http.StatusSeeOther)
+				return
+			}
+		default:
+			a.flash(w, "visibility is not valid")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		if err := a.db.UpdateSharing(r.Context(), user, username, visibility); err != nil {
+			a.flash(w, "username is already taken")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		// create a new unlisted link on first use or when the old one leaked
+		if visibility == VisibilityUnlisted && (len(user.ShareToken) == 0 || len(r.FormValue("regenerate")) > 0) {
+			token, err := randomToken()
+			if err != nil {
+				http.Error(w, "cannot create share link", http.StatusInternalServerError)
+				return
+			}
+			if err := a.db.UpdateShareToken(r.Context(), user, token); err != nil {
+				http.Error(w, "cannot create share link", http.StatusBadRequest)
+				return
+			}
+			a.audit(r, user, user, "token.share", "")
+		}
+
+		a.flash(w, "sharing updated")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	}
+}
+
+// hide hides a link of the signed in user on shared pages or reveals it
+// again. The link stays visible to the user.
+func (a *App) hide() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "link is not valid", http.StatusBadRequest)
+			return
+		}
+
+		hidden := r.FormValue("hidden") == "true"
+		if err := a.db.HideLink(r.Context(), user, id, hidden); err != nil {
+			http.Error(w, "cannot update link", http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, r, returnPath(r), http.StatusSeeOther)
+	}
+}
+
+// returnPath returns the page of pinub a form was sent from, to go back to
+// after it: the path in its return field, or else the one in the Referer
+// header, or else /. Paths pointing to other sites are ignored.
+func returnPath(r *http.Request) string {
+	if path := r.FormValue("return"); localPath(path) {
+		return path
+	}
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host {
+		if path := ref.RequestURI(); localPath(path) {
+			return path
+		}
+	}
+
+	return "/"
+}
+
+// localPath reports whether path is an absolute path on pinub. Browsers
+// read //host and /\host as addresses of other sites, and drop tabs and
+// newlines in addresses.
+func localPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\\t\r\n") {
+		return false
+	}
+	u, err := url.Parse(path)
+
+	return err == nil && len(u.Scheme) == 0 && len(u.Host) == 0
+}
+
+// listing is a list of pins shown to people without an account: the
+// shared pins of a user, or those with a tag. Page is the path it is shown
+// at, and TagPages the path pages of single tags are found below, if all of
+// them are shared. Private listings include hidden pins and are only found
+// in private feeds.
+type listing struct {
+	User     *User
+	Tag      string
+	Unlisted bool
+	Page     string
+	TagPages string
+	private  bool
+}
+
+// publicListing finds the pins shown at /u/{username}, or at
+// /u/{username}/t/{tag}: of a user who made their pins public, or of a tag
+// they made public.
+func (a *App) publicListing(r *http.Request) (*listing, bool) {
+	user, err := a.db.ByUsername(r.Context(), r.PathValue("username"))
+	if err != nil {
+		return nil, false
+	}
+	l := &listing{User: user, Page: "/u/" + user.Username}
+	if user.Visibility == VisibilityPublic {
+		l.TagPages = l.Page
+	}
+
+	tag := r.PathValue("tag")
+	if len(tag) == 0 {
+		return l, user.Visibility == VisibilityPublic
+	}
+	l.Tag, l.Page = tag, l.Page+"/t/"+tag
+	if user.Visibility == VisibilityPublic {
+		return l, true
+	}
+	share, err := a.db.TagShare(r.Context(), user, tag)
+
+	return l, err == nil && share.Visibility == VisibilityPublic
+}
+
+// unlistedListing finds the pins shown at /s/{token}: of a user who shared
+// their pins by link only, or of a tag shared by link only. The single tags
+// of a user's pins are at /s/{token}/t/{tag}.
+func (a *App) unlistedListing(r *http.Request) (*listing, bool) {
+	token, tag := r.PathValue("token"), r.PathValue("tag")
+
+	user, err := a.db.ByShareToken(r.Context(), token)
+	if err == nil && user.Visibility == VisibilityUnlisted {
+		l := &listing{User: user, Unlisted: true, Page: "/s/" + token, TagPages: "/s/" + token}
+		if len(tag) > 0 {
+			l.Tag, l.Page = tag, l.Page+"/t/"+tag
+		}
+		return l, true
+	}
+
+	user, share, err := a.db.ByTagShareToken(r.Context(), token)
+	if err != nil || share.Visibility != VisibilityUnlisted || len(tag) > 0 {
+		return nil, false
+	}
+
+	return &listing{User: user, Tag: share.Tag, Unlisted: true, Page: "/s/" + token}, true
+}
+
+// shared shows the pins find finds for the request.
+func (a *App) shared(find func(r *http.Request) (*listing, bool)) http.HandlerFunc {
+	tpl, _ := template.New("shared.html").Funcs(funcs).ParseFS(tpls, "templates/shared.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := find(r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		links, err := a.db.SharedLinks(r.Context(), l.User, l.Tag)
+		if err != nil {
+			slog.Error("cannot get shared links", err)
+			http.Error(w, "cannot get links from database", http.StatusInternalServerError)
+			return
+		}
+
+		// the newest pin is the last change visible on the page
+		modtime := *l.User.CreatedAt
+		if len(links) > 0 {
+			modtime = *links[0].CreatedAt
+		}
+
+		data := struct {
+			*listing
+			Links []Link
+		}{l, links}
+
+		renderCached(w, r, tpl, data, modtime)
+	}
+}
@@ -0,0 +1,181 @@
+package pinub
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// tags end up in /u/{username}/t/{tag} and are separated by spaces or
+// commas when typed.
+var tagRe = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}_-]{1,64}$`)
+
+// maxTags limits the tags of a single pin.
+const maxTags = 20
+
+// parseTags returns the tags in s, separated by spaces or commas, in lower
+// case, without a leading # and without duplicates, sorted.
+func parseTags(s string) ([]string, error) {
+	seen := map[string]bool{}
+	var tags []string
+	for _, tag := range strings.FieldsFunc(s, isTagSeparator) {
+		tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+		if len(tag) == 0 || seen[tag] {
+			continue
+		}
+		if !tagRe.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q is not valid, use letters, digits, - and _", tag)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("use at most %d tags", maxTags)
+	}
+	sort.Strings(tags)
+
+	return tags, nil
+}
+
+// suggestedTags returns the valid tags in s, like the keywords of a page,
+// and drops the others.
+func suggestedTags(s string) []string {
+	var valid []string
+	for _, field := range strings.FieldsFunc(s, isTagSeparator) {
+		tags, err := parseTags(field)
+		if err != nil || len(tags) == 0 || slices.Contains(valid, tags[0]) {
+			continue
+		}
+		valid = append(valid, tags[0])
+		if len(valid) == maxTags {
+			break
+		}
+	}
+	sort.Strings(valid)
+
+	return valid
+}
+
+func isTagSeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// linksData is the list of the user's own links, all of them or those with
+// a tag.
+type linksData struct {
+	User  *User
+	Links []Link
+	// Tags are all tags of the user, Tag the one Links are limited to and
+	// Share how it is shared.
+	Tags  []string
+	Tag   string
+	Share *TagShare
+	// Page is the path the list is shown at, to come back to after
+	// hiding a pin.
+	Page string
+}
+
+func (a *App) renderLinks(w http.ResponseWriter, r *http.Request, tpl *template.Template, user *User, tag string) {
+	data := linksData{User: user, Tag: tag, Page: r.URL.EscapedPath()}
+
+	var err error
+	if data.Links, err = a.db.Links(r.Context(), user, tag); err != nil {
+		http.Error(w, "cannot get links from database", http.StatusBadRequest)
+		return
+	}
+	if data.Tags, err = a.db.Tags(r.Context(), user); err != nil {
+		http.Error(w, "cannot get tags from database", http.StatusBadRequest)
+		return
+	}
+	if len(tag) > 0 {
+		if data.Share, err = a.db.TagShare(r.Context(), user, tag); err != nil {
+			http.Error(w, "cannot get tag from database", http.StatusBadRequest)
+			return
+		}
+	}
+
+	render(w, r, tpl, data)
+}
+
+// tagged shows the links of the signed in user with the tag in the path,
+// and how the tag is shared.
+func (a *App) tagged() http.HandlerFunc {
+	tpl, _ := template.New("index.html").Funcs(funcs).ParseFS(tpls, "templates/index.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		tag := r.PathValue("tag")
+		if !tagRe.MatchString(tag) {
+			http.NotFound(w, r)
+			return
+		}
+
+		a.renderLinks(w, r, tpl, user, tag)
+	}
+}
+
+// tagSharing updates how the pins of the signed in user with a tag are
+// shared with people that have no account. Sharing a tag adds to how all
+// pins are shared: the tag of a user whose pins are public is public
+// anyway.
+func (a *App) tagSharing() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		tag := r.FormValue("tag")
+		if !tagRe.MatchString(tag) {
+			http.Error(w, "tag is not valid", http.StatusBadRequest)
+			return
+		}
+		back := "/tags/" + tag
+
+		share, err := a.db.TagShare(r.Context(), user, tag)
+		if err != nil {
+			http.Error(w, "cannot get tag from database", http.StatusBadRequest)
+			return
+		}
+
+		share.Visibility = r.FormValue("visibility")
+		switch share.Visibility {
+		case VisibilityPrivate, VisibilityUnlisted:
+		case VisibilityPublic:
+			if len(user.Username) == 0 {
+				a.flash(w, "public tags need a username, set it in your profile")
+				http.Redirect(w, r, back, http.StatusSeeOther)
+				return
+			}
+		default:
+			a.flash(w, "visibility is not valid")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+
+		// create a new unlisted link on first use or when the old one leaked
+		regenerate := share.Visibility == VisibilityUnlisted && (len(share.ShareToken) == 0 || len(r.FormValue("regenerate")) > 0)
+		share.ShareToken = ""
+		if regenerate {
+			if share.ShareToken, err = randomToken(); err != nil {
+				http.Error(w, "cannot create share link", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := a.db.UpdateTagShare(r.Context(), user, share); err != nil {
+			slog.Error("cannot update tag share", err)
+			http.Error(w, "cannot update tag", http.StatusBadRequest)
+			return
+		}
+		if regenerate {
+			a.audit(r, user, user, "token.share", tag)
+		}
+
+		a.flash(w, "sharing updated")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,250 @@
+package pinub
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		tags []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"go", []string{"go"}, true},
+		{"Go, web  #reading", []string{"go", "reading", "web"}, true},
+		{"go go GO", []string{"go"}, true},
+		{"café 日本 c_2-x", []string{"c_2-x", "café", "日本"}, true},
+		{"#", nil, true},
+		{"a/b", nil, false},
+		{"a.b", nil, false},
+		{"<script>", nil, false},
+		{strings.Repeat("x", 65), nil, false},
+		{strings.Repeat("t ", maxTags+1), []string{"t"}, true},
+		{"a b c d e f g h i j k l m n o p q r s t u", nil, false},
+	}
+	for _, tt := range tests {
+		tags, err := parseTags(tt.in)
+		if (err == nil) != tt.ok || !slices.Equal(tags, tt.tags) {
+			t.Errorf("parseTags(%q) = %q, %v, want %q", tt.in, tags, err, tt.tags)
+		}
+	}
+}
+
+// pin pins the link with the tags.
+func (c *testClient) pin(link, tags string) {
+	c.t.Helper()
+
+	resp, body := c.post("/pin", url.Values{"url": {link}, "title": {link}, "tags": {tags}})
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("pin %s: %s %s", link, resp.Status, body)
+	}
+}
+
+// shows reports whether the page at path lists the link.
+func (c *testClient) shows(path, link string) bool {
+	c.t.Helper()
+
+	status, body := c.get(path)
+
+	return status == http.StatusOK && strings.Contains(body, `href="`+link+`"`)
+}
+
+var shareLinkPattern = regexp.MustCompile(`href="(/s/[^"]+)"`)
+
+func TestTags(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	createUser(t, a, "tags@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("tags@example.com")
+
+	c.pin("https://go.dev/", "go Web")
+	c.pin("https://example.com/", "web")
+	c.pin("https://example.org/", "")
+
+	if !c.shows("/tags/web", "https://go.dev/") || !c.shows("/tags/web", "https://example.com/") {
+		t.Error("pins with the tag missing")
+	}
+	if c.shows("/tags/web", "https://example.org/") || c.shows("/tags/go", "https://example.com/") {
+		t.Error("pins without the tag listed")
+	}
+
+	// saving the pin again replaces its tags
+	c.pin("https://go.dev/", "golang")
+	if c.shows("/tags/go", "https://go.dev/") || !c.shows("/tags/golang", "https://go.dev/") {
+		t.Error("tags not replaced")
+	}
+	link, err := a.db.Link(context.Background(), &User{ID: 1}, "https://go.dev/")
+	if err != nil || !slices.Equal(link.Tags, []string{"golang"}) {
+		t.Errorf("tags of pin: %v, %v", link.Tags, err)
+	}
+
+	if resp, _ := c.post("/pin", url.Values{"url": {"https://example.net/"}, "tags": {"a/b"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("pin with invalid tag: %s", resp.Status)
+	}
+}
+
+func TestTagSharing(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	user := createUser(t, a, "tags@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("tags@example.com")
+
+	c.pin("https://go.dev/", "go")
+	c.pin("https://example.com/", "go other")
+	c.pin("https://example.org/", "other")
+	link, _ := a.db.Link(context.Background(), user, "https://example.com/")
+	if err := a.db.HideLink(context.Background(), user, link.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := newTestClient(t, srv)
+
+	// public tags need a username
+	c.post("/sharing/tag", url.Values{"tag": {"go"}, "visibility": {VisibilityPublic}})
+	if share, _ := a.db.TagShare(context.Background(), user, "go"); share.Visibility != VisibilityPrivate {
+		t.Fatalf("tag shared as %s without username", share.Visibility)
+	}
+	c.post("/sharing", url.Values{"username": {"tagger"}, "visibility": {VisibilityPrivate}})
+	c.post("/sharing/tag", url.Values{"tag": {"go"}, "visibility": {VisibilityPublic}})
+
+	if !visitor.shows("/u/tagger/t/go", "https://go.dev/") {
+		t.Error("public tag not shown")
+	}
+	if visitor.shows("/u/tagger/t/go", "https://example.com/") {
+		t.Error("hidden pin shown")
+	}
+	for _, path := range []string{"/u/tagger", "/u/tagger/t/other"} {
+		if status, _ := visitor.get(path); status != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", path, status)
+		}
+	}
+	// the username cannot go while a tag is public
+	c.post("/sharing", url.Values{"username": {""}, "visibility": {VisibilityPrivate}})
+	if !visitor.shows("/u/tagger/t/go", "https://go.dev/") {
+		t.Error("public tag gone with the username")
+	}
+
+	// unlisted tags are only found by their link
+	c.post("/sharing/tag", url.Values{"tag": {"go"}, "visibility": {VisibilityUnlisted}})
+	if status, _ := visitor.get("/u/tagger/t/go"); status != http.StatusNotFound {
+		t.Errorf("unlisted tag public: %d", status)
+	}
+	_, body := c.get("/tags/go")
+	match := shareLinkPattern.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("no share link on tag page")
+	}
+	share := match[1]
+	if !visitor.shows(share, "https://go.dev/") || visitor.shows(share, "https://example.org/") {
+		t.Error("unlisted tag shows other pins")
+	}
+	if status, _ := visitor.get(share + "/t/other"); status != http.StatusNotFound {
+		t.Errorf("other tag below unlisted tag: %d", status)
+	}
+
+	// a new link replaces the old one
+	c.post("/sharing/tag", url.Values{"tag": {"go"}, "visibility": {VisibilityUnlisted}, "regenerate": {"1"}})
+	if status, _ := visitor.get(share); status != http.StatusNotFound {
+		t.Errorf("replaced link: %d", status)
+	}
+
+	// private again
+	c.post("/sharing/tag", url.Values{"tag": {"go"}, "visibility": {VisibilityPrivate}})
+	_, body = c.get("/tags/go")
+	if match := shareLinkPattern.FindStringSubmatch(body); match != nil {
+		if status, _ := visitor.get(match[1]); status != http.StatusNotFound {
+			t.Errorf("private tag: %d", status)
+		}
+	}
+}
+
+// All pins shared also shares the pages of their tags.
+func TestTagPages(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	createUser(t, a, "tags@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("tags@example.com")
+	c.pin("https://go.dev/", "go")
+	c.pin("https://example.org/", "other")
+	visitor := newTestClient(t, srv)
+
+	c.post("/sharing", url.Values{"username": {"tagger"}, "visibility": {VisibilityPublic}})
+	if !visitor.shows("/u/tagger/t/go", "https://go.dev/") || visitor.shows("/u/tagger/t/go", "https://example.org/") {
+		t.Error("tag page of public pins")
+	}
+	if _, body := visitor.get("/u/tagger"); !strings.Contains(body, `href="/u/tagger/t/go"`) {
+		t.Error("public pins do not link their tags")
+	}
+
+	c.post("/sharing", url.Values{"username": {"tagger"}, "visibility": {VisibilityUnlisted}})
+	user, _ := a.db.ByUsername(context.Background(), "tagger")
+	page := "/s/" + user.ShareToken
+	if !visitor.shows(page+"/t/go", "https://go.dev/") || visitor.shows(page+"/t/go", "https://example.org/") {
+		t.Error("tag page of unlisted pins")
+	}
+	if status, _ := visitor.get("/u/tagger/t/go"); status != http.StatusNotFound {
+		t.Errorf("tag of unlisted pins public: %d", status)
+	}
+}
+
+// Hiding a pin goes back to the page it was hidden on, never to another
+// site.
+func TestHideReturn(t *testing.T) {
+	a, srv, _ := newTestApp(t)
+	user := createUser(t, a, "hide@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("hide@example.com")
+	c.pin("https://go.dev/", "go")
+	link, _ := a.db.Link(context.Background(), user, "https://go.dev/")
+	id := strconv.Itoa(link.ID)
+
+	_, body := c.get("/tags/go")
+	if !strings.Contains(body, `name="return" value="/tags/go"`) {
+		t.Error("hide form does not return to the tag")
+	}
+
+	tests := []struct {
+		back, referer, want string
+	}{
+		{"/tags/go", "", "/tags/go"},
+		{"", srv.URL + "/tags/go?x=1", "/tags/go?x=1"},
+		{"", "", "/"},
+		{"//evil.example/", "", "/"},
+		{`/\evil.example/`, "", "/"},
+		{"/\t/evil.example/", "", "/"},
+		{"https://evil.example/", "", "/"},
+		{"", "https://evil.example/tags/go", "/"},
+		{"https://evil.example/", srv.URL + "/tags/go", "/tags/go"},
+	}
+	for _, tt := range tests {
+		form := url.Values{"id": {id}, "hidden": {"true"}, "return": {tt.back}, csrfField: {c.csrfToken()}}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/hide", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Referer", tt.referer)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || location != tt.want {
+			t.Errorf("return %q, Referer %q: %s to %q, want %q", tt.back, tt.referer, resp.Status, location, tt.want)
+		}
+	}
+
+	resp, err := c.Get(srv.URL + "/hide?id=" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("GET /hide: %s, Allow %q", resp.Status, resp.Header.Get("Allow"))
+	}
+}
@@ -0,0 +1,319 @@
+package pinub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dab.io/pinub/internal/cookies"
+	"dab.io/pinub/internal/totp"
+	"golang.org/x/exp/slog"
+	"rsc.io/qr"
+)
+
+const (
+	// secondFactorCookieName remembers whose password was correct while
+	// the user enters their code.
+	secondFactorCookieName = "signin"
+	secondFactorMaxAge     = 5 * 60
+
+	// totpCookieName holds the secret of a TOTP setup until it is confirmed
+	// with a code.
+	totpCookieName = "totp"
+	totpMaxAge     = 10 * 60
+
+	recoveryCodeCount = 10
+)
+
+// startSecondFactor asks the user, whose password was correct, for a code
+// before signing them in.
+func (a *App) startSecondFactor(w http.ResponseWriter, r *http.Request, user *User, remember bool) {
+	cookie := http.Cookie{
+		Name:     secondFactorCookieName,
+		Value:    strconv.Itoa(user.ID) + ":" + strconv.FormatBool(remember),
+		Path:     "/signin",
+		MaxAge:   secondFactorMaxAge,
+		HttpOnly: true,
+		Secure:   !a.InsecureDev,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if err := cookies.WriteEncrypted(w, cookie, a.Keys); err != nil {
+		http.Error(w, "cannot save cookie", http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/signin/code", http.StatusSeeOther)
+}
+
+// signinCode is the second step of signing in with two-factor
+// authentication. It takes a code from the authenticator app or a recovery
+// code.
+func (a *App) signinCode() http.HandlerFunc {
+	tpl, _ := template.New("signin_code.html").Funcs(funcs).ParseFS(tpls, "templates/signin_code.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		value, err := cookies.ReadEncrypted(r, secondFactorCookieName, a.Keys)
+		if err != nil {
+			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			return
+		}
+		id, remember, _ := strings.Cut(value, ":")
+		userID, _ := strconv.Atoi(id)
+		user, err := a.db.ByID(r.Context(), userID)
+		if err != nil || !user.TwoFactor() {
+			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			return
+		}
+
+		f := newForm(r)
+
+		// show form
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		key := strconv.Itoa(user.ID)
+		if !a.codeAttempts.Allow(key) {
+			f.Fail("code", "too many wrong codes, try again in a few minutes")
+			renderStatus(w, r, http.StatusTooManyRequests, tpl, f)
+			return
+		}
+
+		ok, recovery, err := a.checkSecondFactor(r.Context(), user, f.Value("code"))
+		if err != nil {
+			http.Error(w, "cannot check code", http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			a.codeAttempts.Add(key)
+			a.audit(r, nil, user, "signin.failed", "two-factor code")
+			f.Fail("code", "code not valid")
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, f)
+			return
+		}
+		a.codeAttempts.Reset(key)
+
+		http.SetCookie(w, &http.Cookie{Name: secondFactorCookieName, Path: "/signin", MaxAge: -1})
+		method := "two-factor code"
+		if recovery {
+			method = "recovery code"
+		}
+		if err := a.startSession(w, r, user, remember == "true", method); err != nil {
+			http.Error(w, "cannot create session", http.StatusBadRequest)
+			return
+		}
+
+		if recovery {
+			left, err := a.db.RecoveryCodes(r.Context(), user)
+			if err != nil {
+				slog.Error("cannot count recovery codes", err)
+			}
+			a.flash(w, "recovery code used, "+strconv.Itoa(left)+" left")
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func isTOTPCode(code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	_, err := strconv.Atoi(code)
+
+	return err == nil && len(code) == totp.Digits
+}
+
+// checkSecondFactor checks code as TOTP code of the user, or as one of their
+// recovery codes if it does not look like a TOTP code. recovery reports
+// which one it was.
+func (a *App) checkSecondFactor(ctx context.Context, user *User, code string) (ok, recovery bool, err error) {
+	if isTOTPCode(code) {
+		step, valid := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !valid {
+			return false, false, nil
+		}
+		ok, err = a.db.UseTOTP(ctx, user, step)
+
+		return ok, false, err
+	}
+
+	ok, err = a.db.UseRecoveryCode(ctx, user, normalizeRecoveryCode(code))
+
+	return ok, true, err
+}
+
+// generateRecoveryCodes returns codes of 80 random bits, written as four
+// groups of four characters.
+func generateRecoveryCodes() ([]string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(enc.EncodeToString(b))
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode accepts recovery codes without dashes and in any
+// case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 16 {
+		return code
+	}
+
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+}
+
+// twoFactor sets up, turns off and renews the recovery codes of two-factor
+// authentication for the signed in user.
+func (a *App) twoFactor() http.HandlerFunc {
+	tpl, _ := template.New("totp.html").Funcs(funcs).ParseFS(tpls, "templates/totp.html", layoutTpl)
+
+	type totpData struct {
+		Form   *form
+		Secret string
+		QR     template.URL
+		// Password asks for the current password before turning it on.
+		Password bool
+		// Codes are the new recovery codes, shown just once.
+		Codes []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+		f := newForm(r)
+		data := totpData{Form: f, Password: len(user.Password) > 0}
+
+		action := ""
+		if r.Method == http.MethodPost {
+			action = f.Value("action")
+		}
+		if action == "disable" || action == "codes" {
+			if !user.TwoFactor() {
+				http.Redirect(w, r, "/profile", http.StatusSeeOther)
+				return
+			}
+			if !a.confirmed(r, user, f.Value("pass")) {
+				a.flash(w, confirmFailure(user))
+				http.Redirect(w, r, "/profile", http.StatusSeeOther)
+				return
+			}
+		}
+
+		switch {
+		case action == "disable":
+			if err := a.db.DisableTOTP(r.Context(), user); err != nil {
+				http.Error(w, "cannot disable two-factor authentication", http.StatusBadRequest)
+				return
+			}
+			a.audit(r, user, user, "2fa.disable", "")
+
+			a.flash(w, "two-factor authentication turned off")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+
+		case action == "codes":
+			codes, err := generateRecoveryCodes()
+			if err != nil {
+				http.Error(w, "cannot create recovery codes", http.StatusInternalServerError)
+				return
+			}
+			if err := a.db.ReplaceRecoveryCodes(r.Context(), user, codes); err != nil {
+				http.Error(w, "cannot save recovery codes", http.StatusBadRequest)
+				return
+			}
+			a.audit(r, user, user, "2fa.recovery-codes", "")
+
+			data.Codes = codes
+			render(w, r, tpl, data)
+			return
+
+		case user.TwoFactor():
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		// keep the secret of a setup in progress, so a mistyped code does
+		// not need a new scan
+		secret, err := cookies.ReadEncrypted(r, totpCookieName, a.Keys)
+		if err != nil {
+			if secret, err = totp.GenerateSecret(); err != nil {
+				http.Error(w, "cannot create secret", http.StatusInternalServerError)
+				return
+			}
+			cookie := http.Cookie{
+				Name:     totpCookieName,
+				Value:    secret,
+				Path:     "/profile/2fa",
+				MaxAge:   totpMaxAge,
+				HttpOnly: true,
+				Secure:   !a.InsecureDev,
+				SameSite: http.SameSiteLaxMode,
+			}
+			if err := cookies.WriteEncrypted(w, cookie, a.Keys); err != nil {
+				http.Error(w, "cannot save cookie", http.StatusBadRequest)
+				return
+			}
+		}
+		data.Secret = secret
+		data.QR = qrCode(totp.URI("pinub", user.Email, secret))
+
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, data)
+			return
+		}
+
+		// like turning it off, turning it on needs the password, so a
+		// session left open cannot lock out the owner of the account
+		if !a.confirmed(r, user, f.Value("pass")) {
+			f.Fail("pass", confirmFailure(user))
+		}
+		step, ok := totp.Validate(secret, f.Value("code"), time.Now())
+		if !ok {
+			f.Fail("code", "code not valid, check the time of your device")
+		}
+		if !f.Valid() {
+			renderStatus(w, r, http.StatusUnprocessableEntity, tpl, data)
+			return
+		}
+
+		codes, err := generateRecoveryCodes()
+		if err != nil {
+			http.Error(w, "cannot create recovery codes", http.StatusInternalServerError)
+			return
+		}
+		if err := a.db.EnableTOTP(r.Context(), user, secret, step, codes); err != nil {
+			http.Error(w, "cannot enable two-factor authentication", http.StatusBadRequest)
+			return
+		}
+		a.audit(r, user, user, "2fa.enable", "")
+		http.SetCookie(w, &http.Cookie{Name: totpCookieName, Path: "/profile/2fa", MaxAge: -1})
+
+		data.Codes = codes
+		render(w, r, tpl, data)
+	}
+}
+
+// qrCode returns the text as QR code image to embed in a page.
+func qrCode(text string) template.URL {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		slog.Error("cannot encode QR code", err)
+		return ""
+	}
+	code.Scale = 4
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()))
+}
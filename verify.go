@@ -0,0 +1,238 @@
+package pinub
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"dab.io/pinub/internal/mailer"
+	"golang.org/x/exp/slog"
+)
+
+// What accounts with an unconfirmed email address may do.
+const (
+	UnverifiedAllow = "allow" // everything
+	UnverifiedLimit = "limit" // look at their pins, but change nothing
+	UnverifiedBlock = "block" // only confirm the address from the profile
+)
+
+const (
+	// emailVerificationTTL is how long the link in a confirmation email
+	// works.
+	emailVerificationTTL = 48 * time.Hour
+	// emailRevertTTL is how long the link to restore the previous address
+	// works, which is sent when the address changes.
+	emailRevertTTL = 7 * 24 * time.Hour
+)
+
+// verify confirms the email address the link was sent to. After a change
+// of address, the previous address is told about it and gets a link to
+// restore it.
+func (a *App) verify() http.HandlerFunc {
+	tpl, _ := template.New("email_verify.html").Funcs(funcs).ParseFS(tpls, "templates/email_verify.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// keep the token out of the Referer header of links on the page
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		f := newForm(r)
+
+		// Opening the link only asks, so that mail scanners following
+		// links do not confirm addresses nobody looked at.
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		user, previous, err := a.db.VerifyEmail(r.Context(), f.Value("token"))
+		if err != nil {
+			a.flash(w, "the link to confirm your email address is not valid anymore")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		if previous != user.Email {
+			a.audit(r, user, user, "email.change", previous+" to "+user.Email)
+			revertURL := a.absURL(r, "/verify/revert")
+			a.background(func(ctx context.Context) {
+				if err := a.sendEmailChanged(ctx, user, previous, revertURL); err != nil {
+					slog.Error("cannot send email change notice", err)
+				}
+			})
+		}
+
+		a.flash(w, "email address confirmed")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// resendVerification sends a new link to confirm the email address the
+// user registered with or wants to change to.
+func (a *App) resendVerification() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+
+		email, err := a.db.PendingEmail(r.Context(), user)
+		if err != nil {
+			http.Error(w, "cannot get pending email from database", http.StatusBadRequest)
+			return
+		}
+		if len(email) == 0 {
+			if user.Verified() {
+				http.Redirect(w, r, "/profile", http.StatusSeeOther)
+				return
+			}
+			email = user.Email
+		}
+
+		a.startVerification(r, user, email)
+
+		a.flash(w, "a new link to confirm "+email+" is on its way")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	}
+}
+
+// startVerification mails a link to confirm email as the address of the
+// user. It returns before the mail is sent.
+func (a *App) startVerification(r *http.Request, user *User, email string) {
+	verifyURL := a.absURL(r, "/verify")
+	a.background(func(ctx context.Context) {
+		if err := a.sendVerification(ctx, user, email, verifyURL); err != nil {
+			slog.Error("cannot send email verification", err)
+		}
+	})
+}
+
+func (a *App) sendVerification(ctx context.Context, user *User, email, verifyURL string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := a.db.CreateEmailVerification(ctx, user, email, token, emailVerificationTTL); err != nil {
+		return err
+	}
+
+	subject := "Confirm your pinub email address"
+	intro := "Welcome to pinub! Please confirm that this is your email address."
+	if email != user.Email {
+		subject = "Confirm your new pinub email address"
+		intro = "Someone asked to change the email address of a pinub account to this one."
+	}
+
+	link := verifyURL + "?token=" + url.QueryEscape(token)
+	return a.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: subject,
+		Body: fmt.Sprintf("%s\n\nOpen this link within the next %.0f hours to confirm it:\n\n%s\n\n"+
+			"If it was not you, ignore this email.\n",
+			intro, emailVerificationTTL.Hours(), link),
+	})
+}
+
+// sendEmailChanged tells the previous address of the user that it was
+// changed, with a link to revertURL that restores it.
+func (a *App) sendEmailChanged(ctx context.Context, user *User, previous, revertURL string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := a.db.CreateEmailRevert(ctx, user, previous, token, emailRevertTTL); err != nil {
+		return err
+	}
+
+	link := revertURL + "?token=" + url.QueryEscape(token)
+	return a.Mailer.Send(ctx, mailer.Message{
+		To:      previous,
+		Subject: "Your pinub email address was changed",
+		Body: fmt.Sprintf("The email address of your pinub account was changed to %s.\n\n"+
+			"If it was not you, open this link within the next %.0f days to change it back\n"+
+			"to this address, sign out everywhere and choose a new password:\n\n%s\n",
+			user.Email, emailRevertTTL.Hours()/24, link),
+	})
+}
+
+// revertEmail gives an account back the address it had before its email
+// was changed, from the link sent to that address. The account is signed
+// out everywhere and the user goes on to choose a new password, as
+// whoever changed the address might know the current one.
+func (a *App) revertEmail() http.HandlerFunc {
+	tpl, _ := template.New("email_revert.html").Funcs(funcs).ParseFS(tpls, "templates/email_revert.html", layoutTpl)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// keep the token out of the Referer header of links on the page
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		f := newForm(r)
+
+		// Opening the link only asks, so that mail scanners following
+		// links do not sign anybody out.
+		if r.Method == http.MethodGet {
+			render(w, r, tpl, f)
+			return
+		}
+
+		user, err := a.db.RevertEmail(r.Context(), f.Value("token"))
+		if err != nil {
+			a.flash(w, "the link to restore your email address is not valid anymore")
+			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			return
+		}
+		a.audit(r, user, user, "email.revert", "")
+
+		if a.DisableLocalSignin {
+			a.flash(w, "email address restored and signed out everywhere")
+			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			return
+		}
+
+		token, err := randomToken()
+		if err != nil {
+			http.Error(w, "cannot create token", http.StatusInternalServerError)
+			return
+		}
+		if err := a.db.CreatePasswordReset(r.Context(), user, token, passwordResetTTL); err != nil {
+			http.Error(w, "cannot create password reset", http.StatusBadRequest)
+			return
+		}
+
+		a.flash(w, "email address restored and signed out everywhere, now choose a new password")
+		http.Redirect(w, r, "/reset?token="+url.QueryEscape(token), http.StatusSeeOther)
+	}
+}
+
+// restricted reports whether the user may not do what the request asks for
+// because they have not confirmed their email address yet.
+func (a *App) restricted(user *User, change bool) bool {
+	if user.Verified() {
+		return false
+	}
+
+	switch a.Unverified {
+	case UnverifiedAllow, "":
+		return false
+	case UnverifiedLimit:
+		return change
+	default:
+		return true
+	}
+}
+
+// verified keeps users from next as far as restricted says. Requests other
+// than GET count as changes.
+func (a *App) verified(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(*User)
+		change := r.Method != http.MethodGet && r.Method != http.MethodHead
+
+		if a.restricted(user, change) {
+			a.flash(w, "please confirm your email address first")
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		next(w, r)
+	})
+}
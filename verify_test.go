@@ -0,0 +1,43 @@
+package pinub
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var verifyLinkPattern = regexp.MustCompile(`/verify\?token=(\S+)`)
+
+// Mail scanners open the links in emails, so opening the link to confirm
+// an address only asks and the button confirms it.
+func TestVerifyEmail(t *testing.T) {
+	a, srv, m := newTestApp(t)
+	createUser(t, a, "old@example.com")
+	c := newTestClient(t, srv)
+	c.signIn("old@example.com")
+	ctx := context.Background()
+
+	c.post("/profile", url.Values{"email": {"new@example.com"}, "pass": {testPassword}})
+	msg := waitForMail(t, a, m)
+	match := verifyLinkPattern.FindStringSubmatch(msg.Body)
+	if msg.To != "new@example.com" || match == nil {
+		t.Fatalf("confirmation email to %s: %q", msg.To, msg.Body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+
+	// the link works without being signed in
+	visitor := newTestClient(t, srv)
+	if _, body := visitor.get("/verify?token=" + url.QueryEscape(token)); !strings.Contains(body, "Confirm Email Address") {
+		t.Error("link does not ask to confirm")
+	}
+	if _, err := a.db.ByEmail(ctx, "new@example.com"); err == nil {
+		t.Error("opening the link confirmed the address")
+	}
+
+	visitor.post("/verify", url.Values{"token": {token}})
+	if _, err := a.db.ByEmail(ctx, "new@example.com"); err != nil {
+		t.Errorf("address not confirmed: %v", err)
+	}
+}